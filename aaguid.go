@@ -0,0 +1,214 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// bundledAAGUIDs is a snapshot of the community list of passkey providers
+// (https://github.com/passkeydeveloper/passkey-authenticator-aaguids), in its format
+//
+//go:embed aaguid.json
+var bundledAAGUIDs []byte
+
+// AAGUIDEntry is the provider of an authenticator model, icons are data: URIs
+type AAGUIDEntry struct {
+	Name      string `json:"name"`
+	IconDark  string `json:"icon_dark,omitempty"`
+	IconLight string `json:"icon_light,omitempty"`
+}
+
+// AAGUIDRegistry names authenticator models. Overrides win over the community list,
+// the list wins over the MDS blob, the blob has descriptions of certified authenticators only.
+type AAGUIDRegistry struct {
+	mu        sync.RWMutex
+	community map[uuid.UUID]AAGUIDEntry
+	overrides map[uuid.UUID]AAGUIDEntry
+}
+
+// aaguids names new passkeys and the ones in listings
+var aaguids = NewAAGUIDRegistry()
+
+func NewAAGUIDRegistry() *AAGUIDRegistry {
+	return &AAGUIDRegistry{
+		community: map[uuid.UUID]AAGUIDEntry{},
+		overrides: map[uuid.UUID]AAGUIDEntry{},
+	}
+}
+
+// LoadCommunity replaces the community entries with the JSON list
+func (a *AAGUIDRegistry) LoadCommunity(data []byte) error {
+	entries, err := parseAAGUIDs(data)
+	if err != nil {
+		return fmt.Errorf("can't parse AAGUID list: %w", err)
+	}
+
+	a.mu.Lock()
+	a.community = entries
+	a.mu.Unlock()
+
+	return nil
+}
+
+// LoadOverrides replaces the admin entries with the JSON file in the community list format
+func (a *AAGUIDRegistry) LoadOverrides(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("can't read AAGUID overrides: %w", err)
+	}
+
+	entries, err := parseAAGUIDs(data)
+	if err != nil {
+		return fmt.Errorf("can't parse AAGUID overrides: %w", err)
+	}
+
+	a.mu.Lock()
+	a.overrides = entries
+	a.mu.Unlock()
+
+	return nil
+}
+
+// Lookup returns the entry of the AAGUID, the zero AAGUID of authenticators without attestation is unknown
+func (a *AAGUIDRegistry) Lookup(aaguid []byte) (AAGUIDEntry, bool) {
+	id, err := uuid.FromBytes(aaguid)
+	if err != nil || id == uuid.Nil {
+		return AAGUIDEntry{}, false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if e, ok := a.overrides[id]; ok {
+		// an override that only renames the model keeps the icons of the list
+		if c, ok := a.community[id]; ok && e.IconDark == "" && e.IconLight == "" {
+			e.IconDark, e.IconLight = c.IconDark, c.IconLight
+		}
+
+		return e, true
+	}
+	if e, ok := a.community[id]; ok {
+		return e, true
+	}
+	if mds != nil {
+		if e, ok := mds.Entry(id); ok && e.MetadataStatement.Description != "" {
+			return AAGUIDEntry{Name: e.MetadataStatement.Description, IconLight: e.MetadataStatement.Icon}, true
+		}
+	}
+
+	return AAGUIDEntry{}, false
+}
+
+// parseAAGUIDs is a helper function to parse {"<aaguid>": {"name": ...}} lists
+func parseAAGUIDs(data []byte) (map[uuid.UUID]AAGUIDEntry, error) {
+	var raw map[string]AAGUIDEntry
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[uuid.UUID]AAGUIDEntry, len(raw))
+	for k, e := range raw {
+		id, err := uuid.Parse(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AAGUID %q: %w", k, err)
+		}
+		if e.Name == "" {
+			return nil, fmt.Errorf("AAGUID %s has no name", k)
+		}
+		entries[id] = e
+	}
+
+	return entries, nil
+}
+
+// nameCredential names the new passkey after its provider, "Passkey" if it is unknown. A user with several
+// passkeys of one provider gets "Name (2)" and so on.
+func nameCredential(user PasskeyUser, id, aaguid []byte) {
+	base := "Passkey"
+	if e, ok := aaguids.Lookup(aaguid); ok {
+		base = e.Name
+	}
+
+	taken := map[string]bool{}
+	for _, c := range user.WebAuthnCredentials() {
+		taken[user.CredentialMeta(c.ID).Name] = true
+	}
+
+	name := base
+	for i := 2; taken[name]; i++ {
+		name = fmt.Sprintf("%s (%d)", base, i)
+	}
+
+	user.UpdateCredentialMeta(id, func(m *CredentialMeta) {
+		m.Name = name
+		if m.CreatedAt.IsZero() {
+			m.CreatedAt = time.Now()
+		}
+	})
+}
+
+// credentialView is a passkey in the listing
+type credentialView struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	AAGUID    string    `json:"aaguid"`
+	Provider  string    `json:"provider,omitempty"`
+	IconDark  string    `json:"iconDark,omitempty"`
+	IconLight string    `json:"iconLight,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Current   bool      `json:"current"`
+	// Discoverable tells whether the passkey works for login without username, null if unknown
+	Discoverable   *bool `json:"discoverable"`
+	BackupEligible bool  `json:"backupEligible"`
+	BackupState    bool  `json:"backupState"`
+	// Attestation is the attestation verified at registration, null for passkeys registered before it was kept
+	Attestation *AttestationInfo `json:"attestation"`
+	// Compromised is the undesired status of the authenticator model, null if there is none
+	Compromised *AuthenticatorStatus `json:"compromised"`
+}
+
+// ListCredentials returns the passkeys of the logged-in user with their providers, oldest first
+func ListCredentials(w http.ResponseWriter, r *http.Request) {
+	user, p, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	views := make([]credentialView, 0, len(user.WebAuthnCredentials()))
+	for _, c := range user.WebAuthnCredentials() {
+		meta := user.CredentialMeta(c.ID)
+		v := credentialView{
+			ID:             encodeCredentialID(c.ID),
+			Name:           meta.Name,
+			CreatedAt:      meta.CreatedAt,
+			Current:        string(c.ID) == string(p.CredentialID),
+			Discoverable:   meta.Discoverable,
+			BackupEligible: c.Flags.BackupEligible,
+			BackupState:    c.Flags.BackupState,
+			Attestation:    meta.Attestation,
+			Compromised:    meta.Compromised,
+		}
+		if id, err := uuid.FromBytes(c.Authenticator.AAGUID); err == nil {
+			v.AAGUID = id.String()
+		}
+		if e, ok := aaguids.Lookup(c.Authenticator.AAGUID); ok {
+			v.Provider, v.IconDark, v.IconLight = e.Name, e.IconDark, e.IconLight
+		}
+		if v.Name == "" {
+			v.Name = v.Provider
+		}
+		views = append(views, v)
+	}
+
+	sort.SliceStable(views, func(i, j int) bool { return views[i].CreatedAt.Before(views[j].CreatedAt) })
+
+	JSONResponse(w, views, http.StatusOK)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/google/uuid"
+)
+
+func TestBundledAAGUIDs(t *testing.T) {
+	entries, err := parseAAGUIDs(bundledAAGUIDs)
+	if err != nil {
+		t.Fatalf("can't parse bundled list: %s", err)
+	}
+	if e := entries[uuid.MustParse("fbfc3007-154e-4ecc-8c0b-6e020557d7bd")]; e.Name != "iCloud Keychain" {
+		t.Fatalf("iCloud Keychain is named %q", e.Name)
+	}
+}
+
+func TestAAGUIDLookup(t *testing.T) {
+	listed, overridden, certified := uuid.New(), uuid.New(), uuid.New()
+	reg := NewAAGUIDRegistry()
+	if err := reg.LoadCommunity([]byte(`{
+		"` + listed.String() + `": {"name": "Listed", "icon_dark": "data:dark", "icon_light": "data:light"},
+		"` + overridden.String() + `": {"name": "Listed too", "icon_light": "data:light"}
+	}`)); err != nil {
+		t.Fatalf("can't load list: %s", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	if err := os.WriteFile(path, []byte(`{"`+overridden.String()+`": {"name": "In-house"}}`), 0o600); err != nil {
+		t.Fatalf("can't write overrides: %s", err)
+	}
+	if err := reg.LoadOverrides(path); err != nil {
+		t.Fatalf("can't load overrides: %s", err)
+	}
+
+	mds = &MetadataBLOB{entries: map[uuid.UUID]metadata.MetadataBLOBPayloadEntry{
+		certified: {MetadataStatement: metadata.MetadataStatement{Description: "Certified key"}},
+		listed:    {MetadataStatement: metadata.MetadataStatement{Description: "Blob name"}},
+	}}
+	t.Cleanup(func() { mds = nil })
+
+	for _, tc := range []struct {
+		aaguid    uuid.UUID
+		name      string
+		iconLight string
+		known     bool
+	}{
+		{listed, "Listed", "data:light", true},
+		{overridden, "In-house", "data:light", true},
+		{certified, "Certified key", "", true},
+		{uuid.Nil, "", "", false},
+		{uuid.New(), "", "", false},
+	} {
+		e, ok := reg.Lookup(tc.aaguid[:])
+		if ok != tc.known || e.Name != tc.name || e.IconLight != tc.iconLight {
+			t.Errorf("%s: got %+v, %v", tc.aaguid, e, ok)
+		}
+	}
+}
+
+func TestLoadAAGUIDOverridesInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"no name":      `{"` + uuid.NewString() + `": {"icon_light": "data:light"}}`,
+		"invalid uuid": `{"yubikey": {"name": "YubiKey"}}`,
+		"not json":     `[`,
+	} {
+		path := filepath.Join(dir, "overrides.json")
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatalf("can't write overrides: %s", err)
+		}
+		if err := NewAAGUIDRegistry().LoadOverrides(path); err == nil {
+			t.Errorf("%s: overrides are accepted", name)
+		}
+	}
+	if err := NewAAGUIDRegistry().LoadOverrides(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing file is accepted")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AndroidApp is an Android app allowed to use the passkeys of the RP ID. Fingerprints are SHA-256
+// fingerprints of its signing certificates, as printed by keytool: "AB:CD:...".
+type AndroidApp struct {
+	Package      string   `json:"package"`
+	Fingerprints []string `json:"sha256CertFingerprints"`
+}
+
+// origins returns the android:apk-key-hash: origins Android sends in clientDataJSON for the app
+func (a AndroidApp) origins() ([]string, error) {
+	if a.Package == "" {
+		return nil, fmt.Errorf("android app without package")
+	}
+	if len(a.Fingerprints) == 0 {
+		return nil, fmt.Errorf("android app %s has no certificate fingerprints", a.Package)
+	}
+
+	origins := make([]string, 0, len(a.Fingerprints))
+	for _, f := range a.Fingerprints {
+		hash, err := hex.DecodeString(strings.ReplaceAll(f, ":", ""))
+		if err != nil || len(hash) != 32 {
+			return nil, fmt.Errorf("android app %s: invalid SHA-256 fingerprint %q", a.Package, f)
+		}
+		origins = append(origins, "android:apk-key-hash:"+base64.RawURLEncoding.EncodeToString(hash))
+	}
+
+	return origins, nil
+}
+
+// AppleAppSiteAssociation serves /.well-known/apple-app-site-association with the webcredentials apps
+// of the request tenant
+func AppleAppSiteAssociation(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	if len(t.AppleAppIDs) == 0 {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	JSONResponse(w, map[string]interface{}{
+		"webcredentials": map[string][]string{"apps": t.AppleAppIDs},
+	}, http.StatusOK)
+}
+
+// AssetLinks serves /.well-known/assetlinks.json, it lets the Android apps of the request tenant
+// get login credentials of the site
+func AssetLinks(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	if len(t.AndroidApps) == 0 {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	type target struct {
+		Namespace    string   `json:"namespace"`
+		PackageName  string   `json:"package_name"`
+		Fingerprints []string `json:"sha256_cert_fingerprints"`
+	}
+	type statement struct {
+		Relation []string `json:"relation"`
+		Target   target   `json:"target"`
+	}
+
+	statements := make([]statement, 0, len(t.AndroidApps))
+	for _, a := range t.AndroidApps {
+		fingerprints := make([]string, 0, len(a.Fingerprints))
+		for _, f := range a.Fingerprints {
+			fingerprints = append(fingerprints, strings.ToUpper(f))
+		}
+
+		statements = append(statements, statement{
+			Relation: []string{"delegate_permission/common.get_login_creds"},
+			Target:   target{Namespace: "android_app", PackageName: a.Package, Fingerprints: fingerprints},
+		})
+	}
+
+	JSONResponse(w, statements, http.StatusOK)
+}
+
+// checkAppleAppIDs checks that the ids are "TEAMID.bundle.id"
+func checkAppleAppIDs(ids []string) error {
+	for _, id := range ids {
+		team, bundle, ok := strings.Cut(id, ".")
+		if !ok || len(team) != 10 || bundle == "" {
+			return fmt.Errorf("apple app id %q must be TEAMID.bundle.id", id)
+		}
+	}
+
+	return nil
+}
+
+// parseAndroidApps is a helper function to parse "package=FP|FP,package=FP"
+func parseAndroidApps(s string) []AndroidApp {
+	var apps []AndroidApp
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		pkg, fps, _ := strings.Cut(item, "=")
+		app := AndroidApp{Package: pkg}
+		for _, f := range strings.Split(fps, "|") {
+			if f = strings.TrimSpace(f); f != "" {
+				app.Fingerprints = append(app.Fingerprints, f)
+			}
+		}
+		apps = append(apps, app)
+	}
+
+	return apps
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testFingerprint = "fa:c6:17:45:dc:09:03:78:6f:b9:ed:e6:2a:96:2b:39:9f:73:48:f0:bb:6f:89:9b:83:32:66:75:91:03:3b:9c"
+
+func TestAndroidAppOrigins(t *testing.T) {
+	apps := parseAndroidApps("com.example.app=" + testFingerprint + ", com.example.other=")
+	if len(apps) != 2 || apps[0].Package != "com.example.app" || len(apps[0].Fingerprints) != 1 {
+		t.Fatalf("unexpected apps %+v", apps)
+	}
+
+	origins, err := apps[0].origins()
+	if err != nil {
+		t.Fatalf("can't get origins: %s", err)
+	}
+	if want := "android:apk-key-hash:-sYXRdwJA3hvue3mKpYrOZ9zSPC7b4mbgzJmdZEDO5w"; len(origins) != 1 || origins[0] != want {
+		t.Fatalf("got %v, want %s", origins, want)
+	}
+
+	if _, err := apps[1].origins(); err == nil {
+		t.Fatal("app without fingerprints is accepted")
+	}
+	if _, err := (AndroidApp{Package: "com.example.app", Fingerprints: []string{"AB:CD"}}).origins(); err == nil {
+		t.Fatal("short fingerprint is accepted")
+	}
+}
+
+func TestCheckAppleAppIDs(t *testing.T) {
+	if err := checkAppleAppIDs([]string{"ABCDE12345.com.example.app"}); err != nil {
+		t.Fatalf("valid id: %s", err)
+	}
+	for _, id := range []string{"com.example.app", "ABC.com.example.app", "ABCDE12345."} {
+		if err := checkAppleAppIDs([]string{id}); err == nil {
+			t.Errorf("%s is accepted", id)
+		}
+	}
+}
+
+func TestAppAssociationFiles(t *testing.T) {
+	tenant := newTestTenant(t)
+
+	for _, h := range []http.HandlerFunc{AppleAppSiteAssociation, AssetLinks} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("without apps: status %d, want %d", w.Code, http.StatusNotFound)
+		}
+	}
+
+	tenant.AppleAppIDs = []string{"ABCDE12345.com.example.app"}
+	tenant.AndroidApps = []AndroidApp{{Package: "com.example.app", Fingerprints: []string{testFingerprint}}}
+
+	w := httptest.NewRecorder()
+	AppleAppSiteAssociation(w, httptest.NewRequest(http.MethodGet, "/.well-known/apple-app-site-association", nil))
+	var aasa struct {
+		WebCredentials struct {
+			Apps []string `json:"apps"`
+		} `json:"webcredentials"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &aasa); err != nil || len(aasa.WebCredentials.Apps) != 1 ||
+		aasa.WebCredentials.Apps[0] != "ABCDE12345.com.example.app" {
+		t.Fatalf("unexpected apple-app-site-association %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	AssetLinks(w, httptest.NewRequest(http.MethodGet, "/.well-known/assetlinks.json", nil))
+	var links []struct {
+		Relation []string `json:"relation"`
+		Target   struct {
+			Namespace    string   `json:"namespace"`
+			PackageName  string   `json:"package_name"`
+			Fingerprints []string `json:"sha256_cert_fingerprints"`
+		} `json:"target"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &links); err != nil || len(links) != 1 {
+		t.Fatalf("unexpected assetlinks %s", w.Body)
+	}
+	link := links[0]
+	if link.Relation[0] != "delegate_permission/common.get_login_creds" || link.Target.Namespace != "android_app" ||
+		link.Target.PackageName != "com.example.app" || link.Target.Fingerprints[0] != "FA:C6:17:45:DC:09:03:78:6F:B9:ED:E6:2A:96:2B:39:9F:73:48:F0:BB:6F:89:9B:83:32:66:75:91:03:3B:9C" {
+		t.Fatalf("unexpected statement %+v", link)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// trustStore keeps the custom attestation roots per AAGUID, nil if TRUST_STORE is not set
+var trustStore TrustStore
+
+// defaultAttestation is the attestation preference of tenants that set none. The trust store and the revocation
+// checks need the AAGUID and the chain, clients send them only when direct attestation is asked for.
+func defaultAttestation() string {
+	if getEnv("TRUST_STORE", "") != "" || getEnv("REVOCATION_POLICY", revocationOff) != revocationOff {
+		return string(protocol.PreferDirectAttestation)
+	}
+
+	return ""
+}
+
+// TrustStore maps authenticator models to the roots their attestation chains must end in. It is meant
+// for enterprise keys whose roots are in no public metadata.
+type TrustStore map[uuid.UUID]*x509.CertPool
+
+// LoadTrustStore reads the JSON file mapping AAGUIDs to PEM files of root certificates, relative paths
+// are relative to the file:
+//
+//	{"ee882879-721c-4913-9775-3dfcce97072a": "roots/acme.pem"}
+func LoadTrustStore(path string) (TrustStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read trust store: %w", err)
+	}
+
+	var files map[string]string
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("can't parse trust store: %w", err)
+	}
+
+	store := make(TrustStore, len(files))
+	for aaguid, file := range files {
+		id, err := uuid.Parse(aaguid)
+		if err != nil {
+			return nil, fmt.Errorf("bad AAGUID %q in trust store: %w", aaguid, err)
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("can't read roots of %s: %w", aaguid, err)
+		}
+
+		pool, n := x509.NewCertPool(), 0
+		for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("can't parse root of %s: %w", aaguid, err)
+			}
+			pool.AddCert(cert)
+			n++
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("no root certificates for %s in %s", aaguid, file)
+		}
+		store[id] = pool
+	}
+
+	return store, nil
+}
+
+// AttestationInfo is the verified attestation of a passkey, kept for later audit
+type AttestationInfo struct {
+	Format string `json:"format"`
+	// Type is the attestation type found by the library: basic, attca, self or none
+	Type string `json:"type"`
+	// TrustPath are the subjects of the verified chain from the leaf to the root, without a trust store
+	// entry it is the x5c chain as sent
+	TrustPath []string `json:"trustPath,omitempty"`
+	// LeafSHA256 is the fingerprint of the attestation certificate, empty without x5c
+	LeafSHA256 string `json:"leafSha256,omitempty"`
+	// Anchored is set if the chain was verified against the trust store
+	Anchored   bool      `json:"anchored"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
+
+// attestationChain parses the x5c chain of the attestation, leaf first, nil for attestations without one
+func attestationChain(att protocol.AttestationObject) ([]*x509.Certificate, error) {
+	x5c, ok := att.AttStatement["x5c"].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+
+	chain := make([]*x509.Certificate, 0, len(x5c))
+	for _, c := range x5c {
+		der, ok := c.([]byte)
+		if !ok {
+			return nil, protocol.ErrAttestationFormat.WithDetails("malformed x5c")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, protocol.ErrAttestationFormat.WithDetails(fmt.Sprintf("can't parse x5c: %s", err))
+		}
+		chain = append(chain, cert)
+	}
+
+	return chain, nil
+}
+
+// verifyAttestationTrust checks the chain of the attestation against the trust store roots of its AAGUID.
+// Models without an entry are left to the library, their chain is only described.
+func verifyAttestationTrust(r *http.Request, user PasskeyUser, credential *webauthn.Credential, att protocol.AttestationObject) (AttestationInfo, error) {
+	info := AttestationInfo{
+		Format:     att.Format,
+		Type:       credential.AttestationType,
+		VerifiedAt: time.Now(),
+	}
+
+	chain, err := attestationChain(att)
+	if err != nil {
+		return info, err
+	}
+	if len(chain) > 0 {
+		sum := sha256.Sum256(chain[0].Raw)
+		info.LeafSHA256 = hex.EncodeToString(sum[:])
+	}
+
+	id, err := uuid.FromBytes(credential.Authenticator.AAGUID)
+	if err != nil {
+		return info, protocol.ErrAttestationFormat.WithDetails("bad AAGUID")
+	}
+	roots, ok := trustStore[id]
+	if !ok {
+		for _, c := range chain {
+			info.TrustPath = append(info.TrustPath, c.Subject.String())
+		}
+
+		return info, nil
+	}
+
+	data := map[string]interface{}{"aaguid": id.String(), "format": att.Format}
+	if len(chain) == 0 {
+		Audit(r, "attestation.untrusted", user, data)
+
+		return info, protocol.ErrAttestation.WithDetails(fmt.Sprintf("authenticator %s must send an attestation chain", id))
+	}
+
+	leaf := *chain[0]
+	if att.Format == "tpm" {
+		// the library checked the critical SAN of the AIK certificate, x509 doesn't know its TPM names
+		leaf.UnhandledCriticalExtensions = nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+
+	verified, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		data["error"] = err.Error()
+		Audit(r, "attestation.untrusted", user, data)
+
+		return info, protocol.ErrAttestation.WithDetails(fmt.Sprintf("attestation of %s is not trusted: %s", id, err))
+	}
+
+	for _, c := range verified[0] {
+		info.TrustPath = append(info.TrustPath, c.Subject.String())
+	}
+	info.Anchored = true
+
+	return info, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// verifyChain runs verifyAttestationTrust for a packed attestation of the model with the chain
+func verifyChain(t *testing.T, aaguid uuid.UUID, chain ...*x509.Certificate) (AttestationInfo, error) {
+	t.Helper()
+
+	var x5c []interface{}
+	for _, c := range chain {
+		x5c = append(x5c, c.Raw)
+	}
+	att := protocol.AttestationObject{Format: "packed", AttStatement: map[string]interface{}{"x5c": x5c}}
+	credential := &webauthn.Credential{AttestationType: "basic", Authenticator: webauthn.Authenticator{AAGUID: aaguid[:]}}
+	r := httptest.NewRequest(http.MethodPost, "/api/passkey/registerFinish", nil)
+
+	return verifyAttestationTrust(r, &User{Name: "alice"}, credential, att)
+}
+
+func TestAttestationTrustStore(t *testing.T) {
+	newTestTenant(t)
+
+	root := newTestCert(t, "acme root", true, nil)
+	inter := newTestCert(t, "acme intermediate", true, root)
+	leaf := newTestCert(t, "acme key", false, inter)
+	other := newTestCert(t, "other root", true, nil)
+	foreign := newTestCert(t, "other key", false, other)
+
+	pinned, unpinned := uuid.New(), uuid.New()
+	pool := x509.NewCertPool()
+	pool.AddCert(root.cert)
+	trustStore = TrustStore{pinned: pool}
+	t.Cleanup(func() { trustStore = nil })
+
+	info, err := verifyChain(t, pinned, leaf.cert, inter.cert)
+	if err != nil || !info.Anchored || len(info.TrustPath) != 3 {
+		t.Fatalf("pinned model with its chain: anchored %v, trust path %v, error %v", info.Anchored, info.TrustPath, err)
+	}
+
+	if _, err := verifyChain(t, pinned, foreign.cert); err == nil {
+		t.Fatal("pinned model with a chain to another root is accepted")
+	}
+	if _, err := verifyChain(t, pinned); err == nil {
+		t.Fatal("pinned model without a chain is accepted")
+	}
+
+	// other models are accepted as they are, the chain is kept as sent
+	info, err = verifyChain(t, unpinned, foreign.cert)
+	if err != nil || info.Anchored || len(info.TrustPath) != 1 {
+		t.Fatalf("unpinned model: anchored %v, trust path %v, error %v", info.Anchored, info.TrustPath, err)
+	}
+}
+
+func TestDefaultAttestation(t *testing.T) {
+	for _, tc := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{nil, ""},
+		{map[string]string{"TRUST_STORE": "trust.json"}, "direct"},
+		{map[string]string{"REVOCATION_POLICY": revocationFailClosed}, "direct"},
+	} {
+		for k, v := range tc.env {
+			t.Setenv(k, v)
+		}
+		if got := defaultAttestation(); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.env, got, tc.want)
+		}
+	}
+
+	// a tenant that sets none asks for the default, its own choice is kept
+	t.Setenv("TRUST_STORE", "trust.json")
+	for _, tc := range []struct{ attestation, want string }{{"", "direct"}, {"enterprise", "enterprise"}} {
+		tenant := &Tenant{ID: "a", RPID: testRPID, DisplayName: "a", Origins: []string{testOrigin}, Attestation: tc.attestation}
+		if err := tenant.init(); err != nil {
+			t.Fatalf("can't init tenant: %s", err)
+		}
+		if got := string(tenant.WebAuthn.Config.AttestationPreference); got != tc.want {
+			t.Errorf("tenant with %q: got %q, want %q", tc.attestation, got, tc.want)
+		}
+	}
+}
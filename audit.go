@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AuditEvent is a security relevant action, it is logged and appended to the audit log as a JSON line
+type AuditEvent struct {
+	Time       time.Time              `json:"time"`
+	Event      string                 `json:"event"`
+	Tenant     string                 `json:"tenant"`
+	User       string                 `json:"user,omitempty"`
+	RemoteAddr string                 `json:"remoteAddr,omitempty"`
+	UserAgent  string                 `json:"userAgent,omitempty"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+}
+
+// AuditLog writes audit events to w, one JSON object per line
+type AuditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// auditLog is the AUDIT_LOG file, nil if not set, events are still logged
+var auditLog *AuditLog
+
+// Audit records the event of the request, user may be nil
+func Audit(r *http.Request, event string, user PasskeyUser, data map[string]interface{}) {
+	ev := AuditEvent{
+		Time:       time.Now().UTC(),
+		Event:      event,
+		Tenant:     tenantFor(r).ID,
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+		Data:       data,
+	}
+	if user != nil {
+		ev.User = user.WebAuthnName()
+	}
+
+	writeAudit(ev)
+}
+
+// AuditJob records the event of a background job of the tenant, user may be nil
+func AuditJob(t *Tenant, event string, user PasskeyUser, data map[string]interface{}) {
+	ev := AuditEvent{
+		Time:   time.Now().UTC(),
+		Event:  event,
+		Tenant: t.ID,
+		Data:   data,
+	}
+	if user != nil {
+		ev.User = user.WebAuthnName()
+	}
+
+	writeAudit(ev)
+}
+
+// writeAudit logs the event and appends it to the audit log
+func writeAudit(ev AuditEvent) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		l.Printf("[ERRO] can't marshal audit event %s: %s", ev.Event, err)
+
+		return
+	}
+	l.Printf("[INFO] audit %s", line)
+
+	if auditLog == nil {
+		return
+	}
+
+	auditLog.mu.Lock()
+	defer auditLog.mu.Unlock()
+
+	if _, err := auditLog.w.Write(append(line, '\n')); err != nil {
+		l.Printf("[ERRO] can't write audit log: %s", err)
+	}
+}
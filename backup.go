@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// updateCredential stores the credential of a new assertion, a change of its backup flags goes to the audit log.
+// BE must never change, so its change is a warning.
+func updateCredential(r *http.Request, user PasskeyUser, credential *webauthn.Credential) {
+	for _, c := range user.WebAuthnCredentials() {
+		if string(c.ID) != string(credential.ID) {
+			continue
+		}
+
+		if c.Flags.BackupEligible != credential.Flags.BackupEligible {
+			l.Printf("[WARN] backup eligibility of a passkey of %s changed to %t", user.WebAuthnName(), credential.Flags.BackupEligible)
+			Audit(r, "passkey.backup_eligibility_changed", user, map[string]interface{}{
+				"credentialId": encodeCredentialID(credential.ID),
+				"from":         c.Flags.BackupEligible,
+				"to":           credential.Flags.BackupEligible,
+			})
+		}
+		if c.Flags.BackupState != credential.Flags.BackupState {
+			Audit(r, "passkey.backup_state_changed", user, map[string]interface{}{
+				"credentialId": encodeCredentialID(credential.ID),
+				"from":         c.Flags.BackupState,
+				"to":           credential.Flags.BackupState,
+			})
+		}
+	}
+
+	user.UpdateCredential(credential)
+}
+
+// singleDevice reports whether all passkeys of the user live on one device: none is backed up,
+// and there is no second one. Losing that device locks the user out.
+func singleDevice(user PasskeyUser) bool {
+	creds := user.WebAuthnCredentials()
+	for _, c := range creds {
+		if c.Flags.BackupState {
+			return false
+		}
+	}
+
+	return len(creds) < 2
+}
+
+// backupView is the backup state of a passkey
+type backupView struct {
+	ID             string `json:"id"`
+	BackupEligible bool   `json:"backupEligible"`
+	BackupState    bool   `json:"backupState"`
+}
+
+// BackupStatus tells whether the logged-in user should be prompted to add a second passkey
+func BackupStatus(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	views := make([]backupView, 0, len(user.WebAuthnCredentials()))
+	for _, c := range user.WebAuthnCredentials() {
+		views = append(views, backupView{
+			ID:             encodeCredentialID(c.ID),
+			BackupEligible: c.Flags.BackupEligible,
+			BackupState:    c.Flags.BackupState,
+		})
+	}
+
+	JSONResponse(w, map[string]interface{}{
+		"nudge":       singleDevice(user),
+		"credentials": views,
+	}, http.StatusOK)
+}
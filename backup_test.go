@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestSingleDevice(t *testing.T) {
+	l = testLogger()
+	for _, tc := range []struct {
+		name  string
+		flags []webauthn.CredentialFlags
+		want  bool
+	}{
+		{"device-bound", []webauthn.CredentialFlags{{}}, true},
+		{"eligible, not backed up", []webauthn.CredentialFlags{{BackupEligible: true}}, true},
+		{"synced", []webauthn.CredentialFlags{{BackupEligible: true, BackupState: true}}, false},
+		{"two device-bound", []webauthn.CredentialFlags{{}, {}}, false},
+	} {
+		user := NewInMem(l).GetOrCreateUser("alice")
+		for i, f := range tc.flags {
+			user.AddCredential(&webauthn.Credential{ID: []byte{byte(i)}, Flags: f})
+		}
+		if got := singleDevice(user); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUpdateCredentialAuditsBackupState(t *testing.T) {
+	tenant := newTestTenant(t)
+	var audit bytes.Buffer
+	auditLog = NewAuditLog(&audit)
+	t.Cleanup(func() { auditLog = nil })
+
+	user := tenant.Store.GetOrCreateUser("alice")
+	user.AddCredential(&webauthn.Credential{ID: []byte("passkey"), Flags: webauthn.CredentialFlags{BackupEligible: true}})
+	r := httptest.NewRequest(http.MethodPost, "/api/passkey/loginFinish", nil)
+
+	updateCredential(r, user, &webauthn.Credential{ID: []byte("passkey"), Flags: webauthn.CredentialFlags{BackupEligible: true}})
+	if audit.Len() != 0 {
+		t.Fatalf("unchanged flags are audited: %s", audit.String())
+	}
+
+	updateCredential(r, user, &webauthn.Credential{ID: []byte("passkey"), Flags: webauthn.CredentialFlags{BackupEligible: true, BackupState: true}})
+	if !strings.Contains(audit.String(), `"event":"passkey.backup_state_changed"`) {
+		t.Fatalf("backup state change is not audited: %s", audit.String())
+	}
+	if !user.WebAuthnCredentials()[0].Flags.BackupState {
+		t.Fatal("the new backup state is not stored")
+	}
+
+	// the synced passkey needs no nudge
+	w := httptest.NewRecorder()
+	BackupStatus(w, principalRequest(http.MethodGet, "/api/passkey/backup", nil, user))
+	var resp struct {
+		Nudge bool `json:"nudge"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Nudge {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	ceremonyRegistration = "registration"
+	ceremonyLogin        = "login"
+
+	ceremonyCookieName = "ceremony"
+
+	ceremonyModeMemory = "memory"
+	ceremonyModeSealed = "sealed"
+)
+
+var (
+	errNoCeremony      = errors.New("no ceremony in progress")
+	errCeremonyExpired = errors.New("ceremony expired")
+	errCeremonyReplay  = errors.New("ceremony already finished")
+)
+
+// newCeremonyStore makes the CeremonyStore selected by CEREMONY_MODE
+func newCeremonyStore() (CeremonyStore, error) {
+	ttl := getEnvDuration("CEREMONY_TTL", 5*time.Minute)
+
+	switch mode := getEnv("CEREMONY_MODE", ceremonyModeMemory); mode {
+	case ceremonyModeMemory:
+		return NewMemCeremonies(datastore, ttl), nil
+	case ceremonyModeSealed:
+		keys, err := parseCeremonyKeys(getEnv("CEREMONY_KEYS", ""))
+		if err != nil {
+			return nil, err
+		}
+
+		return NewSealedCeremonies(keys, ttl, newStoreReplayCache(datastore, "ceremony:"))
+	default:
+		return nil, fmt.Errorf("unknown CEREMONY_MODE %q", mode)
+	}
+}
+
+// MemCeremonies keeps ceremony data in the datastore of this process, the cookie holds only the key
+type MemCeremonies struct {
+	store PasskeyStore
+	ttl   time.Duration
+}
+
+func NewMemCeremonies(store PasskeyStore, ttl time.Duration) *MemCeremonies {
+	return &MemCeremonies{
+		store: store,
+		ttl:   ttl,
+	}
+}
+
+func (m *MemCeremonies) Save(w http.ResponseWriter, ceremony string, data webauthn.SessionData) error {
+	t, err := m.store.GenSessionID()
+	if err != nil {
+		return fmt.Errorf("can't generate session id: %w", err)
+	}
+
+	if data.Expires.IsZero() {
+		data.Expires = time.Now().Add(m.ttl)
+	}
+	m.store.SaveSession(ceremony+":"+t, data)
+	setCeremonyCookie(w, t, m.ttl)
+
+	return nil
+}
+
+func (m *MemCeremonies) Load(w http.ResponseWriter, r *http.Request, ceremony string) (webauthn.SessionData, error) {
+	c, err := r.Cookie(ceremonyCookieName)
+	if err != nil {
+		return webauthn.SessionData{}, errNoCeremony
+	}
+	clearCeremonyCookie(w)
+
+	key := ceremony + ":" + c.Value
+	data, ok := m.store.GetSession(key)
+	if !ok {
+		return webauthn.SessionData{}, errNoCeremony
+	}
+	m.store.DeleteSession(key)
+
+	if data.Expires.Before(time.Now()) {
+		return webauthn.SessionData{}, errCeremonyExpired
+	}
+
+	return data, nil
+}
+
+// SealedCeremonies keeps nothing on the server side except a replay cache: the ceremony data is encrypted
+// with AES-GCM into the cookie, so a Finish* call can be served by any instance sharing the keys.
+//
+// A state is single-use only as far as its ReplayCache is shared: CEREMONY_MODE=sealed keeps the finished
+// states in the PasskeyStore, so with a store shared by the replicas a state can be finished once overall.
+type SealedCeremonies struct {
+	aeads  []cipher.AEAD
+	ttl    time.Duration
+	replay ReplayCache
+}
+
+type sealedCeremony struct {
+	ID       string               `json:"id"`
+	Ceremony string               `json:"ceremony"`
+	Expires  int64                `json:"exp"`
+	Data     webauthn.SessionData `json:"data"`
+}
+
+// NewSealedCeremonies makes a SealedCeremonies, the first key seals new ceremonies, all keys can open them.
+// replay remembers the finished states.
+func NewSealedCeremonies(keys [][]byte, ttl time.Duration, replay ReplayCache) (*SealedCeremonies, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("CEREMONY_KEYS is required in sealed mode")
+	}
+
+	aeads := make([]cipher.AEAD, 0, len(keys))
+	for _, k := range keys {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, fmt.Errorf("can't make cipher: %w", err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("can't make GCM: %w", err)
+		}
+		aeads = append(aeads, aead)
+	}
+
+	return &SealedCeremonies{
+		aeads:  aeads,
+		ttl:    ttl,
+		replay: replay,
+	}, nil
+}
+
+func (s *SealedCeremonies) Save(w http.ResponseWriter, ceremony string, data webauthn.SessionData) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("can't generate ceremony id: %w", err)
+	}
+
+	exp := time.Now().Add(s.ttl)
+	if !data.Expires.IsZero() && data.Expires.Before(exp) {
+		exp = data.Expires
+	}
+
+	plain, err := json.Marshal(sealedCeremony{
+		ID:       base64.RawURLEncoding.EncodeToString(id),
+		Ceremony: ceremony,
+		Expires:  exp.Unix(),
+		Data:     data,
+	})
+	if err != nil {
+		return fmt.Errorf("can't marshal ceremony: %w", err)
+	}
+
+	aead := s.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("can't generate nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, plain, []byte(ceremony))
+	setCeremonyCookie(w, base64.RawURLEncoding.EncodeToString(sealed), s.ttl)
+
+	return nil
+}
+
+func (s *SealedCeremonies) Load(w http.ResponseWriter, r *http.Request, ceremony string) (webauthn.SessionData, error) {
+	c, err := r.Cookie(ceremonyCookieName)
+	if err != nil {
+		return webauthn.SessionData{}, errNoCeremony
+	}
+	clearCeremonyCookie(w)
+
+	sealed, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil {
+		return webauthn.SessionData{}, errNoCeremony
+	}
+
+	plain, err := s.open(sealed, ceremony)
+	if err != nil {
+		return webauthn.SessionData{}, err
+	}
+
+	var sc sealedCeremony
+	if err := json.Unmarshal(plain, &sc); err != nil {
+		return webauthn.SessionData{}, fmt.Errorf("can't unmarshal ceremony: %w", err)
+	}
+
+	// ceremony is bound as additional data already, this is just a belt and braces check
+	if sc.Ceremony != ceremony {
+		return webauthn.SessionData{}, errNoCeremony
+	}
+
+	exp := time.Unix(sc.Expires, 0)
+	if exp.Before(time.Now()) {
+		return webauthn.SessionData{}, errCeremonyExpired
+	}
+
+	if !s.replay.Use(sc.ID, exp) {
+		return webauthn.SessionData{}, errCeremonyReplay
+	}
+
+	return sc.Data, nil
+}
+
+func (s *SealedCeremonies) open(sealed []byte, ceremony string) ([]byte, error) {
+	for _, aead := range s.aeads {
+		if len(sealed) < aead.NonceSize() {
+			continue
+		}
+
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if plain, err := aead.Open(nil, nonce, ciphertext, []byte(ceremony)); err == nil {
+			return plain, nil
+		}
+	}
+
+	return nil, errNoCeremony
+}
+
+// parseCeremonyKeys parses comma separated base64 AES-256 keys
+func parseCeremonyKeys(s string) ([][]byte, error) {
+	var keys [][]byte
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		b, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("can't decode ceremony key: %w", err)
+		}
+		if len(b) != 32 {
+			return nil, fmt.Errorf("ceremony key must be 32 bytes, got %d", len(b))
+		}
+
+		keys = append(keys, b)
+	}
+
+	return keys, nil
+}
+
+func setCeremonyCookie(w http.ResponseWriter, value string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     ceremonyCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // TODO: SameSiteStrictMode maybe?
+	})
+}
+
+func clearCeremonyCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   ceremonyCookieName,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// ReplayCache remembers used ids until they expire
+type ReplayCache interface {
+	// Use marks id as used and reports whether it was unused before, it must be atomic
+	Use(id string, until time.Time) bool
+	// Seen reports whether id is marked as used
+	Seen(id string) bool
+}
+
+// replayCache is the in-memory ReplayCache of this process, ids expire in the order of their expiry
+type replayCache struct {
+	mu      sync.Mutex
+	entries map[string]int64
+	expiry  replayHeap
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{entries: make(map[string]int64)}
+}
+
+// Use marks id as used and reports whether it was unused before
+func (c *replayCache) Use(id string, until time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().Unix()
+	for len(c.expiry) > 0 && c.expiry[0].until < now {
+		e := heap.Pop(&c.expiry).(replayEntry)
+		if c.entries[e.id] == e.until {
+			delete(c.entries, e.id)
+		}
+	}
+
+	if _, used := c.entries[id]; used {
+		return false
+	}
+	c.entries[id] = until.Unix()
+	heap.Push(&c.expiry, replayEntry{id: id, until: until.Unix()})
+
+	return true
+}
+
+// Seen reports whether id is marked as used
+func (c *replayCache) Seen(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	exp, ok := c.entries[id]
+
+	return ok && exp >= time.Now().Unix()
+}
+
+type replayEntry struct {
+	id    string
+	until int64
+}
+
+// replayHeap is a min-heap of the ids by expiry
+type replayHeap []replayEntry
+
+func (h replayHeap) Len() int            { return len(h) }
+func (h replayHeap) Less(i, j int) bool  { return h[i].until < h[j].until }
+func (h replayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x interface{}) { *h = append(*h, x.(replayEntry)) }
+
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return e
+}
+
+// storeReplayCache is a ReplayCache kept in the PasskeyStore, so ids are single-use as far as the store is shared.
+// The prefix keeps the ids of different users of the store apart.
+type storeReplayCache struct {
+	store  PasskeyStore
+	prefix string
+}
+
+func newStoreReplayCache(store PasskeyStore, prefix string) *storeReplayCache {
+	return &storeReplayCache{store: store, prefix: prefix}
+}
+
+func (c *storeReplayCache) Use(id string, until time.Time) bool {
+	return c.store.MarkUsed(c.prefix+id, until)
+}
+
+func (c *storeReplayCache) Seen(id string) bool {
+	return c.store.IsUsed(c.prefix + id)
+}
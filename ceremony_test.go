@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestReplayCacheExpiry(t *testing.T) {
+	c := newReplayCache()
+	now := time.Now()
+
+	if !c.Use("expired", now.Add(-time.Minute)) || !c.Use("live", now.Add(time.Minute)) {
+		t.Fatal("unused ids are refused")
+	}
+	if c.Use("live", now.Add(time.Minute)) {
+		t.Fatal("id is accepted twice")
+	}
+
+	// the expired id is forgotten by the next Use, the live one stays
+	if !c.Use("other", now.Add(time.Minute)) {
+		t.Fatal("unused id is refused")
+	}
+	if c.Seen("expired") || len(c.entries) != 2 || len(c.expiry) != 2 {
+		t.Fatalf("%d ids and %d expiries kept, want 2 live ones", len(c.entries), len(c.expiry))
+	}
+	if !c.Seen("live") {
+		t.Fatal("live id is forgotten")
+	}
+}
+
+func TestSealedCeremoniesSingleUseAcrossInstances(t *testing.T) {
+	l = testLogger()
+	store := NewInMem(l)
+	key := [][]byte{bytes.Repeat([]byte{7}, 32)}
+
+	// two instances with the same keys and store, as replicas behind a load balancer
+	a, err := NewSealedCeremonies(key, time.Minute, newStoreReplayCache(store, "ceremony:"))
+	if err != nil {
+		t.Fatalf("can't make ceremonies: %s", err)
+	}
+	b, err := NewSealedCeremonies(key, time.Minute, newStoreReplayCache(store, "ceremony:"))
+	if err != nil {
+		t.Fatalf("can't make ceremonies: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := a.Save(w, ceremonyLogin, webauthn.SessionData{Challenge: "challenge"}); err != nil {
+		t.Fatalf("can't save ceremony: %s", err)
+	}
+	load := func(c *SealedCeremonies) error {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		for _, ck := range w.Result().Cookies() {
+			r.AddCookie(ck)
+		}
+		_, err := c.Load(httptest.NewRecorder(), r, ceremonyLogin)
+
+		return err
+	}
+
+	if err := load(a); err != nil {
+		t.Fatalf("first load: %s", err)
+	}
+	if err := load(b); !errors.Is(err, errCeremonyReplay) {
+		t.Fatalf("load on the other instance: got %v, want %v", err, errCeremonyReplay)
+	}
+}
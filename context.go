@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Principal is the authenticated user of the request, LoggedInMiddleware puts it into the request context
+type Principal struct {
+	TenantID     string
+	UserID       []byte
+	Name         string
+	DisplayName  string
+	CredentialID []byte
+	AuthTime     time.Time
+	UserVerified bool
+	SessionID    string
+	Scope        string
+}
+
+type principalCtxKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalCtxKey{}, p)
+}
+
+// PrincipalFromContext returns the principal put by LoggedInMiddleware
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalCtxKey{}).(Principal)
+
+	return p, ok
+}
+
+// newPrincipal is a helper function to make the principal of the session
+func newPrincipal(session AuthSession, user PasskeyUser) Principal {
+	return Principal{
+		TenantID:     session.TenantID,
+		UserID:       session.UserID,
+		Name:         user.WebAuthnName(),
+		DisplayName:  user.WebAuthnDisplayName(),
+		CredentialID: session.CredentialID,
+		AuthTime:     session.AuthTime,
+		UserVerified: session.UserVerified,
+		SessionID:    session.ID,
+		Scope:        session.Scope,
+	}
+}
+
+// userFromPrincipal returns the logged-in user and the principal. It answers 401 and reports false if there is
+// no principal or its user doesn't exist, e.g. was deleted after the session was issued.
+func userFromPrincipal(w http.ResponseWriter, r *http.Request) (PasskeyUser, Principal, bool) {
+	p, ok := PrincipalFromContext(r.Context())
+	if !ok {
+		JSONResponse(w, "not logged in", http.StatusUnauthorized)
+
+		return nil, Principal{}, false
+	}
+
+	user, ok := tenantFor(r).Store.GetUser(string(p.UserID))
+	if !ok {
+		l.Printf("[WARN] session of unknown user %q", p.UserID)
+		JSONResponse(w, "not logged in", http.StatusUnauthorized)
+
+		return nil, Principal{}, false
+	}
+
+	return user, p, true
+}
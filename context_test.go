@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserFromPrincipal(t *testing.T) {
+	tenant := newTestTenant(t)
+	alice := tenant.Store.GetOrCreateUser("alice")
+	tenant.Store.SaveUser(alice)
+	ghost := &User{ID: []byte("ghost"), Name: "ghost"}
+
+	w := httptest.NewRecorder()
+	if _, _, ok := userFromPrincipal(w, httptest.NewRequest(http.MethodGet, "/", nil)); ok || w.Code != http.StatusUnauthorized {
+		t.Fatalf("without principal: ok %v, status %d", ok, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	if _, _, ok := userFromPrincipal(w, principalRequest(http.MethodGet, "/", nil, ghost)); ok || w.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown user: ok %v, status %d", ok, w.Code)
+	}
+	if _, ok := tenant.Store.GetUser("ghost"); ok {
+		t.Fatal("the principal created the user")
+	}
+
+	user, p, ok := userFromPrincipal(httptest.NewRecorder(), principalRequest(http.MethodGet, "/", nil, alice))
+	if !ok || user.WebAuthnName() != "alice" || string(p.UserID) != "alice" {
+		t.Fatalf("known user: ok %v, user %v, principal %+v", ok, user, p)
+	}
+}
+
+func TestSessionOfUnknownUser(t *testing.T) {
+	tenant := newTestTenant(t)
+	newTestSessions(t)
+	ghost := &User{ID: []byte("ghost"), Name: "ghost"}
+
+	// the session outlived its user, the routes of logged-in users refuse it and don't bring the user back
+	for _, h := range []http.HandlerFunc{ListCredentials, BeginStepUp, SetEmail} {
+		w := httptest.NewRecorder()
+		LoggedInMiddleware(h, WithJSONUnauthorized()).ServeHTTP(w, sessionRequest(t, http.MethodPost, "/", nil, ghost, ""))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("status %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	}
+	if _, ok := tenant.Store.GetUser("ghost"); ok {
+		t.Fatal("the session created the user")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// DeleteCredential removes a passkey of the logged-in user, the last one can't be removed
+func DeleteCredential(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "can't decode request: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	id, err := decodeCredentialID(req.ID)
+	if err != nil {
+		JSONResponse(w, "can't decode credential id: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if len(user.WebAuthnCredentials()) <= 1 {
+		JSONResponse(w, "can't delete the last passkey", http.StatusConflict)
+
+		return
+	}
+
+	if !user.RemoveCredential(id) {
+		JSONResponse(w, "passkey not found", http.StatusNotFound)
+
+		return
+	}
+	tenantFor(r).Store.SaveUser(user)
+
+	webhooks.Emit(EventPasskeyRemoved, user, map[string]interface{}{"credentialId": encodeCredentialID(id)})
+
+	l.Printf("[INFO] passkey deleted for %s", user.WebAuthnName())
+	JSONResponse(w, "Passkey Deleted", http.StatusOK)
+}
+
+// beginEnrollment starts adding a passkey to the logged-in user, the ceremony name keeps enrollments
+// of different flows apart
+func beginEnrollment(w http.ResponseWriter, r *http.Request, ceremony string) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	options, session, err := tenantFor(r).WebAuthn.BeginRegistration(user, webauthn.WithExtensions(registrationExtensions()))
+	if err != nil {
+		msg := fmt.Sprintf("can't begin %s registration: %s", ceremony, err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	if err := ceremonies.Save(w, ceremony, *session); err != nil {
+		msg := fmt.Sprintf("can't save %s session: %s", ceremony, err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	JSONResponse(w, options, http.StatusOK)
+}
+
+// finishEnrollment verifies and stores the new passkey of the logged-in user. On failure it writes
+// the response and returns false, on success the caller writes it.
+func finishEnrollment(w http.ResponseWriter, r *http.Request, ceremony string) (PasskeyUser, *webauthn.Credential, bool) {
+	user, p, ok := userFromPrincipal(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	session, err := ceremonies.Load(w, r, ceremony)
+	if err != nil {
+		msg := fmt.Sprintf("can't get %s session: %s", ceremony, err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return nil, nil, false
+	}
+
+	if !bytes.Equal(session.UserID, p.UserID) {
+		JSONResponse(w, ceremony+" user doesn't match the session user", http.StatusForbidden)
+
+		return nil, nil, false
+	}
+
+	if err := hooks.BeforeFinishRegistration(r, user); err != nil {
+		vetoResponse(w, err)
+
+		return nil, nil, false
+	}
+
+	credential, ext, err := finishCreation(tenantFor(r), user, session, r)
+	if err != nil {
+		msg := fmt.Sprintf("can't finish %s registration: %s", ceremony, err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return nil, nil, false
+	}
+
+	user.AddCredential(credential)
+	if err := recordCredential(user, credential, ext); err != nil {
+		l.Printf("[ERRO] %s", err.Error())
+	}
+	tenantFor(r).Store.SaveUser(user)
+
+	hooks.AfterFinishRegistration(r, user, credential)
+
+	return user, credential, true
+}
+
+// findCredential is a helper function to find the passkey of the user by id, nil if there is none
+func findCredential(user PasskeyUser, id []byte) *webauthn.Credential {
+	if len(id) == 0 {
+		return nil
+	}
+	for _, c := range user.WebAuthnCredentials() {
+		if string(c.ID) == string(id) {
+			return &c
+		}
+	}
+
+	return nil
+}
+
+// decodeCredentialID is a helper function to decode base64url credential id, with or without padding
+func decodeCredentialID(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// encodeCredentialID is a helper function to encode credential id as base64url without padding
+func encodeCredentialID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+const extensionCredProps = "credProps"
+
+// Discoverable (usernameless) login modes, DISCOVERABLE_LOGIN
+const (
+	discoverableOff  = "off"  // a username is required
+	discoverableOn   = "on"   // login with or without a username
+	discoverableOnly = "only" // a username works only for users without a discoverable passkey
+)
+
+// discoverableLogin is the discoverable login mode
+var discoverableLogin = discoverableOff
+
+// recordCredProps keeps the rk property the client reported for the new passkey. Clients that don't
+// support credProps report nothing, so the property stays unknown.
+func recordCredProps(user PasskeyUser, id []byte, ext protocol.AuthenticationExtensionsClientOutputs) {
+	rk, ok := extensionOutput(ext, extensionCredProps)["rk"].(bool)
+	if !ok {
+		return
+	}
+
+	user.UpdateCredentialMeta(id, func(m *CredentialMeta) { m.Discoverable = &rk })
+}
+
+// hasResidentKey reports whether the user has a passkey known to be discoverable
+func hasResidentKey(user PasskeyUser) bool {
+	for _, c := range user.WebAuthnCredentials() {
+		if d := user.CredentialMeta(c.ID).Discoverable; d != nil && *d {
+			return true
+		}
+	}
+
+	return false
+}
+
+// usernameLoginAllowed reports whether the user may log in by username. In the discoverable only mode users
+// without a discoverable passkey keep it, otherwise they couldn't log in at all.
+func usernameLoginAllowed(user PasskeyUser) bool {
+	return discoverableLogin != discoverableOnly || !hasResidentKey(user)
+}
+
+// BeginDiscoverableLogin starts a login without username, the authenticator offers its discoverable passkeys
+func BeginDiscoverableLogin(w http.ResponseWriter, r *http.Request) {
+	if discoverableLogin == discoverableOff {
+		JSONResponse(w, "username is required", http.StatusBadRequest)
+
+		return
+	}
+
+	// the user is known only in FinishLogin, the hooks get none
+	if err := hooks.BeforeBeginLogin(r, nil); err != nil {
+		vetoResponse(w, err)
+
+		return
+	}
+
+	options, session, err := tenantFor(r).WebAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		msg := fmt.Sprintf("can't begin discoverable login: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	if err := ceremonies.Save(w, ceremonyLogin, *session); err != nil {
+		msg := fmt.Sprintf("can't save login session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	hooks.AfterBeginLogin(r, nil)
+
+	JSONResponse(w, options, http.StatusOK)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	linkVerifyEmail = "verify_email"
+	linkRecover     = "recover"
+)
+
+var (
+	errLinkInvalid = errors.New("invalid link")
+	errLinkExpired = errors.New("link expired")
+	errLinkUsed    = errors.New("link already used")
+)
+
+var (
+	// emailThrottle limits the links mailed to an address, EMAIL_THROTTLE_MAX per EMAIL_THROTTLE_WINDOW
+	emailThrottle = NewLockout(3, time.Hour)
+	// mailsInFlight are the recovery emails sent in the background
+	mailsInFlight sync.WaitGroup
+)
+
+// emailLink is the signed content of a link sent by email
+type emailLink struct {
+	ID      string `json:"id"`
+	Purpose string `json:"purpose"`
+	Tenant  string `json:"tenant"`
+	User    string `json:"user"`
+	Email   string `json:"email"`
+	Expires int64  `json:"exp"`
+}
+
+// EmailLinks signs and checks single-use links, the key must be shared by all instances
+type EmailLinks struct {
+	key  []byte
+	ttl  time.Duration
+	used ReplayCache
+}
+
+// emailLinks makes the links of the email channel
+var emailLinks *EmailLinks
+
+// NewEmailLinks makes EmailLinks, without key an ephemeral one is generated. used remembers the used links,
+// they are single-use as far as it is shared.
+func NewEmailLinks(key []byte, ttl time.Duration, used ReplayCache) (*EmailLinks, error) {
+	if len(key) == 0 {
+		l.Printf("[WARN] EMAIL_LINK_KEY is empty, use ephemeral key, links won't survive restart")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("can't generate link key: %w", err)
+		}
+	}
+	if len(key) < 32 {
+		return nil, errors.New("EMAIL_LINK_KEY must be at least 32 bytes")
+	}
+
+	return &EmailLinks{key: key, ttl: ttl, used: used}, nil
+}
+
+// Sign returns a token for the link
+func (e *EmailLinks) Sign(purpose, tenant, user, email string) (string, error) {
+	id, err := datastore.GenSessionID()
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(emailLink{
+		ID:      id,
+		Purpose: purpose,
+		Tenant:  tenant,
+		User:    user,
+		Email:   email,
+		Expires: time.Now().Add(e.ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	p := base64.RawURLEncoding.EncodeToString(payload)
+
+	return p + "." + base64.RawURLEncoding.EncodeToString(e.mac(p)), nil
+}
+
+// Use checks the token of the purpose and tenant and marks it as used
+func (e *EmailLinks) Use(token, purpose, tenant string) (emailLink, error) {
+	var link emailLink
+
+	p, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return link, errLinkInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, e.mac(p)) {
+		return link, errLinkInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return link, errLinkInvalid
+	}
+	if err := json.Unmarshal(payload, &link); err != nil {
+		return link, errLinkInvalid
+	}
+
+	if link.Purpose != purpose || link.Tenant != tenant {
+		return link, errLinkInvalid
+	}
+
+	exp := time.Unix(link.Expires, 0)
+	if time.Now().After(exp) {
+		return link, errLinkExpired
+	}
+	if !e.used.Use(link.ID, exp) {
+		return link, errLinkUsed
+	}
+
+	return link, nil
+}
+
+func (e *EmailLinks) mac(payload string) []byte {
+	h := hmac.New(sha256.New, e.key)
+	h.Write([]byte(payload))
+
+	return h.Sum(nil)
+}
+
+// SetEmail sets an unverified email of the logged-in user and sends the verification link
+func SetEmail(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "can't decode request: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	addr, err := mail.ParseAddress(req.Email)
+	if err != nil {
+		JSONResponse(w, "invalid email: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if emailThrottled(r, addr.Address) {
+		JSONResponse(w, map[string]string{"error": "email_throttled"}, http.StatusTooManyRequests)
+
+		return
+	}
+
+	user.SetEmailAddress(addr.Address, false)
+	tenantFor(r).Store.SaveUser(user)
+
+	m, err := emailLinkMail(r, user, addr.Address, linkVerifyEmail)
+	if err == nil {
+		err = mailer.Send(r.Context(), m)
+	}
+	if err != nil {
+		l.Printf("[ERRO] can't send verification email: %s", err.Error())
+		JSONResponse(w, "can't send verification email", http.StatusInternalServerError)
+
+		return
+	}
+
+	Audit(r, "email.verification_sent", user, map[string]interface{}{"email": addr.Address})
+	JSONResponse(w, "Verification Email Sent", http.StatusOK)
+}
+
+// VerifyEmail marks the email of the link as verified
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	link, err := emailLinks.Use(r.URL.Query().Get("token"), linkVerifyEmail, tenantFor(r).ID)
+	if err != nil {
+		JSONResponse(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+
+		return
+	}
+
+	user := tenantFor(r).Store.GetOrCreateUser(link.User)
+
+	// the email might be changed after the link was sent
+	if addr, _ := user.EmailAddress(); addr != link.Email {
+		JSONResponse(w, map[string]string{"error": "email changed"}, http.StatusConflict)
+
+		return
+	}
+
+	user.SetEmailAddress(link.Email, true)
+	tenantFor(r).Store.SaveUser(user)
+
+	Audit(r, "email.verified", user, map[string]interface{}{"email": link.Email})
+	JSONResponse(w, "Email Verified", http.StatusOK)
+}
+
+// RequestEmailRecovery sends a recovery link to the verified email of the user. The answer is the same
+// whether the user exists or not, and the email is sent in the background, so the time doesn't tell it either.
+func RequestEmailRecovery(w http.ResponseWriter, r *http.Request) {
+	username, err := getUsername(r)
+	if err != nil || username == "" {
+		JSONResponse(w, "username is required", http.StatusBadRequest)
+
+		return
+	}
+
+	user, found := tenantFor(r).Store.GetUser(username)
+	if !found {
+		JSONResponse(w, "If the account has a verified email, a recovery link was sent to it", http.StatusAccepted)
+
+		return
+	}
+
+	if addr, verified := user.EmailAddress(); verified {
+		if emailThrottled(r, addr) {
+			Audit(r, "email.recovery_throttled", user, map[string]interface{}{"email": addr})
+		} else if m, err := emailLinkMail(r, user, addr, linkRecover); err != nil {
+			l.Printf("[ERRO] can't make recovery email: %s", err.Error())
+		} else {
+			sendInBackground(m)
+			Audit(r, "email.recovery_sent", user, map[string]interface{}{"email": addr})
+		}
+	}
+
+	JSONResponse(w, "If the account has a verified email, a recovery link was sent to it", http.StatusAccepted)
+}
+
+// EmailRecover takes the token of the recovery link and issues a recovery session. The link opens the page,
+// and the page posts the token, so link scanners of mail providers don't use it up.
+func EmailRecover(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "can't decode request: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	link, err := emailLinks.Use(req.Token, linkRecover, tenantFor(r).ID)
+	if err != nil {
+		JSONResponse(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
+
+		return
+	}
+
+	user := tenantFor(r).Store.GetOrCreateUser(link.User)
+	if addr, verified := user.EmailAddress(); !verified || addr != link.Email {
+		JSONResponse(w, map[string]string{"error": "email changed"}, http.StatusConflict)
+
+		return
+	}
+	if loginVetoed(w, r, user) {
+		return
+	}
+
+	ttl := getEnvDuration("RECOVERY_SESSION_TTL", 10*time.Minute)
+	if err := sessions.IssueScoped(w, r, user, scopeRecovery, ttl); err != nil {
+		msg := fmt.Sprintf("can't issue recovery session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	hooks.AfterFinishLogin(r, user, nil)
+
+	Audit(r, "email.recovery_used", user, map[string]interface{}{"email": link.Email})
+	JSONResponse(w, map[string]interface{}{
+		"message": "Recovery Success, enroll a new passkey",
+		"start":   "/api/passkey/recover/registerStart",
+		"finish":  "/api/passkey/recover/registerFinish",
+	}, http.StatusOK)
+}
+
+// emailLinkMail is a helper function to sign a link of the purpose and make the email with it
+func emailLinkMail(r *http.Request, user PasskeyUser, addr, purpose string) (Mail, error) {
+	token, err := emailLinks.Sign(purpose, tenantFor(r).ID, user.WebAuthnName(), addr)
+	if err != nil {
+		return Mail{}, fmt.Errorf("can't sign link: %w", err)
+	}
+
+	m := Mail{To: addr}
+	switch purpose {
+	case linkVerifyEmail:
+		m.Subject = "Verify your email"
+		m.Body = fmt.Sprintf("Open this link to verify your email:\n\n%s/api/passkey/email/verify?token=%s\n\nIt expires in %s.\n",
+			linkBase(r), url.QueryEscape(token), emailLinks.ttl)
+	case linkRecover:
+		m.Subject = "Recover your account"
+		m.Body = fmt.Sprintf("Open this link to add a new passkey to your account:\n\n%s/#recover=%s\n\n"+
+			"It expires in %s and works once. If you didn't ask for it, ignore this email.\n",
+			linkBase(r), url.QueryEscape(token), emailLinks.ttl)
+	}
+
+	return m, nil
+}
+
+// sendInBackground sends the email without holding the request, failures are logged
+func sendInBackground(m Mail) {
+	mailsInFlight.Add(1)
+	go func() {
+		defer mailsInFlight.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := mailer.Send(ctx, m); err != nil {
+			l.Printf("[ERRO] can't send email to %s: %s", m.To, err.Error())
+		}
+	}()
+}
+
+// emailThrottled counts a link mailed to the address and reports whether the address got too many already
+func emailThrottled(r *http.Request, addr string) bool {
+	key := tenantFor(r).ID + ":" + strings.ToLower(addr)
+	if _, locked := emailThrottle.Locked(key); locked {
+		return true
+	}
+	emailThrottle.Fail(key)
+
+	return false
+}
+
+// linkBase is a helper function to get the origin of the tenant, with the /t/{id} prefix for path-only tenants
+func linkBase(r *http.Request) string {
+	t := tenantFor(r)
+	base := t.Origins[0]
+	if t != defaultTenant && len(t.Hosts) == 0 {
+		base += "/t/" + t.ID
+	}
+
+	return base
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmailLinksSingleUseAcrossInstances(t *testing.T) {
+	l = testLogger()
+	datastore = NewInMem(l)
+	key := bytes.Repeat([]byte{3}, 32)
+
+	// two instances with the same key and store
+	a, err := NewEmailLinks(key, time.Minute, newStoreReplayCache(datastore, "link:"))
+	if err != nil {
+		t.Fatalf("can't make links: %s", err)
+	}
+	b, err := NewEmailLinks(key, time.Minute, newStoreReplayCache(datastore, "link:"))
+	if err != nil {
+		t.Fatalf("can't make links: %s", err)
+	}
+
+	token, err := a.Sign(linkRecover, "default", "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("can't sign link: %s", err)
+	}
+	if _, err := a.Use(token, linkRecover, "default"); err != nil {
+		t.Fatalf("first use: %s", err)
+	}
+	if _, err := b.Use(token, linkRecover, "default"); !errors.Is(err, errLinkUsed) {
+		t.Fatalf("use on the other instance: got %v, want %v", err, errLinkUsed)
+	}
+}
+
+func TestEmailLinksUse(t *testing.T) {
+	l = testLogger()
+	datastore = NewInMem(l)
+	links, err := NewEmailLinks(bytes.Repeat([]byte{3}, 32), time.Minute, newReplayCache())
+	if err != nil {
+		t.Fatalf("can't make links: %s", err)
+	}
+
+	token, err := links.Sign(linkRecover, "default", "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("can't sign link: %s", err)
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+	forged := strings.Replace(payload, payload[:4], "AAAA", 1) + "." + sig
+
+	for _, tc := range []struct {
+		name                   string
+		token, purpose, tenant string
+		want                   error
+	}{
+		{"tampered payload", forged, linkRecover, "default", errLinkInvalid},
+		{"tampered signature", payload + "." + sig[:len(sig)-2] + "AA", linkRecover, "default", errLinkInvalid},
+		{"no signature", payload, linkRecover, "default", errLinkInvalid},
+		{"other purpose", token, linkVerifyEmail, "default", errLinkInvalid},
+		{"other tenant", token, linkRecover, "acme", errLinkInvalid},
+		{"valid", token, linkRecover, "default", nil},
+		{"used", token, linkRecover, "default", errLinkUsed},
+	} {
+		link, err := links.Use(tc.token, tc.purpose, tc.tenant)
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+		if err == nil && (link.User != "alice" || link.Email != "alice@example.com") {
+			t.Fatalf("%s: unexpected link %+v", tc.name, link)
+		}
+	}
+
+	expired, err := NewEmailLinks(bytes.Repeat([]byte{3}, 32), -time.Minute, newReplayCache())
+	if err != nil {
+		t.Fatalf("can't make links: %s", err)
+	}
+	if token, err = expired.Sign(linkRecover, "default", "alice", "alice@example.com"); err != nil {
+		t.Fatalf("can't sign link: %s", err)
+	}
+	if _, err := expired.Use(token, linkRecover, "default"); !errors.Is(err, errLinkExpired) {
+		t.Fatalf("expired: got %v, want %v", err, errLinkExpired)
+	}
+}
+
+func TestRequestEmailRecovery(t *testing.T) {
+	tenant := newTestTenant(t)
+	sent := NewMemMailer()
+	mailer = sent
+	emailThrottle = NewLockout(2, time.Hour)
+	t.Cleanup(func() { mailer, emailThrottle = nil, NewLockout(3, time.Hour) })
+
+	var err error
+	if emailLinks, err = NewEmailLinks(bytes.Repeat([]byte{3}, 32), time.Minute, newReplayCache()); err != nil {
+		t.Fatalf("can't make links: %s", err)
+	}
+
+	user := tenant.Store.GetOrCreateUser("alice")
+	user.SetEmailAddress("alice@example.com", true)
+	tenant.Store.SaveUser(user)
+
+	request := func(username string) string {
+		w := httptest.NewRecorder()
+		RequestEmailRecovery(w, httptest.NewRequest(http.MethodPost, "/api/passkey/email/recoverStart", strings.NewReader(`{"username":"`+username+`"}`)))
+		mailsInFlight.Wait()
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("%s: status %d: %s", username, w.Code, w.Body)
+		}
+
+		return w.Body.String()
+	}
+
+	// unknown users get the same answer and no email
+	if request("mallory") != request("alice") {
+		t.Fatal("the answer tells whether the user exists")
+	}
+	mails := sent.Sent()
+	if len(mails) != 1 || mails[0].To != "alice@example.com" || !strings.Contains(mails[0].Body, "/#recover=") {
+		t.Fatalf("unexpected emails %+v", mails)
+	}
+	if _, ok := tenant.Store.GetUser("mallory"); ok {
+		t.Fatal("recovery request created the user")
+	}
+
+	// the address gets no more than the throttle allows, the answer stays the same
+	request("alice")
+	request("alice")
+	if n := len(sent.Sent()); n != 2 {
+		t.Fatalf("%d emails sent, want 2", n)
+	}
+}
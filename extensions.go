@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// registrationExtensions are the extensions requested by every registration
+func registrationExtensions() protocol.AuthenticationExtensions {
+	return protocol.AuthenticationExtensions{
+		extensionCredProps: true,
+		extensionPRF:       map[string]interface{}{},
+		extensionLargeBlob: map[string]interface{}{"support": "preferred"},
+	}
+}
+
+// loginOptions are the extensions requested by the login of the user
+func loginOptions(user PasskeyUser) []webauthn.LoginOption {
+	ext := protocol.AuthenticationExtensions{}
+
+	if blob := largeBlobLoginInput(user); blob != nil {
+		ext[extensionLargeBlob] = blob
+	}
+	if prf := prfLoginInput(user, user.WebAuthnCredentials()); prf != nil {
+		ext[extensionPRF] = prf
+	}
+
+	return []webauthn.LoginOption{webauthn.WithAssertionExtensions(ext)}
+}
+
+// finishCreation verifies the attestation like webauthn.FinishRegistration does, checks its chain against
+// the trust store and the CRLs, and also returns the client extension results, the library doesn't keep them
+func finishCreation(t *Tenant, user PasskeyUser, session webauthn.SessionData, r *http.Request) (*webauthn.Credential, protocol.AuthenticationExtensionsClientOutputs, error) {
+	parsed, err := protocol.ParseCredentialCreationResponseBody(r.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	credential, err := t.WebAuthn.CreateCredential(user, session, parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := verifyAttestationTrust(r, user, credential, parsed.Response.AttestationObject)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkAttestationRevocation(r, user, credential, parsed.Response.AttestationObject); err != nil {
+		return nil, nil, err
+	}
+	if err := checkAuthenticatorStatus(r, user, credential); err != nil {
+		return nil, nil, err
+	}
+
+	user.UpdateCredentialMeta(credential.ID, func(m *CredentialMeta) { m.Attestation = &info })
+
+	return credential, parsed.ClientExtensionResults, nil
+}
+
+// finishAssertion verifies the parsed assertion like webauthn.FinishLogin does, a session without user is
+// a discoverable login of the user found by the user handle
+func finishAssertion(t *Tenant, user PasskeyUser, session webauthn.SessionData, parsed *protocol.ParsedCredentialAssertionData) (*webauthn.Credential, error) {
+	if len(session.UserID) == 0 {
+		return t.WebAuthn.ValidateDiscoverableLogin(func(_, _ []byte) (webauthn.User, error) {
+			return user, nil
+		}, session, parsed)
+	}
+
+	return t.WebAuthn.ValidateLogin(user, session, parsed)
+}
+
+// recordCredential keeps what the registration told about the new passkey: its name and supported extensions
+func recordCredential(user PasskeyUser, credential *webauthn.Credential, ext protocol.AuthenticationExtensionsClientOutputs) error {
+	nameCredential(user, credential.ID, credential.Authenticator.AAGUID)
+	recordCredProps(user, credential.ID, ext)
+	recordLargeBlob(user, credential.ID, ext)
+
+	return recordPRF(user, credential.ID, ext)
+}
+
+// extensionOutput is a helper function to get the object result of the extension
+func extensionOutput(ext protocol.AuthenticationExtensionsClientOutputs, name string) map[string]interface{} {
+	out, _ := ext[name].(map[string]interface{})
+
+	return out
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Build metadata, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// ReadinessCheck is a component checked by /readyz. Check must respect ctx, it is cancelled after Timeout.
+type ReadinessCheck struct {
+	Name    string
+	Timeout time.Duration
+	Check   func(ctx context.Context) error
+}
+
+var readinessChecks []ReadinessCheck
+
+// AddReadinessCheck registers a check for /readyz
+func AddReadinessCheck(c ReadinessCheck) {
+	readinessChecks = append(readinessChecks, c)
+}
+
+type checkResult struct {
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+}
+
+// Healthz reports that the process is alive
+func Healthz(w http.ResponseWriter, _ *http.Request) {
+	JSONResponse(w, map[string]string{"status": "ok"}, http.StatusOK)
+}
+
+// Readyz runs all readiness checks in parallel and answers 503 if any of them fails. The answer has only
+// ok or fail per check, the errors are logged as they may name files or addresses.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	results := make(map[string]checkResult, len(readinessChecks))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range readinessChecks {
+		wg.Add(1)
+		go func(c ReadinessCheck) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := runCheck(r.Context(), c)
+			res := checkResult{Status: "ok", Duration: time.Since(start).String()}
+			if err != nil {
+				res.Status = "fail"
+				l.Printf("[WARN] readiness check %s failed: %s", c.Name, err.Error())
+			}
+
+			mu.Lock()
+			results[c.Name] = res
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	status, code := "ok", http.StatusOK
+	for _, res := range results {
+		if res.Status != "ok" {
+			status, code = "fail", http.StatusServiceUnavailable
+		}
+	}
+
+	JSONResponse(w, map[string]interface{}{"status": status, "checks": results}, code)
+}
+
+// runCheck runs the check with its timeout, a check that ignores ctx is abandoned when the timeout passes
+func runCheck(ctx context.Context, c ReadinessCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- c.Check(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("timeout after %s", c.Timeout)
+	}
+}
+
+// Version reports build metadata
+func Version(w http.ResponseWriter, _ *http.Request) {
+	info := map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_date": buildDate,
+		"go":         runtime.Version(),
+	}
+
+	// fall back to the VCS info stamped by the go tool
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info["commit"] == "":
+				info["commit"] = s.Value
+			case s.Key == "vcs.time" && info["build_date"] == "":
+				info["build_date"] = s.Value
+			case s.Key == "vcs.modified":
+				info["modified"] = s.Value
+			}
+		}
+	}
+
+	JSONResponse(w, info, http.StatusOK)
+}
+
+// storeCheck checks that the datastore responds
+func storeCheck(store PasskeyStore) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return store.Ping(ctx)
+	}
+}
+
+// metadataCheck checks that the metadata blob is loaded and not stale
+func metadataCheck(m *MetadataBLOB) func(ctx context.Context) error {
+	return func(context.Context) error {
+		return m.Fresh()
+	}
+}
+
+// tlsCheck checks that the certificate pair can be loaded and the leaf is currently valid
+func tlsCheck(certFile, keyFile string) func(ctx context.Context) error {
+	return func(context.Context) error {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("can't load key pair: %w", err)
+		}
+		if len(pair.Certificate) == 0 {
+			return errors.New("no certificate")
+		}
+
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("can't parse certificate: %w", err)
+		}
+
+		now := time.Now()
+		if now.Before(leaf.NotBefore) {
+			return fmt.Errorf("certificate is not valid before %s", leaf.NotBefore)
+		}
+		if now.After(leaf.NotAfter) {
+			return fmt.Errorf("certificate expired at %s", leaf.NotAfter)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyzHidesErrors(t *testing.T) {
+	l = testLogger()
+
+	saved := readinessChecks
+	t.Cleanup(func() { readinessChecks = saved })
+	readinessChecks = nil
+
+	AddReadinessCheck(ReadinessCheck{Name: "ok", Timeout: time.Second, Check: func(context.Context) error { return nil }})
+	AddReadinessCheck(ReadinessCheck{Name: "tls", Timeout: time.Second, Check: func(context.Context) error {
+		return errors.New("open /etc/secret/tls.key: permission denied")
+	}})
+
+	w := httptest.NewRecorder()
+	Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if strings.Contains(w.Body.String(), "/etc/secret") {
+		t.Fatalf("the answer leaks the check error: %s", w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"tls":{"status":"fail"`) {
+		t.Fatalf("the answer doesn't report the failed check: %s", w.Body)
+	}
+}
+
+func TestStoreCheckDeadline(t *testing.T) {
+	l = testLogger()
+	store := NewInMem(l)
+	check := storeCheck(store)
+
+	if err := check(context.Background()); err != nil {
+		t.Fatalf("idle store: %s", err)
+	}
+
+	// a store stuck under its lock fails the check when the deadline passes
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := check(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("stuck store: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
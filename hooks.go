@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Hooks lets the application run its own logic around ceremonies and logout.
+// Before* hooks run before the step and can veto it by returning an error, a *HookError controls
+// the response. After* hooks run once the step succeeded. Embed NopHooks to implement only some of them.
+// The login hooks run on every path that authenticates a user: the credential is nil when no passkey
+// was asserted (password, recovery code, email link, TOTP), the user is nil when a discoverable login begins.
+type Hooks interface {
+	BeforeBeginRegistration(r *http.Request, user PasskeyUser) error
+	AfterBeginRegistration(r *http.Request, user PasskeyUser)
+	BeforeFinishRegistration(r *http.Request, user PasskeyUser) error
+	AfterFinishRegistration(r *http.Request, user PasskeyUser, credential *webauthn.Credential)
+	BeforeBeginLogin(r *http.Request, user PasskeyUser) error
+	AfterBeginLogin(r *http.Request, user PasskeyUser)
+	BeforeFinishLogin(r *http.Request, user PasskeyUser) error
+	AfterFinishLogin(r *http.Request, user PasskeyUser, credential *webauthn.Credential)
+	BeforeLogout(r *http.Request, user PasskeyUser) error
+	AfterLogout(r *http.Request, user PasskeyUser)
+}
+
+// hooks are called by the handlers, set them with SetHooks
+var hooks Hooks = NopHooks{}
+
+// SetHooks sets the hooks, several hooks are called in the given order
+func SetHooks(h ...Hooks) {
+	if len(h) == 1 {
+		hooks = h[0]
+
+		return
+	}
+
+	hooks = chainHooks(h)
+}
+
+// AddHooks adds hooks after the ones already set, so built-in hooks don't replace the application ones
+func AddHooks(h ...Hooks) {
+	var all chainHooks
+	switch cur := hooks.(type) {
+	case chainHooks:
+		all = append(all, cur...)
+	case NopHooks:
+	default:
+		all = append(all, cur)
+	}
+
+	SetHooks(append(all, h...)...)
+}
+
+// loginVetoed is a helper function to run BeforeFinishLogin on a path that authenticates the user,
+// it answers the veto
+func loginVetoed(w http.ResponseWriter, r *http.Request, user PasskeyUser) bool {
+	if err := hooks.BeforeFinishLogin(r, user); err != nil {
+		vetoResponse(w, err)
+
+		return true
+	}
+
+	return false
+}
+
+// HookError is returned by a Before* hook to veto the step
+type HookError struct {
+	Status  int    // http status of the response, 403 if not set
+	Code    string // machine-readable reason, e.g. "account_disabled"
+	Message string
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("vetoed by hook: %s: %s", e.Code, e.Message)
+}
+
+// vetoResponse is a helper function to answer a request vetoed by a hook
+func vetoResponse(w http.ResponseWriter, err error) {
+	l.Printf("[WARN] %s", err.Error())
+	setErrorCode(w, err)
+
+	var herr *HookError
+	if !errors.As(err, &herr) {
+		herr = &HookError{Code: "vetoed", Message: err.Error()}
+	}
+
+	status := herr.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+
+	JSONResponse(w, map[string]string{"error": herr.Code, "message": herr.Message}, status)
+}
+
+// NopHooks does nothing
+type NopHooks struct{}
+
+func (NopHooks) BeforeBeginRegistration(*http.Request, PasskeyUser) error                 { return nil }
+func (NopHooks) AfterBeginRegistration(*http.Request, PasskeyUser)                        {}
+func (NopHooks) BeforeFinishRegistration(*http.Request, PasskeyUser) error                { return nil }
+func (NopHooks) AfterFinishRegistration(*http.Request, PasskeyUser, *webauthn.Credential) {}
+func (NopHooks) BeforeBeginLogin(*http.Request, PasskeyUser) error                        { return nil }
+func (NopHooks) AfterBeginLogin(*http.Request, PasskeyUser)                               {}
+func (NopHooks) BeforeFinishLogin(*http.Request, PasskeyUser) error                       { return nil }
+func (NopHooks) AfterFinishLogin(*http.Request, PasskeyUser, *webauthn.Credential)        {}
+func (NopHooks) BeforeLogout(*http.Request, PasskeyUser) error                            { return nil }
+func (NopHooks) AfterLogout(*http.Request, PasskeyUser)                                   {}
+
+// chainHooks calls every hook in order, Before* stops at the first veto
+type chainHooks []Hooks
+
+func (c chainHooks) BeforeBeginRegistration(r *http.Request, user PasskeyUser) error {
+	for _, h := range c {
+		if err := h.BeforeBeginRegistration(r, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c chainHooks) AfterBeginRegistration(r *http.Request, user PasskeyUser) {
+	for _, h := range c {
+		h.AfterBeginRegistration(r, user)
+	}
+}
+
+func (c chainHooks) BeforeFinishRegistration(r *http.Request, user PasskeyUser) error {
+	for _, h := range c {
+		if err := h.BeforeFinishRegistration(r, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c chainHooks) AfterFinishRegistration(r *http.Request, user PasskeyUser, credential *webauthn.Credential) {
+	for _, h := range c {
+		h.AfterFinishRegistration(r, user, credential)
+	}
+}
+
+func (c chainHooks) BeforeBeginLogin(r *http.Request, user PasskeyUser) error {
+	for _, h := range c {
+		if err := h.BeforeBeginLogin(r, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c chainHooks) AfterBeginLogin(r *http.Request, user PasskeyUser) {
+	for _, h := range c {
+		h.AfterBeginLogin(r, user)
+	}
+}
+
+func (c chainHooks) BeforeFinishLogin(r *http.Request, user PasskeyUser) error {
+	for _, h := range c {
+		if err := h.BeforeFinishLogin(r, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c chainHooks) AfterFinishLogin(r *http.Request, user PasskeyUser, credential *webauthn.Credential) {
+	for _, h := range c {
+		h.AfterFinishLogin(r, user, credential)
+	}
+}
+
+func (c chainHooks) BeforeLogout(r *http.Request, user PasskeyUser) error {
+	for _, h := range c {
+		if err := h.BeforeLogout(r, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c chainHooks) AfterLogout(r *http.Request, user PasskeyUser) {
+	for _, h := range c {
+		h.AfterLogout(r, user)
+	}
+}
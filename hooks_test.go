@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// loginHooks vetoes logins when veto is set and records the finished ones
+type loginHooks struct {
+	NopHooks
+	veto     bool
+	finished []*webauthn.Credential
+}
+
+func (h *loginHooks) BeforeFinishLogin(*http.Request, PasskeyUser) error {
+	if h.veto {
+		return &HookError{Code: "account_disabled", Message: "disabled by the application"}
+	}
+
+	return nil
+}
+
+func (h *loginHooks) AfterFinishLogin(_ *http.Request, _ PasskeyUser, credential *webauthn.Credential) {
+	h.finished = append(h.finished, credential)
+}
+
+func setTestHooks(t *testing.T, h ...Hooks) {
+	t.Helper()
+
+	SetHooks(h...)
+	t.Cleanup(func() { hooks = NopHooks{} })
+}
+
+func TestAddHooksKeepsApplicationHooks(t *testing.T) {
+	app, builtin := &loginHooks{}, &loginHooks{}
+	setTestHooks(t, app)
+	AddHooks(builtin)
+
+	hooks.AfterFinishLogin(httptest.NewRequest(http.MethodPost, "/", nil), &User{Name: "alice"}, nil)
+	if len(app.finished) != 1 || len(builtin.finished) != 1 {
+		t.Fatalf("app hook called %d times, built-in %d times, want 1 each", len(app.finished), len(builtin.finished))
+	}
+
+	// without hooks set before, the added ones are the only ones
+	hooks = NopHooks{}
+	AddHooks(builtin)
+	if hooks != Hooks(builtin) {
+		t.Fatalf("hooks %T, want the added hook", hooks)
+	}
+}
+
+func TestPasswordLoginHooks(t *testing.T) {
+	tenant := newTestTenant(t)
+	newTestSessions(t)
+	passwordMode = passwordOn
+	t.Cleanup(func() { passwordMode = passwordOff })
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("can't hash password: %s", err)
+	}
+	user := tenant.Store.GetOrCreateUser("alice")
+	user.SetPassword(LegacyPassword{Hash: string(hash)})
+	tenant.Store.SaveUser(user)
+
+	h := &loginHooks{veto: true}
+	setTestHooks(t, h)
+
+	login := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		PasswordLogin(w, httptest.NewRequest(http.MethodPost, "/api/password/login", strings.NewReader(`{"username":"alice","password":"secret"}`)))
+
+		return w
+	}
+
+	w := login()
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "account_disabled") {
+		t.Fatalf("vetoed login: status %d: %s", w.Code, w.Body)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatal("vetoed login issued a session")
+	}
+
+	h.veto = false
+	if w = login(); w.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body)
+	}
+	if len(h.finished) != 1 || h.finished[0] != nil {
+		t.Fatalf("AfterFinishLogin got %v, want one call without credential", h.finished)
+	}
+}
+
+func TestRecoverHooks(t *testing.T) {
+	tenant := newTestTenant(t)
+	newTestSessions(t)
+
+	user := tenant.Store.GetOrCreateUser("alice")
+	plain, codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("can't generate codes: %s", err)
+	}
+	user.SetRecoveryCodes(codes)
+	tenant.Store.SaveUser(user)
+
+	setTestHooks(t, &loginHooks{veto: true})
+
+	w := httptest.NewRecorder()
+	Recover(w, httptest.NewRequest(http.MethodPost, "/api/passkey/recover", strings.NewReader(`{"username":"alice","code":"`+plain[0]+`"}`)))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("vetoed recovery: status %d: %s", w.Code, w.Body)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatal("vetoed recovery issued a session")
+	}
+}
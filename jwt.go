@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const jwtCookieName = "token"
+
+// errBearerStepUp is returned by a step-up of a bearer token, the token can't be re-issued to its client
+var errBearerStepUp = errors.New("step-up is not supported for bearer tokens, log in again for a fresh token")
+
+// JWTKey is a HMAC key used to sign session tokens. ID goes to the "kid" header, so tokens signed
+// with an old key stay valid as long as the key is still configured.
+type JWTKey struct {
+	ID     string
+	Secret []byte
+}
+
+type JWTConfig struct {
+	Issuer   string
+	Audience string
+	Timeouts SessionTimeouts
+	// Keys are used to verify tokens, the first one is used to sign new tokens
+	Keys []JWTKey
+	// Denylist keeps the ids of revoked tokens, revocation holds on the instances sharing it.
+	// The in-memory one of the instance if nil.
+	Denylist ReplayCache
+}
+
+// JWTSessions is a stateless SessionManager: the session is a signed token, and only revoked
+// tokens are kept on the server side.
+type JWTSessions struct {
+	cfg JWTConfig
+	// denylist keeps ids of revoked tokens until they expire anyway
+	denylist ReplayCache
+	// rotated keeps ids of rotated tokens for sessionRotationGrace, they are denylisted but still accepted
+	rotated *rotatedTokens
+}
+
+type sessionClaims struct {
+	jwt.RegisteredClaims
+	TenantID     string `json:"tid"`
+	AuthTime     int64  `json:"auth_time"`
+	UserVerified bool   `json:"uv,omitempty"`
+	CredentialID string `json:"cid"`
+	Scope        string `json:"scope,omitempty"`
+	// MaxExpires is the absolute expiration of the session, exp slides up to it
+	MaxExpires int64 `json:"max_exp"`
+}
+
+func NewJWTSessions(cfg JWTConfig, log Logger) (*JWTSessions, error) {
+	if len(cfg.Keys) == 0 {
+		log.Printf("[WARN] JWT_KEYS is empty, use ephemeral signing key, sessions won't survive restart")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("can't generate signing key: %w", err)
+		}
+		cfg.Keys = []JWTKey{{ID: "ephemeral", Secret: secret}}
+	}
+
+	if cfg.Denylist == nil {
+		cfg.Denylist = newReplayCache()
+	}
+
+	return &JWTSessions{
+		cfg:      cfg,
+		denylist: cfg.Denylist,
+		rotated:  newRotatedTokens(),
+	}, nil
+}
+
+func (s *JWTSessions) Issue(w http.ResponseWriter, r *http.Request, user PasskeyUser, credential *webauthn.Credential, scope string) error {
+	claims, err := s.newClaims(r, user, 0)
+	if err != nil {
+		return err
+	}
+	claims.UserVerified = credential.Flags.UserVerified
+	claims.CredentialID = base64.RawURLEncoding.EncodeToString(credential.ID)
+	claims.Scope = scope
+
+	return s.write(w, r, claims)
+}
+
+func (s *JWTSessions) IssueScoped(w http.ResponseWriter, r *http.Request, user PasskeyUser, scope string, ttl time.Duration) error {
+	claims, err := s.newClaims(r, user, ttl)
+	if err != nil {
+		return err
+	}
+	claims.Scope = scope
+
+	return s.write(w, r, claims)
+}
+
+// newClaims makes claims of a new token of the user, a ttl > 0 is a fixed lifetime instead of the session timeouts
+func (s *JWTSessions) newClaims(r *http.Request, user PasskeyUser, ttl time.Duration) (sessionClaims, error) {
+	jti, err := datastore.GenSessionID()
+	if err != nil {
+		return sessionClaims{}, fmt.Errorf("can't generate token id: %w", err)
+	}
+
+	now := time.Now()
+	absolute, expires := now.Add(ttl), now.Add(ttl)
+	if ttl <= 0 {
+		absolute = now.Add(s.cfg.Timeouts.Absolute)
+		expires = s.cfg.Timeouts.expires(now, absolute)
+	}
+
+	return sessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    s.cfg.Issuer,
+			Audience:  jwt.ClaimStrings{s.cfg.Audience},
+			Subject:   base64.RawURLEncoding.EncodeToString(user.WebAuthnID()),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expires),
+		},
+		TenantID:   tenantFor(r).ID,
+		AuthTime:   now.Unix(),
+		MaxExpires: absolute.Unix(),
+	}, nil
+}
+
+func (s *JWTSessions) Touch(w http.ResponseWriter, r *http.Request, session AuthSession) (AuthSession, error) {
+	// a bearer token can't be re-issued, the client keeps it until it expires
+	if bearerToken(r) != "" {
+		return session, nil
+	}
+
+	now := time.Now()
+	renew, rotate := s.cfg.Timeouts.renew(session, now)
+	if !renew {
+		return session, nil
+	}
+
+	claims, err := s.parse(r)
+	if err != nil {
+		return AuthSession{}, err
+	}
+	if rotate {
+		if err := s.rotate(claims); err != nil {
+			return AuthSession{}, err
+		}
+	}
+	claims.ExpiresAt = jwt.NewNumericDate(s.cfg.Timeouts.expires(now, time.Unix(claims.MaxExpires, 0)))
+
+	if err := s.write(w, r, *claims); err != nil {
+		return AuthSession{}, err
+	}
+
+	// the session of the issued token, not of the one the request came with
+	session, ok := claims.session(false)
+	if !ok {
+		return AuthSession{}, errors.New("renewed token is not valid")
+	}
+
+	return session, nil
+}
+
+// rotate gives the claims a new id, the old one stays valid for sessionRotationGrace and is linked to the new one
+func (s *JWTSessions) rotate(claims *sessionClaims) error {
+	if !s.denylist.Use(claims.ID, claims.ExpiresAt.Time) {
+		return errors.New("token revoked")
+	}
+
+	jti, err := datastore.GenSessionID()
+	if err != nil {
+		return fmt.Errorf("can't generate token id: %w", err)
+	}
+	s.rotated.Add(claims.ID, jti, time.Now().Add(sessionRotationGrace))
+
+	now := time.Now()
+	claims.ID = jti
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now)
+
+	return nil
+}
+
+func (s *JWTSessions) Reauthenticate(w http.ResponseWriter, r *http.Request, credential *webauthn.Credential) error {
+	claims, err := s.parse(r)
+	if err != nil {
+		return err
+	}
+
+	if s.denylist.Seen(claims.ID) {
+		return errors.New("token revoked")
+	}
+	if bearerToken(r) != "" {
+		return errBearerStepUp
+	}
+
+	// a fresh assertion is a privilege change, the session gets a new id
+	now := time.Now()
+	if err := s.rotate(claims); err != nil {
+		return err
+	}
+	claims.AuthTime = now.Unix()
+	claims.UserVerified = credential.Flags.UserVerified
+	claims.CredentialID = base64.RawURLEncoding.EncodeToString(credential.ID)
+	claims.ExpiresAt = jwt.NewNumericDate(s.cfg.Timeouts.expires(now, time.Unix(claims.MaxExpires, 0)))
+
+	return s.write(w, r, *claims)
+}
+
+func (s *JWTSessions) Promote(w http.ResponseWriter, r *http.Request) error {
+	claims, err := s.parse(r)
+	if err != nil {
+		return err
+	}
+
+	if !s.denylist.Use(claims.ID, claims.ExpiresAt.Time) {
+		return errors.New("token revoked")
+	}
+
+	jti, err := datastore.GenSessionID()
+	if err != nil {
+		return fmt.Errorf("can't generate token id: %w", err)
+	}
+
+	// the login is complete only now, so are its timeouts
+	now := time.Now()
+	absolute := now.Add(s.cfg.Timeouts.Absolute)
+	claims.ID = jti
+	claims.Scope = ""
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(s.cfg.Timeouts.expires(now, absolute))
+	claims.MaxExpires = absolute.Unix()
+
+	return s.write(w, r, *claims)
+}
+
+// write signs claims with the current key and sets the token cookie
+func (s *JWTSessions) write(w http.ResponseWriter, r *http.Request, claims sessionClaims) error {
+	key := s.cfg.Keys[0]
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.ID
+
+	signed, err := token.SignedString(key.Secret)
+	if err != nil {
+		return fmt.Errorf("can't sign token: %w", err)
+	}
+
+	setSessionCookie(w, r, jwtCookieName, signed, claims.ExpiresAt.Time)
+
+	return nil
+}
+
+func (s *JWTSessions) Check(r *http.Request) (AuthSession, bool) {
+	claims, err := s.parse(r)
+	if err != nil {
+		return AuthSession{}, false
+	}
+
+	// a rotated token is denylisted, but still accepted for its grace period
+	rotated := s.rotated.Seen(claims.ID)
+	if (s.denylist.Seen(claims.ID) && !rotated) || claims.TenantID != tenantFor(r).ID {
+		return AuthSession{}, false
+	}
+
+	return claims.session(rotated)
+}
+
+// session is a helper function to make the AuthSession of the claims
+func (c *sessionClaims) session(rotated bool) (AuthSession, bool) {
+	userID, err := base64.RawURLEncoding.DecodeString(c.Subject)
+	if err != nil {
+		return AuthSession{}, false
+	}
+
+	credID, err := base64.RawURLEncoding.DecodeString(c.CredentialID)
+	if err != nil {
+		return AuthSession{}, false
+	}
+
+	return AuthSession{
+		ID:           c.ID,
+		TenantID:     c.TenantID,
+		UserID:       userID,
+		CredentialID: credID,
+		AuthTime:     time.Unix(c.AuthTime, 0),
+		UserVerified: c.UserVerified,
+		Expires:      c.ExpiresAt.Time,
+		MaxExpires:   time.Unix(c.MaxExpires, 0),
+		RotatedAt:    c.IssuedAt.Time,
+		Rotated:      rotated,
+		Scope:        c.Scope,
+	}, true
+}
+
+func (s *JWTSessions) Revoke(w http.ResponseWriter, r *http.Request) {
+	// the tokens rotated from and to this one are revoked too, their grace period ends with the logout
+	if claims, err := s.parse(r); err == nil {
+		for _, id := range s.rotated.Unlink(claims.ID) {
+			s.denylist.Use(id, time.Unix(claims.MaxExpires, 0))
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   jwtCookieName,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// rotatedTokens keeps the ids of rotated tokens with the ids they were rotated to, for their grace period
+type rotatedTokens struct {
+	mu      sync.Mutex
+	entries map[string]rotatedToken
+}
+
+type rotatedToken struct {
+	successor string
+	until     time.Time
+}
+
+func newRotatedTokens() *rotatedTokens {
+	return &rotatedTokens{entries: make(map[string]rotatedToken)}
+}
+
+// Add records that id was rotated to successor, id is accepted until then
+func (t *rotatedTokens) Add(id, successor string, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range t.entries {
+		if e.until.Before(now) {
+			delete(t.entries, k)
+		}
+	}
+	t.entries[id] = rotatedToken{successor: successor, until: until}
+}
+
+// Seen reports whether id is a rotated token in its grace period
+func (t *rotatedTokens) Seen(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[id]
+
+	return ok && !e.until.Before(time.Now())
+}
+
+// Unlink ends the grace period of id and of the tokens rotated before and after it,
+// and returns all of them with id
+func (t *rotatedTokens) Unlink(id string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := []string{id}
+	for next := id; ; {
+		e, ok := t.entries[next]
+		if !ok {
+			break
+		}
+		delete(t.entries, next)
+		next = e.successor
+		ids = append(ids, next)
+	}
+	for prev := id; prev != ""; {
+		found := ""
+		for k, e := range t.entries {
+			if e.successor == prev {
+				found = k
+			}
+		}
+		if found != "" {
+			delete(t.entries, found)
+			ids = append(ids, found)
+		}
+		prev = found
+	}
+
+	return ids
+}
+
+func (s *JWTSessions) parse(r *http.Request) (*sessionClaims, error) {
+	raw := bearerToken(r)
+	if raw == "" {
+		c, err := r.Cookie(jwtCookieName)
+		if err != nil {
+			return nil, err
+		}
+		raw = c.Value
+	}
+
+	var claims sessionClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, s.key,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(s.cfg.Issuer),
+		jwt.WithAudience(s.cfg.Audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+// key looks up the verification key by the "kid" header
+func (s *JWTSessions) key(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	for _, k := range s.cfg.Keys {
+		if k.ID == kid {
+			return k.Secret, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// bearerToken is a helper function to extract the token from the Authorization header
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return h[len(prefix):]
+	}
+
+	return ""
+}
+
+// bearerSession reports whether the request is authenticated by a bearer token of the JWT sessions
+func bearerSession(r *http.Request) bool {
+	_, ok := sessions.(*JWTSessions)
+
+	return ok && bearerToken(r) != ""
+}
+
+// parseJWTKeys parses keys in "kid1:base64secret,kid2:base64secret" format
+func parseJWTKeys(s string) ([]JWTKey, error) {
+	var keys []JWTKey
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		kid, secret, ok := strings.Cut(part, ":")
+		if !ok || kid == "" {
+			return nil, errors.New("JWT_KEYS must be in kid:base64secret format")
+		}
+
+		b, err := base64.StdEncoding.DecodeString(secret)
+		if err != nil {
+			return nil, fmt.Errorf("can't decode JWT key %q: %w", kid, err)
+		}
+		if len(b) < 32 {
+			return nil, fmt.Errorf("JWT key %q is too short, need at least 32 bytes", kid)
+		}
+
+		keys = append(keys, JWTKey{ID: kid, Secret: b})
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	extensionLargeBlob = "largeBlob"
+	ceremonyLargeBlob  = "largeblob"
+
+	// maxLargeBlobLen is what we accept, authenticators have at least 1024 bytes of storage
+	// and report a write they can't fit as not written
+	maxLargeBlobLen = 4096
+
+	// a queued blob is dropped after this many failed writes or this long without a login with its passkey
+	largeBlobMaxAttempts = 3
+	largeBlobPendingTTL  = 7 * 24 * time.Hour
+)
+
+// recordLargeBlob marks the passkey as largeBlob capable if the registration reported it
+func recordLargeBlob(user PasskeyUser, id []byte, ext protocol.AuthenticationExtensionsClientOutputs) {
+	if supported, _ := extensionOutput(ext, extensionLargeBlob)["supported"].(bool); !supported {
+		return
+	}
+
+	user.UpdateCredentialMeta(id, func(m *CredentialMeta) { m.LargeBlob = true })
+}
+
+// blobPending reports whether the queued blob of the passkey still waits to be written
+func blobPending(m CredentialMeta) bool {
+	return len(m.PendingBlob) > 0 && m.PendingAttempts < largeBlobMaxAttempts && time.Since(m.PendingSince) < largeBlobPendingTTL
+}
+
+// pendingLargeBlob returns the passkey of the user with a blob queued for writing
+func pendingLargeBlob(user PasskeyUser) (webauthn.Credential, []byte, bool) {
+	for _, c := range user.WebAuthnCredentials() {
+		if meta := user.CredentialMeta(c.ID); blobPending(meta) {
+			return c, meta.PendingBlob, true
+		}
+	}
+
+	return webauthn.Credential{}, nil, false
+}
+
+// largeBlobLoginInput is the largeBlob input of the login: a read if any passkey supports it. Writes need
+// exactly one allowed credential, so they are left to the write ceremony after the login.
+func largeBlobLoginInput(user PasskeyUser) map[string]interface{} {
+	for _, c := range user.WebAuthnCredentials() {
+		if user.CredentialMeta(c.ID).LargeBlob {
+			return map[string]interface{}{"read": true}
+		}
+	}
+
+	return nil
+}
+
+// largeBlobWriteOffer returns the routes of the write ceremony if the passkey of the login has a queued blob
+func largeBlobWriteOffer(user PasskeyUser, credential *webauthn.Credential) map[string]string {
+	if !blobPending(user.CredentialMeta(credential.ID)) {
+		return nil
+	}
+
+	return map[string]string{
+		"start":  "/api/passkey/largeBlob/writeStart",
+		"finish": "/api/passkey/largeBlob/writeFinish",
+	}
+}
+
+// recordLargeBlobWrite confirms the queued write when the assertion reports it written. A failed write counts
+// as an attempt, the blob is dropped after largeBlobMaxAttempts of them.
+func recordLargeBlobWrite(r *http.Request, user PasskeyUser, credential *webauthn.Credential, ext protocol.AuthenticationExtensionsClientOutputs) bool {
+	written, _ := extensionOutput(ext, extensionLargeBlob)["written"].(bool)
+	data := map[string]interface{}{"credentialId": encodeCredentialID(credential.ID)}
+
+	var sum [sha256.Size]byte
+	pending, abandoned := false, false
+	user.UpdateCredentialMeta(credential.ID, func(m *CredentialMeta) {
+		if pending = blobPending(*m); !pending {
+			return
+		}
+
+		if !written {
+			m.PendingAttempts++
+			if abandoned = m.PendingAttempts >= largeBlobMaxAttempts; abandoned {
+				m.PendingBlob = nil
+			}
+
+			return
+		}
+
+		sum = sha256.Sum256(m.PendingBlob)
+		m.BlobSHA256 = sum[:]
+		m.BlobWrittenAt = time.Now()
+		m.PendingBlob = nil
+	})
+
+	switch {
+	case !pending:
+		return false
+	case abandoned:
+		Audit(r, "largeblob.write_abandoned", user, data)
+
+		return false
+	case !written:
+		Audit(r, "largeblob.write_failed", user, data)
+
+		return false
+	}
+
+	data["sha256"] = hex.EncodeToString(sum[:])
+	Audit(r, "largeblob.written", user, data)
+
+	return true
+}
+
+// BeginLargeBlobWrite starts the assertion that writes the queued blob, it is limited to the passkey of the blob
+func BeginLargeBlobWrite(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	c, blob, ok := pendingLargeBlob(user)
+	if !ok {
+		JSONResponse(w, map[string]string{"error": "largeblob_nothing_pending"}, http.StatusConflict)
+
+		return
+	}
+
+	options, session, err := tenantFor(r).WebAuthn.BeginLogin(user,
+		webauthn.WithAllowedCredentials([]protocol.CredentialDescriptor{c.Descriptor()}),
+		webauthn.WithAssertionExtensions(protocol.AuthenticationExtensions{
+			extensionLargeBlob: map[string]interface{}{"write": protocol.URLEncodedBase64(blob)},
+		}),
+	)
+	if err != nil {
+		msg := fmt.Sprintf("can't begin blob write: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	if err := ceremonies.Save(w, ceremonyLargeBlob, *session); err != nil {
+		msg := fmt.Sprintf("can't save blob write session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	JSONResponse(w, options, http.StatusOK)
+}
+
+// FinishLargeBlobWrite verifies the assertion and confirms the write it reports
+func FinishLargeBlobWrite(w http.ResponseWriter, r *http.Request) {
+	user, p, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	session, err := ceremonies.Load(w, r, ceremonyLargeBlob)
+	if err != nil {
+		msg := fmt.Sprintf("can't get blob write session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	if !bytes.Equal(session.UserID, p.UserID) {
+		JSONResponse(w, "blob write user doesn't match the session user", http.StatusForbidden)
+
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		msg := fmt.Sprintf("can't finish blob write: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	credential, err := tenantFor(r).WebAuthn.ValidateLogin(user, session, parsed)
+	if err != nil {
+		msg := fmt.Sprintf("can't finish blob write: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	if credentialDisabled(r, user, credential) {
+		disabledResponse(w)
+
+		return
+	}
+
+	if credential.Authenticator.CloneWarning {
+		cloneWarning(user, credential, ceremonyLargeBlob)
+	}
+
+	updateCredential(r, user, credential)
+	written := recordLargeBlobWrite(r, user, credential, parsed.ClientExtensionResults)
+	tenantFor(r).Store.SaveUser(user)
+
+	if !written {
+		JSONResponse(w, map[string]string{"error": "largeblob_not_written"}, http.StatusConflict)
+
+		return
+	}
+
+	JSONResponse(w, "Blob Written", http.StatusOK)
+}
+
+// largeBlobView is the largeBlob state of a passkey
+type largeBlobView struct {
+	CredentialID string     `json:"credentialId"`
+	Supported    bool       `json:"supported"`
+	Pending      bool       `json:"pending"`
+	WrittenAt    *time.Time `json:"writtenAt,omitempty"`
+	SHA256       string     `json:"sha256,omitempty"`
+}
+
+// LargeBlobs returns the largeBlob state of the passkeys of the logged-in user
+func LargeBlobs(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	views := make([]largeBlobView, 0, len(user.WebAuthnCredentials()))
+	for _, c := range user.WebAuthnCredentials() {
+		meta := user.CredentialMeta(c.ID)
+		v := largeBlobView{
+			CredentialID: encodeCredentialID(c.ID),
+			Supported:    meta.LargeBlob,
+			Pending:      blobPending(meta),
+		}
+		if !meta.BlobWrittenAt.IsZero() {
+			v.WrittenAt = &meta.BlobWrittenAt
+			v.SHA256 = hex.EncodeToString(meta.BlobSHA256)
+		}
+		views = append(views, v)
+	}
+
+	JSONResponse(w, views, http.StatusOK)
+}
+
+// QueueLargeBlob queues a blob to write to a passkey of the logged-in user by its next login, an empty blob
+// cancels the queued one. Only one write is queued at a time.
+func QueueLargeBlob(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		CredentialID string                    `json:"credentialId"`
+		Blob         protocol.URLEncodedBase64 `json:"blob"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "can't decode request: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	if len(req.Blob) > maxLargeBlobLen {
+		JSONResponse(w, fmt.Sprintf("blob is larger than %d bytes", maxLargeBlobLen), http.StatusBadRequest)
+
+		return
+	}
+
+	id, err := decodeCredentialID(req.CredentialID)
+	if err != nil {
+		JSONResponse(w, "can't decode credential id: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	meta := user.CredentialMeta(id)
+	if !meta.LargeBlob {
+		JSONResponse(w, map[string]string{"error": "largeblob_not_supported"}, http.StatusConflict)
+
+		return
+	}
+	if c, _, ok := pendingLargeBlob(user); ok && string(c.ID) != string(id) && len(req.Blob) > 0 {
+		JSONResponse(w, map[string]string{"error": "largeblob_write_pending"}, http.StatusConflict)
+
+		return
+	}
+
+	user.UpdateCredentialMeta(id, func(m *CredentialMeta) {
+		m.PendingBlob = req.Blob
+		m.PendingSince = time.Now()
+		m.PendingAttempts = 0
+	})
+	tenantFor(r).Store.SaveUser(user)
+
+	if len(req.Blob) == 0 {
+		Audit(r, "largeblob.write_cancelled", user, map[string]interface{}{"credentialId": req.CredentialID})
+		JSONResponse(w, "Blob Write Cancelled", http.StatusOK)
+
+		return
+	}
+
+	Audit(r, "largeblob.write_queued", user, map[string]interface{}{"credentialId": req.CredentialID, "size": len(req.Blob)})
+	JSONResponse(w, "Blob Write Queued, it is written after the next login with the passkey", http.StatusAccepted)
+}
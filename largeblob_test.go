@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// beginTestBlobWrite starts the write ceremony and returns its options and cookie
+func beginTestBlobWrite(t *testing.T, user PasskeyUser) (protocol.PublicKeyCredentialRequestOptions, *http.Cookie) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	BeginLargeBlobWrite(w, principalRequest(http.MethodPost, "/api/passkey/largeBlob/writeStart", nil, user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin: status %d: %s", w.Code, w.Body)
+	}
+
+	var options protocol.CredentialAssertion
+	if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+		t.Fatalf("begin: can't decode options: %s", err)
+	}
+
+	return options.Response, w.Result().Cookies()[0]
+}
+
+// finishTestBlobWrite answers the write ceremony with the written output of the client
+func finishTestBlobWrite(t *testing.T, user PasskeyUser, auth *softAuthenticator, written bool) int {
+	t.Helper()
+
+	options, cookie := beginTestBlobWrite(t, user)
+	body := auth.assertWithExtensions(t, options.Challenge, user.WebAuthnID(), map[string]interface{}{
+		extensionLargeBlob: map[string]interface{}{"written": written},
+	})
+
+	r := principalRequest(http.MethodPost, "/api/passkey/largeBlob/writeFinish", body, user)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	FinishLargeBlobWrite(w, r)
+
+	return w.Code
+}
+
+func newBlobTestUser(t *testing.T) (PasskeyUser, *softAuthenticator, *softAuthenticator) {
+	t.Helper()
+
+	tenant := newTestTenant(t)
+	user := tenant.Store.GetOrCreateUser("alice")
+	key, phone := newSoftAuthenticator(t), newSoftAuthenticator(t)
+	key.register(t, user)
+	phone.register(t, user)
+	user.UpdateCredentialMeta(key.id, func(m *CredentialMeta) {
+		m.LargeBlob = true
+		m.PendingBlob = []byte("certificate")
+		m.PendingSince = time.Now()
+	})
+	tenant.Store.SaveUser(user)
+
+	return user, key, phone
+}
+
+func TestLargeBlobWriteAfterLogin(t *testing.T) {
+	user, key, phone := newBlobTestUser(t)
+
+	// the login stays open to every passkey and only reads
+	options, _, err := defaultTenant.WebAuthn.BeginLogin(user, loginOptions(user)...)
+	if err != nil {
+		t.Fatalf("can't begin login: %s", err)
+	}
+	if n := len(options.Response.AllowedCredentials); n != 2 {
+		t.Fatalf("login allows %d passkeys, want 2", n)
+	}
+	if _, ok := options.Response.Extensions[extensionLargeBlob].(map[string]interface{})["write"]; ok {
+		t.Fatal("login asks for a write")
+	}
+
+	if largeBlobWriteOffer(user, &webauthn.Credential{ID: phone.id}) != nil {
+		t.Fatal("write offered after a login with another passkey")
+	}
+	if largeBlobWriteOffer(user, &webauthn.Credential{ID: key.id}) == nil {
+		t.Fatal("no write offered after a login with the passkey of the blob")
+	}
+
+	// the write ceremony is limited to the passkey of the blob
+	wopts, _ := beginTestBlobWrite(t, user)
+	if len(wopts.AllowedCredentials) != 1 || string(wopts.AllowedCredentials[0].CredentialID) != string(key.id) {
+		t.Fatalf("write allows %v, want only the passkey of the blob", wopts.AllowedCredentials)
+	}
+
+	if code := finishTestBlobWrite(t, user, key, true); code != http.StatusOK {
+		t.Fatalf("finish: status %d", code)
+	}
+	meta := user.CredentialMeta(key.id)
+	if len(meta.PendingBlob) != 0 || meta.BlobWrittenAt.IsZero() {
+		t.Fatalf("write not confirmed: %+v", meta)
+	}
+}
+
+func TestLargeBlobWriteAbandoned(t *testing.T) {
+	user, key, _ := newBlobTestUser(t)
+
+	for i := 0; i < largeBlobMaxAttempts; i++ {
+		if code := finishTestBlobWrite(t, user, key, false); code != http.StatusConflict {
+			t.Fatalf("attempt %d: status %d, want %d", i+1, code, http.StatusConflict)
+		}
+	}
+
+	if _, _, ok := pendingLargeBlob(user); ok {
+		t.Fatal("blob still pending after the last attempt")
+	}
+}
+
+func TestLargeBlobPendingExpires(t *testing.T) {
+	user, key, _ := newBlobTestUser(t)
+
+	user.UpdateCredentialMeta(key.id, func(m *CredentialMeta) { m.PendingSince = time.Now().Add(-largeBlobPendingTTL) })
+	if _, _, ok := pendingLargeBlob(user); ok {
+		t.Fatal("expired blob is pending")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// beginDiscoverableLogin is a helper function to start a login without username, it returns the challenge
+// and the cookies of the ceremony
+func beginDiscoverableLogin(t *testing.T) (protocol.URLEncodedBase64, []*http.Cookie) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	BeginLogin(w, httptest.NewRequest(http.MethodPost, "/api/passkey/loginStart", strings.NewReader(`{}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin login: status %d: %s", w.Code, w.Body)
+	}
+
+	var options protocol.CredentialAssertion
+	if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+		t.Fatalf("can't decode options: %s", err)
+	}
+
+	return options.Response.Challenge, w.Result().Cookies()
+}
+
+func TestFinishLoginUnknownUserHandle(t *testing.T) {
+	tenant := newTestTenant(t)
+	newTestSessions(t)
+	discoverableLogin = discoverableOn
+	t.Cleanup(func() { discoverableLogin = discoverableOff })
+
+	user := tenant.Store.GetOrCreateUser("alice")
+	auth := newSoftAuthenticator(t)
+	auth.register(t, user)
+	tenant.Store.SaveUser(user)
+
+	finish := func(userHandle []byte) *httptest.ResponseRecorder {
+		challenge, cookies := beginDiscoverableLogin(t)
+		r := httptest.NewRequest(http.MethodPost, "/api/passkey/loginFinish", bytes.NewReader(auth.assert(t, challenge, userHandle)))
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		FinishLogin(w, r)
+
+		return w
+	}
+
+	// an unverified user handle of nobody fails the login and doesn't create the user
+	if w := finish([]byte("mallory")); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown user handle: status %d: %s", w.Code, w.Body)
+	}
+	if _, ok := tenant.Store.GetUser("mallory"); ok {
+		t.Fatal("login attempt created the user")
+	}
+
+	if w := finish(user.WebAuthnID()); w.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	mailerSMTP   = "smtp"
+	mailerFile   = "file"
+	mailerMemory = "memory"
+)
+
+// Mail is a plain text email
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+// mailer sends verification and recovery links
+var mailer Mailer
+
+// newMailer makes the Mailer selected by MAILER. Outside of development (local is false) MAILER is required,
+// the memory mailer never delivers verification and recovery links.
+func newMailer(local bool) (Mailer, error) {
+	from := getEnv("MAIL_FROM", "passkey@localhost")
+
+	mode := getEnv("MAILER", "")
+	switch {
+	case mode == "" && local:
+		mode = mailerMemory
+	case mode == "":
+		return nil, fmt.Errorf("MAILER is required outside of localhost: smtp, file or memory")
+	case mode == mailerMemory && !local:
+		l.Printf("[WARN] MAILER=memory: emails are kept in memory and never delivered, " +
+			"users can't verify addresses or recover accounts by email")
+	}
+
+	switch mode {
+	case mailerSMTP:
+		addr := getEnv("SMTP_ADDR", "")
+		if addr == "" {
+			return nil, fmt.Errorf("SMTP_ADDR is required with MAILER=smtp")
+		}
+
+		return NewSMTPMailer(addr, getEnv("SMTP_USER", ""), getEnv("SMTP_PASSWORD", ""), from), nil
+	case mailerFile:
+		return NewFileMailer(getEnv("MAIL_DIR", "mail"), from)
+	case mailerMemory:
+		return NewMemMailer(), nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q", mode)
+	}
+}
+
+// SMTPMailer sends emails with net/smtp, STARTTLS is used when the server offers it
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer makes an SMTPMailer for the server at addr ("host:port"), without user there is no auth
+func NewSMTPMailer(addr, user, password, from string) *SMTPMailer {
+	m := &SMTPMailer{addr: addr, from: from}
+	if user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", user, password, host)
+	}
+
+	return m
+}
+
+func (m *SMTPMailer) Send(_ context.Context, mail Mail) error {
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{mail.To}, formatMail(m.from, mail)); err != nil {
+		return fmt.Errorf("can't send mail to %s: %w", mail.To, err)
+	}
+
+	return nil
+}
+
+// FileMailer writes every email to a .eml file in dir, for local development
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("can't make mail dir: %w", err)
+	}
+
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (m *FileMailer) Send(_ context.Context, mail Mail) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), uuid.NewString())
+	if err := os.WriteFile(filepath.Join(m.dir, name), formatMail(m.from, mail), 0o600); err != nil {
+		return fmt.Errorf("can't write mail: %w", err)
+	}
+	l.Printf("[INFO] mail to %s written to %s", mail.To, name)
+
+	return nil
+}
+
+// MemMailer keeps sent emails in memory, for tests
+type MemMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func NewMemMailer() *MemMailer {
+	return &MemMailer{}
+}
+
+func (m *MemMailer) Send(_ context.Context, mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, mail)
+	l.Printf("[DEBUG] mail to %s: %s", mail.To, mail.Subject)
+
+	return nil
+}
+
+// Sent returns the emails sent so far
+func (m *MemMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Mail(nil), m.sent...)
+}
+
+// formatMail is a helper function to make the RFC 5322 message
+func formatMail(from string, m Mail) []byte {
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + m.To + "\r\n")
+	b.WriteString("Subject: " + m.Subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
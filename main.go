@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 )
 
@@ -15,9 +20,10 @@ var (
 	webAuthn *webauthn.WebAuthn
 	err      error
 
-	datastore PasskeyStore
-	//sessions  SessionStore
-	l Logger
+	datastore  PasskeyStore
+	sessions   SessionManager
+	ceremonies CeremonyStore
+	l          Logger
 )
 
 type Logger interface {
@@ -28,15 +34,70 @@ type PasskeyUser interface {
 	webauthn.User
 	AddCredential(*webauthn.Credential)
 	UpdateCredential(*webauthn.Credential)
+	RemoveCredential(id []byte) bool
+	CredentialMeta(id []byte) CredentialMeta
+	// UpdateCredentialMeta changes the meta of the passkey by fn, atomically for concurrent updates
+	UpdateCredentialMeta(id []byte, fn func(m *CredentialMeta))
+	RecoveryCodes() []RecoveryCode
+	SetRecoveryCodes(codes []RecoveryCode)
+	// EmailAddress returns the email of the user and whether it is verified
+	EmailAddress() (string, bool)
+	SetEmailAddress(addr string, verified bool)
+	Password() LegacyPassword
+	SetPassword(p LegacyPassword)
+	TOTP() TOTPSecret
+	SetTOTP(s TOTPSecret)
+	Roles() []string
+	SetRoles(roles []string)
 }
 
 type PasskeyStore interface {
 	GetOrCreateUser(userName string) PasskeyUser
+	// GetUser returns an existing user, unauthenticated routes use it so they don't create users
+	GetUser(userName string) (PasskeyUser, bool)
 	SaveUser(PasskeyUser)
 	GenSessionID() (string, error)
 	GetSession(token string) (webauthn.SessionData, bool)
 	SaveSession(token string, data webauthn.SessionData)
 	DeleteSession(token string)
+	GetAuthSession(token string) (AuthSession, bool)
+	SaveAuthSession(token string, data AuthSession)
+	DeleteAuthSession(token string)
+	ListUsers() []PasskeyUser
+	Stats() StoreStats
+	// MarkUsed marks the single-use id (ceremony state, email link, revoked token) as used until it expires
+	// and reports whether it was unused, atomically. A store shared by the instances makes them single-use overall.
+	MarkUsed(id string, until time.Time) bool
+	// IsUsed reports whether the single-use id is marked as used
+	IsUsed(id string) bool
+	// Ping checks that the store responds, in constant time whatever it holds, and gives up when ctx is done
+	Ping(ctx context.Context) error
+}
+
+// CeremonyStore keeps webauthn.SessionData between Begin* and Finish* calls of a ceremony.
+// Load consumes the data; how far that holds across instances depends on the store.
+type CeremonyStore interface {
+	Save(w http.ResponseWriter, ceremony string, data webauthn.SessionData) error
+	Load(w http.ResponseWriter, r *http.Request, ceremony string) (webauthn.SessionData, error)
+}
+
+// SessionManager issues and checks the login session handed out after FinishLogin
+type SessionManager interface {
+	// Issue issues a session for the assertion, a non-empty scope limits it like IssueScoped does
+	Issue(w http.ResponseWriter, r *http.Request, user PasskeyUser, credential *webauthn.Credential, scope string) error
+	// IssueScoped issues a session without an assertion that is valid only for the routes of the scope,
+	// an empty scope is a regular session (e.g. after a password login), ttl <= 0 is the default one
+	IssueScoped(w http.ResponseWriter, r *http.Request, user PasskeyUser, scope string, ttl time.Duration) error
+	// Check returns the session of the request, sessions of other tenants are not valid
+	Check(r *http.Request) (AuthSession, bool)
+	Revoke(w http.ResponseWriter, r *http.Request)
+	// Promote turns the scoped session into a regular one with a new id, keeping its assertion
+	Promote(w http.ResponseWriter, r *http.Request) error
+	// Reauthenticate records a fresh assertion for the current session and rotates its id
+	Reauthenticate(w http.ResponseWriter, r *http.Request, credential *webauthn.Credential) error
+	// Touch records activity of the session: it slides the idle timeout and rotates the id when due,
+	// re-issuing the cookie, and returns the session as it is now
+	Touch(w http.ResponseWriter, r *http.Request, session AuthSession) (AuthSession, error)
 }
 
 func main() {
@@ -47,12 +108,36 @@ func main() {
 	port := getEnv("PORT", ":8080")
 	origin := fmt.Sprintf("%s://%s%s", proto, host, port)
 
+	defaultTenant = &Tenant{
+		ID:      "default",
+		RPID:    host,
+		Origins: []string{origin},
+		// Other domains and native apps sharing passkeys with this one
+		RelatedOrigins: splitList(getEnv("RELATED_ORIGINS", "")),
+		AppleAppIDs:    splitList(getEnv("APPLE_APP_IDS", "")),
+		AndroidApps:    parseAndroidApps(getEnv("ANDROID_APPS", "")),
+	}
+	extraOrigins, xerr := defaultTenant.extraOrigins()
+	if xerr != nil {
+		fmt.Printf("[FATA] %s", xerr.Error())
+		os.Exit(1)
+	}
+
 	l.Printf("[INFO] make webauthn config")
 	wconfig := &webauthn.Config{
 		RPDisplayName: "Go Webauthn",    // Display Name for your site
 		RPID:          host,             // Generally the FQDN for your site
 		RPOrigins:     []string{origin}, // The origin URLs allowed for WebAuthn
 	}
+	wconfig.RPOrigins = append(wconfig.RPOrigins, extraOrigins...)
+
+	switch defaultTenant.Attestation = getEnv("ATTESTATION", defaultAttestation()); protocol.ConveyancePreference(defaultTenant.Attestation) {
+	case "", protocol.PreferNoAttestation, protocol.PreferIndirectAttestation, protocol.PreferDirectAttestation, protocol.PreferEnterpriseAttestation:
+		wconfig.AttestationPreference = protocol.ConveyancePreference(defaultTenant.Attestation)
+	default:
+		fmt.Printf("[FATA] unknown ATTESTATION %q", defaultTenant.Attestation)
+		os.Exit(1)
+	}
 
 	l.Printf("[INFO] create webauthn")
 	if webAuthn, err = webauthn.New(wconfig); err != nil {
@@ -61,23 +146,322 @@ func main() {
 	}
 
 	l.Printf("[INFO] create datastore")
-	datastore = NewInMem(l)
+	datastore = newInstrumentedStore(NewInMem(l))
+
+	defaultTenant.DisplayName = wconfig.RPDisplayName
+	defaultTenant.WebAuthn = webAuthn
+	defaultTenant.Store = datastore
+
+	// with TENANTS_CONFIG requests of unknown hosts are rejected, otherwise the default tenant serves all of them
+	var tenantList []*Tenant
+	fallback := defaultTenant
+	if path := getEnv("TENANTS_CONFIG", ""); path != "" {
+		l.Printf("[INFO] load tenants from %s", path)
+		if tenantList, err = loadTenants(path); err != nil {
+			fmt.Printf("[FATA] %s", err.Error())
+			os.Exit(1)
+		}
+		fallback = nil
+	}
+	if tenants, err = NewTenantRegistry(tenantList, fallback); err != nil {
+		fmt.Printf("[FATA] %s", err.Error())
+		os.Exit(1)
+	}
+
+	if path := getEnv("METADATA_BLOB", ""); path != "" {
+		l.Printf("[INFO] load metadata blob %s", path)
+		mds = NewMetadataBLOB(path, getEnv("METADATA_VERIFY", "true") == "true")
+		if err := mds.Load(); err != nil {
+			fmt.Printf("[FATA] %s", err.Error())
+			os.Exit(1)
+		}
+		mds.Install()
+	}
+
+	switch statusPolicy = getEnv("MDS_STATUS_POLICY", statusFlag); statusPolicy {
+	case statusFlag, statusReregister, statusDisable:
+	default:
+		fmt.Printf("[FATA] unknown MDS_STATUS_POLICY %q", statusPolicy)
+		os.Exit(1)
+	}
+
+	if path := getEnv("TRUST_STORE", ""); path != "" {
+		l.Printf("[INFO] load attestation trust store %s", path)
+		if trustStore, err = LoadTrustStore(path); err != nil {
+			fmt.Printf("[FATA] %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	switch policy := getEnv("REVOCATION_POLICY", revocationOff); policy {
+	case revocationOff:
+	case revocationFailOpen, revocationFailClosed:
+		dir := getEnv("CRL_DIR", "")
+		if dir == "" {
+			fmt.Printf("[FATA] CRL_DIR is required by REVOCATION_POLICY %s", policy)
+			os.Exit(1)
+		}
+		l.Printf("[INFO] load CRLs from %s", dir)
+		crls = NewCRLStore(dir, policy)
+		if err := crls.Load(); err != nil {
+			fmt.Printf("[FATA] %s", err.Error())
+			os.Exit(1)
+		}
+		go crls.Run(context.Background(), getEnvDuration("CRL_REFRESH", time.Hour))
+	default:
+		fmt.Printf("[FATA] unknown REVOCATION_POLICY %q", policy)
+		os.Exit(1)
+	}
+
+	if err := aaguids.LoadCommunity(bundledAAGUIDs); err != nil {
+		fmt.Printf("[FATA] %s", err.Error())
+		os.Exit(1)
+	}
+	if path := getEnv("AAGUID_OVERRIDES", ""); path != "" {
+		l.Printf("[INFO] load AAGUID overrides from %s", path)
+		if err := aaguids.LoadOverrides(path); err != nil {
+			fmt.Printf("[FATA] %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if path := getEnv("AUDIT_LOG", ""); path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			fmt.Printf("[FATA] %s", err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		auditLog = NewAuditLog(f)
+	}
+
+	l.Printf("[INFO] create mailer")
+	if mailer, err = newMailer(tenants.Local()); err != nil {
+		fmt.Printf("[FATA] %s", err.Error())
+		os.Exit(1)
+	}
+
+	linkKey, kerr := base64.StdEncoding.DecodeString(getEnv("EMAIL_LINK_KEY", ""))
+	if kerr != nil {
+		fmt.Printf("[FATA] can't decode EMAIL_LINK_KEY: %s", kerr.Error())
+		os.Exit(1)
+	}
+	if emailLinks, err = NewEmailLinks(linkKey, getEnvDuration("EMAIL_LINK_TTL", 15*time.Minute), newStoreReplayCache(datastore, "link:")); err != nil {
+		fmt.Printf("[FATA] %s", err.Error())
+		os.Exit(1)
+	}
+	emailThrottle = NewLockout(getEnvInt("EMAIL_THROTTLE_MAX", 3), getEnvDuration("EMAIL_THROTTLE_WINDOW", time.Hour))
+
+	totpKey, kerr := base64.StdEncoding.DecodeString(getEnv("TOTP_KEY", ""))
+	if kerr != nil {
+		fmt.Printf("[FATA] can't decode TOTP_KEY: %s", kerr.Error())
+		os.Exit(1)
+	}
+	if totpVault, err = NewTOTPVault(totpKey); err != nil {
+		fmt.Printf("[FATA] %s", err.Error())
+		os.Exit(1)
+	}
+	totpPolicy = parseTOTPPolicy(getEnv("TOTP_REQUIRED_USERS", ""), getEnv("TOTP_REQUIRED_ROLES", ""))
+	totpLockout = NewLockout(getEnvInt("TOTP_MAX_FAILURES", 5), getEnvDuration("TOTP_LOCKOUT", 15*time.Minute))
+	totpRecoveryLockout = NewLockout(getEnvInt("TOTP_MAX_FAILURES", 5), getEnvDuration("TOTP_LOCKOUT", 15*time.Minute))
+	passwordLockout = NewLockout(getEnvInt("PASSWORD_MAX_FAILURES", 5), getEnvDuration("PASSWORD_LOCKOUT", 15*time.Minute))
+	if err = ApplyUserRoles(tenants, parseUserRoles(getEnv("USER_ROLES", ""))); err != nil {
+		fmt.Printf("[FATA] %s", err.Error())
+		os.Exit(1)
+	}
+
+	switch discoverableLogin = getEnv("DISCOVERABLE_LOGIN", discoverableOff); discoverableLogin {
+	case discoverableOff, discoverableOn, discoverableOnly:
+	default:
+		fmt.Printf("[FATA] unknown DISCOVERABLE_LOGIN %q", discoverableLogin)
+		os.Exit(1)
+	}
+
+	switch passwordMode = getEnv("PASSWORD_MODE", passwordOff); passwordMode {
+	case passwordOff, passwordOn, passwordUntilPasskey:
+	default:
+		fmt.Printf("[FATA] unknown PASSWORD_MODE %q", passwordMode)
+		os.Exit(1)
+	}
+
+	if path := getEnv("PASSWORD_IMPORT", ""); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("[FATA] %s", err.Error())
+			os.Exit(1)
+		}
+		n, err := ImportPasswords(tenants, f)
+		_ = f.Close()
+		if err != nil {
+			fmt.Printf("[FATA] %s", err.Error())
+			os.Exit(1)
+		}
+		l.Printf("[INFO] imported %d passwords from %s", n, path)
+	}
+
+	l.Printf("[INFO] create ceremony store")
+	if ceremonies, err = newCeremonyStore(); err != nil {
+		fmt.Printf("[FATA] %s", err.Error())
+		os.Exit(1)
+	}
+
+	ceremonies = newInstrumentedCeremonies(ceremonies, getEnv("CEREMONY_MODE", ceremonyModeMemory))
+
+	l.Printf("[INFO] create session manager")
+	if sessions, err = newSessionManager(origin); err != nil {
+		fmt.Printf("[FATA] %s", err.Error())
+		os.Exit(1)
+	}
+
+	if path := getEnv("WEBHOOKS_CONFIG", ""); path != "" {
+		l.Printf("[INFO] start webhooks from %s", path)
+		cfg, err := loadWebhookConfig(path)
+		if err != nil {
+			fmt.Printf("[FATA] %s", err.Error())
+			os.Exit(1)
+		}
+		if webhooks, err = NewWebhookDispatcher(cfg); err != nil {
+			fmt.Printf("[FATA] %s", err.Error())
+			os.Exit(1)
+		}
+		go webhooks.Run(context.Background())
+		AddHooks(newSecurityEvents())
+	}
+
+	// passkeys of models reported compromised are flagged now and after every reload of the blob
+	if mds != nil {
+		flagged, _ := ReevaluateCredentials(mds, tenants)
+		l.Printf("[INFO] authenticator status checked: %d passkeys flagged", flagged)
+		go RunStatusChecks(context.Background(), mds, tenants, getEnvDuration("MDS_REFRESH", 24*time.Hour))
+	}
 
 	l.Printf("[INFO] register routes")
 	// Serve the web files
 	http.Handle("/", http.FileServer(http.Dir("./web")))
+	http.HandleFunc("/.well-known/webauthn", RelatedOrigins)
+	http.HandleFunc("/.well-known/apple-app-site-association", AppleAppSiteAssociation)
+	http.HandleFunc("/.well-known/assetlinks.json", AssetLinks)
+
+	rateLimit := getEnvInt("RATE_LIMIT_PER_MINUTE", 0)
 
 	// Add auth the routes
-	http.HandleFunc("/api/passkey/registerStart", BeginRegistration)
-	http.HandleFunc("/api/passkey/registerFinish", FinishRegistration)
-	http.HandleFunc("/api/passkey/loginStart", BeginLogin)
-	http.HandleFunc("/api/passkey/loginFinish", FinishLogin)
+	http.Handle("/api/passkey/registerStart", RateLimitMiddleware(
+		metrics.InstrumentCeremony(ceremonyRegistration, "begin", http.HandlerFunc(BeginRegistration)), "registerStart", rateLimit))
+	http.Handle("/api/passkey/registerFinish", metrics.InstrumentCeremony(ceremonyRegistration, "finish", http.HandlerFunc(FinishRegistration)))
+	http.Handle("/api/passkey/loginStart", RateLimitMiddleware(
+		metrics.InstrumentCeremony(ceremonyLogin, "begin", http.HandlerFunc(BeginLogin)), "loginStart", rateLimit))
+	http.Handle("/api/passkey/loginFinish", metrics.InstrumentCeremony(ceremonyLogin, "finish", http.HandlerFunc(FinishLogin)))
+	http.HandleFunc("/api/passkey/logout", Logout)
+	http.Handle("/api/passkey/stepupStart", metrics.InstrumentCeremony(ceremonyStepUp, "begin", apiAuth(BeginStepUp)))
+	http.Handle("/api/passkey/stepupFinish", metrics.InstrumentCeremony(ceremonyStepUp, "finish", apiAuth(FinishStepUp)))
+
+	// Operations confirmed with a passkey, see HandleOperation
+	HandleOperation("echo", EchoOperation)
+	http.Handle("/api/tx/begin", metrics.InstrumentCeremony(ceremonyTx, "begin", apiAuth(BeginOperation)))
+	http.Handle("/api/tx/finish", metrics.InstrumentCeremony(ceremonyTx, "finish", apiAuth(FinishOperation)))
+
+	// Account recovery with a recovery code
+	http.Handle("/api/passkey/recover", RateLimitMiddleware(http.HandlerFunc(Recover), "recover", getEnvInt("RECOVERY_RATE_LIMIT_PER_MINUTE", 5)))
+	http.Handle("/api/passkey/recover/registerStart", metrics.InstrumentCeremony(ceremonyRecovery, "begin",
+		LoggedInMiddleware(http.HandlerFunc(BeginRecoveryRegistration), WithJSONUnauthorized(), WithScope(scopeRecovery))))
+	http.Handle("/api/passkey/recover/registerFinish", metrics.InstrumentCeremony(ceremonyRecovery, "finish",
+		LoggedInMiddleware(http.HandlerFunc(FinishRecoveryRegistration), WithJSONUnauthorized(), WithScope(scopeRecovery))))
+
+	// Second factor of logins flagged by the TOTP policy, see loginScope
+	totpRateLimit := getEnvInt("TOTP_RATE_LIMIT_PER_MINUTE", 5)
+	http.Handle("/api/totp/login/verify", RateLimitMiddleware(
+		LoggedInMiddleware(http.HandlerFunc(VerifyTOTP), WithJSONUnauthorized(), WithScope(scopeTOTP)), "totpVerify", totpRateLimit))
+	http.Handle("/api/totp/login/enroll", LoggedInMiddleware(http.HandlerFunc(EnrollTOTP), WithJSONUnauthorized(), WithScope(scopeTOTP)))
+	http.Handle("/api/totp/login/confirm", RateLimitMiddleware(
+		LoggedInMiddleware(http.HandlerFunc(ConfirmTOTP), WithJSONUnauthorized(), WithScope(scopeTOTP)), "totpVerify", totpRateLimit))
+	http.Handle("/api/totp/confirm", RateLimitMiddleware(apiAuth(ConfirmTOTP), "totpVerify", totpRateLimit))
+	http.Handle("/api/totp/recover", RateLimitMiddleware(http.HandlerFunc(RecoverWithTOTP), "recover", getEnvInt("RECOVERY_RATE_LIMIT_PER_MINUTE", 5)))
+
+	// Legacy passwords, only while migrating to passkeys
+	if passwordMode != passwordOff {
+		http.Handle("/api/password/login", RateLimitMiddleware(http.HandlerFunc(PasswordLogin), "passwordLogin", getEnvInt("PASSWORD_RATE_LIMIT_PER_MINUTE", 10)))
+		http.Handle("/api/password/upgrade/registerStart", metrics.InstrumentCeremony(ceremonyUpgrade, "begin", apiAuth(BeginPasskeyUpgrade)))
+		http.Handle("/api/password/upgrade/registerFinish", metrics.InstrumentCeremony(ceremonyUpgrade, "finish", apiAuth(FinishPasskeyUpgrade)))
+	}
+
+	// Email channel: verification and recovery links
+	http.HandleFunc("/api/passkey/email/verify", VerifyEmail)
+	http.Handle("/api/passkey/email/recoverStart", RateLimitMiddleware(http.HandlerFunc(RequestEmailRecovery), "emailRecover", getEnvInt("RECOVERY_RATE_LIMIT_PER_MINUTE", 5)))
+	http.Handle("/api/passkey/email/recover", RateLimitMiddleware(http.HandlerFunc(EmailRecover), "emailRecover", getEnvInt("RECOVERY_RATE_LIMIT_PER_MINUTE", 5)))
+
+	// Sensitive routes need a recent assertion
+	stepUpMaxAge := getEnvDuration("STEPUP_MAX_AGE", 5*time.Minute)
+	http.Handle("/api/passkey/credentials", apiAuth(ListCredentials))
+	http.Handle("/api/passkey/prf", apiAuth(PRFKeys))
+	http.Handle("/api/passkey/backup", apiAuth(BackupStatus))
+	http.Handle("/api/passkey/largeBlob", apiAuth(LargeBlobs))
+	http.Handle("/api/passkey/largeBlob/write", LoggedInMiddleware(
+		StepUpMiddleware(http.HandlerFunc(QueueLargeBlob), stepUpMaxAge, true),
+		WithJSONUnauthorized(),
+	))
+	http.Handle("/api/passkey/largeBlob/writeStart", metrics.InstrumentCeremony(ceremonyLargeBlob, "begin", apiAuth(BeginLargeBlobWrite)))
+	http.Handle("/api/passkey/largeBlob/writeFinish", metrics.InstrumentCeremony(ceremonyLargeBlob, "finish", apiAuth(FinishLargeBlobWrite)))
+	http.Handle("/api/passkey/prf/wrappedKey", LoggedInMiddleware(
+		StepUpMiddleware(http.HandlerFunc(SetWrappedKey), stepUpMaxAge, true),
+		WithJSONUnauthorized(),
+	))
+	http.Handle("/api/passkey/credentials/delete", LoggedInMiddleware(
+		StepUpMiddleware(http.HandlerFunc(DeleteCredential), stepUpMaxAge, true),
+		WithJSONUnauthorized(),
+	))
+	http.Handle("/api/passkey/email", LoggedInMiddleware(
+		StepUpMiddleware(http.HandlerFunc(SetEmail), stepUpMaxAge, true),
+		WithJSONUnauthorized(),
+	))
+	http.Handle("/api/password/disable", LoggedInMiddleware(
+		StepUpMiddleware(http.HandlerFunc(DisablePassword), stepUpMaxAge, true),
+		WithJSONUnauthorized(),
+	))
+	http.Handle("/api/totp/enroll", LoggedInMiddleware(
+		StepUpMiddleware(http.HandlerFunc(EnrollTOTP), stepUpMaxAge, true),
+		WithJSONUnauthorized(),
+	))
+	http.Handle("/api/totp/disable", LoggedInMiddleware(
+		StepUpMiddleware(http.HandlerFunc(DisableTOTP), stepUpMaxAge, true),
+		WithJSONUnauthorized(),
+	))
+	http.Handle("/api/passkey/recovery/regenerate", LoggedInMiddleware(
+		StepUpMiddleware(http.HandlerFunc(RegenerateRecoveryCodes), stepUpMaxAge, true),
+		WithJSONUnauthorized(),
+	))
 
 	http.Handle("/private", LoggedInMiddleware(http.HandlerFunc(PrivatePage)))
 
+	// Metrics and probes don't belong to a tenant
+	root := http.NewServeMux()
+	root.Handle("/", TenantMiddleware(http.DefaultServeMux, tenants))
+	root.Handle("/metrics", MetricsAuth(metrics, getEnv("METRICS_TOKEN", "")))
+
+	// Probes
+	tlsCert, tlsKey := getEnv("TLS_CERT", ""), getEnv("TLS_KEY", "")
+	checkTimeout := getEnvDuration("READY_CHECK_TIMEOUT", 2*time.Second)
+	AddReadinessCheck(ReadinessCheck{Name: "store", Timeout: checkTimeout, Check: storeCheck(datastore)})
+	for _, t := range tenantList {
+		AddReadinessCheck(ReadinessCheck{Name: "store:" + t.ID, Timeout: checkTimeout, Check: storeCheck(t.Store)})
+	}
+	if mds != nil {
+		AddReadinessCheck(ReadinessCheck{Name: "metadata", Timeout: checkTimeout, Check: metadataCheck(mds)})
+	}
+	if tlsCert != "" {
+		AddReadinessCheck(ReadinessCheck{Name: "tls", Timeout: checkTimeout, Check: tlsCheck(tlsCert, tlsKey)})
+	}
+	root.HandleFunc("/healthz", Healthz)
+	root.HandleFunc("/readyz", Readyz)
+	root.HandleFunc("/version", Version)
+
 	// Start the server
 	l.Printf("[INFO] start server at %s", origin)
-	if err := http.ListenAndServe(port, nil); err != nil {
+	if tlsCert != "" {
+		err = http.ListenAndServeTLS(port, tlsCert, tlsKey, root)
+	} else {
+		err = http.ListenAndServe(port, root)
+	}
+	if err != nil {
 		fmt.Println(err)
 	}
 }
@@ -94,65 +478,71 @@ func BeginRegistration(w http.ResponseWriter, r *http.Request) {
 		panic(err) // FIXME: handle error
 	}
 
-	user := datastore.GetOrCreateUser(username) // Find or create the new user
+	user := tenantFor(r).Store.GetOrCreateUser(username) // Find or create the new user
+	if registrationRefused(w, r, user) {
+		return
+	}
+
+	if err := hooks.BeforeBeginRegistration(r, user); err != nil {
+		vetoResponse(w, err)
+
+		return
+	}
 
-	options, session, err := webAuthn.BeginRegistration(user)
+	options, session, err := tenantFor(r).WebAuthn.BeginRegistration(user, webauthn.WithExtensions(registrationExtensions()))
 	if err != nil {
 		msg := fmt.Sprintf("can't begin registration: %s", err.Error())
 		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
 		JSONResponse(w, msg, http.StatusBadRequest)
 
 		return
 	}
 
-	// Make a session key and store the sessionData values
-	t, err := datastore.GenSessionID()
-	if err != nil {
-		l.Printf("[ERRO] can't generate session id: %s", err.Error())
+	// Store the sessionData values until FinishRegistration
+	if err := ceremonies.Save(w, ceremonyRegistration, *session); err != nil {
+		msg := fmt.Sprintf("can't save registration session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
 
-		panic(err) // FIXME: handle error
+		return
 	}
 
-	datastore.SaveSession(t, *session)
-
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sid",
-		Value:    t,
-		Path:     "api/passkey/registerStart",
-		MaxAge:   3600,
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode, // TODO: SameSiteStrictMode maybe?
-	})
+	hooks.AfterBeginRegistration(r, user)
 
 	JSONResponse(w, options, http.StatusOK) // return the options generated with the session key
 	// options.publicKey contain our registration options
 }
 
 func FinishRegistration(w http.ResponseWriter, r *http.Request) {
-	// Get the session key from cookie
-	sid, err := r.Cookie("sid")
+	// Get the session data stored from the function above
+	session, err := ceremonies.Load(w, r, ceremonyRegistration)
 	if err != nil {
-		l.Printf("[ERRO] can't get session id: %s", err.Error())
+		msg := fmt.Sprintf("can't get registration session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
 
-		panic(err) // FIXME: handle error
+		return
 	}
 
-	// Get the session data stored from the function above
-	session, _ := datastore.GetSession(sid.Value) // FIXME: cover invalid session
-
 	// In out example username == userID, but in real world it should be different
-	user := datastore.GetOrCreateUser(string(session.UserID)) // Get the user
+	user := tenantFor(r).Store.GetOrCreateUser(string(session.UserID)) // Get the user
+	if registrationRefused(w, r, user) {
+		return
+	}
+
+	if err := hooks.BeforeFinishRegistration(r, user); err != nil {
+		vetoResponse(w, err)
+
+		return
+	}
 
-	credential, err := webAuthn.FinishRegistration(user, session, r)
+	credential, ext, err := finishCreation(tenantFor(r), user, session, r)
 	if err != nil {
 		msg := fmt.Sprintf("can't finish registration: %s", err.Error())
 		l.Printf("[ERRO] %s", msg)
-		// clean up sid cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:  "sid",
-			Value: "",
-		})
+		setErrorCode(w, err)
 		JSONResponse(w, msg, http.StatusBadRequest)
 
 		return
@@ -160,18 +550,67 @@ func FinishRegistration(w http.ResponseWriter, r *http.Request) {
 
 	// If creation was successful, store the credential object
 	user.AddCredential(credential)
-	datastore.SaveUser(user)
-	// Delete the session data
-	datastore.DeleteSession(sid.Value)
-	http.SetCookie(w, &http.Cookie{
-		Name:  "sid",
-		Value: "",
-	})
+	if err := recordCredential(user, credential, ext); err != nil {
+		l.Printf("[ERRO] %s", err.Error())
+	}
+	tenantFor(r).Store.SaveUser(user)
+
+	hooks.AfterFinishRegistration(r, user, credential)
+
+	// The first passkey gets recovery codes, they are shown only now
+	if len(user.RecoveryCodes()) == 0 {
+		codes, err := issueRecoveryCodes(r, user, "recovery.codes_generated")
+		if err != nil {
+			l.Printf("[ERRO] %s", err.Error())
+			JSONResponse(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		l.Printf("[INFO] finish registration ----------------------/")
+		JSONResponse(w, map[string]interface{}{"message": "Registration Success", "recoveryCodes": codes}, http.StatusOK)
+
+		return
+	}
 
 	l.Printf("[INFO] finish registration ----------------------/")
 	JSONResponse(w, "Registration Success", http.StatusOK) // Handle next steps
 }
 
+// registrationRefused answers 403 if the user already has a passkey or a password and the request doesn't carry
+// a full session of that user. Without it anyone could add a passkey to the account: password users enroll
+// the first one through the upgrade routes, locked-out users through the recovery ones.
+func registrationRefused(w http.ResponseWriter, r *http.Request, user PasskeyUser) bool {
+	if len(user.WebAuthnCredentials()) == 0 && user.Password().Hash == "" {
+		return false
+	}
+
+	session, ok := sessions.Check(r)
+	if ok && bytes.Equal(session.UserID, user.WebAuthnID()) {
+		switch session.Scope {
+		case "":
+			return false
+		case scopeRecovery:
+			// the recovery session is the only way into a locked-out account, and only on its own routes
+			Audit(r, "registration.refused", user, map[string]interface{}{"scope": session.Scope})
+			JSONResponse(w, map[string]string{
+				"error":   "recovery_session",
+				"message": "enroll the passkey with /api/passkey/recover/registerStart",
+			}, http.StatusForbidden)
+
+			return true
+		}
+	}
+
+	Audit(r, "registration.refused", user, nil)
+	JSONResponse(w, map[string]string{
+		"error":   "account_exists",
+		"message": "the account already exists, log in to add a passkey to it",
+	}, http.StatusForbidden)
+
+	return true
+}
+
 func BeginLogin(w http.ResponseWriter, r *http.Request) {
 	l.Printf("[INFO] begin login ----------------------\\")
 
@@ -181,104 +620,189 @@ func BeginLogin(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	user := datastore.GetOrCreateUser(username) // Find the user
+	// Without username the authenticator offers discoverable passkeys, the user is known only in FinishLogin
+	if username == "" {
+		BeginDiscoverableLogin(w, r)
+
+		return
+	}
+
+	user := tenantFor(r).Store.GetOrCreateUser(username) // Find the user
+
+	if err := hooks.BeforeBeginLogin(r, user); err != nil {
+		vetoResponse(w, err)
+
+		return
+	}
+
+	if !usernameLoginAllowed(user) {
+		JSONResponse(w, map[string]string{"error": "usernameless_required"}, http.StatusForbidden)
+
+		return
+	}
 
-	options, session, err := webAuthn.BeginLogin(user)
+	options, session, err := tenantFor(r).WebAuthn.BeginLogin(user, loginOptions(user)...)
 	if err != nil {
 		msg := fmt.Sprintf("can't begin login: %s", err.Error())
 		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
 		JSONResponse(w, msg, http.StatusBadRequest)
 
 		return
 	}
 
-	// Make a session key and store the sessionData values
-	t, err := datastore.GenSessionID()
-	if err != nil {
-		l.Printf("[ERRO] can't generate session id: %s", err.Error())
+	// Store the sessionData values until FinishLogin
+	if err := ceremonies.Save(w, ceremonyLogin, *session); err != nil {
+		msg := fmt.Sprintf("can't save login session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
 
-		panic(err) // TODO: handle error
+		return
 	}
-	datastore.SaveSession(t, *session)
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sid",
-		Value:    t,
-		Path:     "api/passkey/loginStart",
-		MaxAge:   3600,
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode, // TODO: SameSiteStrictMode maybe?
-	})
+	hooks.AfterBeginLogin(r, user)
 
 	JSONResponse(w, options, http.StatusOK) // return the options generated with the session key
 	// options.publicKey contain our registration options
 }
 
 func FinishLogin(w http.ResponseWriter, r *http.Request) {
-	// Get the session key from cookie
-	sid, err := r.Cookie("sid")
+	// Get the session data stored from the function above
+	session, err := ceremonies.Load(w, r, ceremonyLogin)
+	if err != nil {
+		msg := fmt.Sprintf("can't get login session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
 	if err != nil {
-		l.Printf("[ERRO] can't get session id: %s", err.Error())
+		msg := fmt.Sprintf("can't finish login: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
 
-		panic(err) // FIXME: handle error
+		return
 	}
-	// Get the session data stored from the function above
-	session, _ := datastore.GetSession(sid.Value) // FIXME: cover invalid session
 
-	// In out example username == userID, but in real world it should be different
-	user := datastore.GetOrCreateUser(string(session.UserID)) // Get the user
+	// A discoverable login has no user in the session, the passkey tells it by the user handle
+	userID := session.UserID
+	if len(userID) == 0 {
+		userID = parsed.Response.UserHandle
+	}
+	if len(userID) == 0 {
+		JSONResponse(w, "can't finish login: no user handle", http.StatusBadRequest)
+
+		return
+	}
+
+	// In out example username == userID, but in real world it should be different.
+	// The user handle isn't verified yet, an unknown one fails like a wrong assertion and creates no user.
+	user, found := tenantFor(r).Store.GetUser(string(userID))
+	if !found {
+		l.Printf("[ERRO] can't finish login: unknown user")
+		JSONResponse(w, "can't finish login: unknown user", http.StatusBadRequest)
 
-	credential, err := webAuthn.FinishLogin(user, session, r)
+		return
+	}
+
+	if loginVetoed(w, r, user) {
+		return
+	}
+
+	credential, err := finishAssertion(tenantFor(r), user, session, parsed)
 	if err != nil {
-		l.Printf("[ERRO] can't finish login: %s", err.Error())
-		panic(err)
+		msg := fmt.Sprintf("can't finish login: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
 	}
 
 	// Handle credential.Authenticator.CloneWarning
 	if credential.Authenticator.CloneWarning {
-		l.Printf("[WARN] can't finish login: %s", "CloneWarning")
+		cloneWarning(user, credential, ceremonyLogin)
 	}
 
-	// If login was successful, update the credential object
-	user.UpdateCredential(credential)
-	datastore.SaveUser(user)
-
-	// Delete the login session data
-	datastore.DeleteSession(sid.Value)
-	http.SetCookie(w, &http.Cookie{
-		Name:  "sid",
-		Value: "",
-	})
+	if credentialDisabled(r, user, credential) {
+		disabledResponse(w)
 
-	// Add the new session cookie
-	t, err := datastore.GenSessionID()
-	if err != nil {
-		l.Printf("[ERRO] can't generate session id: %s", err.Error())
+		return
+	}
 
-		panic(err) // TODO: handle error
+	// If login was successful, update the credential object
+	updateCredential(r, user, credential)
+	tenantFor(r).Store.SaveUser(user)
+
+	// Add the new session cookie, users flagged by the TOTP policy get a session that only allows the second factor,
+	// a passkey of a compromised model may only enroll a new one by the status policy
+	scope := statusScope(user, credential, loginScope(user))
+	if err := sessions.Issue(w, r, user, credential, scope); err != nil {
+		msg := fmt.Sprintf("can't issue session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
 	}
 
-	datastore.SaveSession(t, webauthn.SessionData{
-		Expires: time.Now().Add(time.Hour),
-	})
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sid",
-		Value:    t,
-		Path:     "/",
-		MaxAge:   3600,
-		Secure:   true,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode, // TODO: SameSiteStrictMode maybe?
-	})
+	// the login of a TOTP session completes with the second factor, promoteSession runs the hook then
+	if scope != scopeTOTP {
+		hooks.AfterFinishLogin(r, user, credential)
+	}
 
 	l.Printf("[INFO] finish login ----------------------/")
+	switch scope {
+	case scopeTOTP:
+		JSONResponse(w, totpChallenge(user), http.StatusOK)
+
+		return
+	case scopeRecovery:
+		JSONResponse(w, reregisterChallenge(), http.StatusOK)
+
+		return
+	}
+	// a blob queued for this passkey is written by a second assertion limited to it
+	if offer := largeBlobWriteOffer(user, credential); offer != nil {
+		JSONResponse(w, map[string]interface{}{"message": "Login Success", "largeBlobWrite": offer}, http.StatusOK)
+
+		return
+	}
 	JSONResponse(w, "Login Success", http.StatusOK)
 }
 
+func Logout(w http.ResponseWriter, r *http.Request) {
+	var user PasskeyUser
+	if session, ok := sessions.Check(r); ok {
+		// the session of a deleted user is revoked without hooks
+		if u, found := tenantFor(r).Store.GetUser(string(session.UserID)); found {
+			user = u
+		}
+	}
+	if user != nil {
+		if err := hooks.BeforeLogout(r, user); err != nil {
+			vetoResponse(w, err)
+
+			return
+		}
+	}
+
+	sessions.Revoke(w, r)
+
+	if user != nil {
+		hooks.AfterLogout(r, user)
+	}
+
+	l.Printf("[INFO] logout")
+	JSONResponse(w, "Logout Success", http.StatusOK)
+}
+
 func PrivatePage(w http.ResponseWriter, r *http.Request) {
-	// just show "Hello, World!" for now
-	_, _ = w.Write([]byte("Hello, World!"))
+	p, _ := PrincipalFromContext(r.Context())
+	_, _ = w.Write([]byte(fmt.Sprintf("Hello, %s!", p.DisplayName)))
 }
 
 // JSONResponse is a helper function to send json response
@@ -288,6 +812,11 @@ func JSONResponse(w http.ResponseWriter, data interface{}, status int) {
 	_ = json.NewEncoder(w).Encode(data)
 }
 
+// apiAuth is a helper function to wrap API handlers with LoggedInMiddleware in JSON mode
+func apiAuth(h http.HandlerFunc) http.Handler {
+	return LoggedInMiddleware(h, WithJSONUnauthorized())
+}
+
 // getUsername is a helper function to extract the username from json request
 func getUsername(r *http.Request) (string, error) {
 	type Username struct {
@@ -310,30 +839,103 @@ func getEnv(key, def string) string {
 	return def
 }
 
-func LoggedInMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// TODO: url to redirect to should be passed as a parameter
+// getEnvInt is a helper function to get the environment variable as int
+func getEnvInt(key string, def int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return def
+	}
 
-		sid, err := r.Cookie("sid")
-		if err != nil {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		l.Printf("[WARN] can't parse %s=%q as int, use %d", key, value, def)
 
-			return
-		}
+		return def
+	}
 
-		session, ok := datastore.GetSession(sid.Value)
-		if !ok {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+	return n
+}
 
-			return
+// getEnvDuration is a helper function to get the environment variable as time.Duration
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		l.Printf("[WARN] can't parse %s=%q as duration, use %s", key, value, def)
+
+		return def
+	}
+
+	return d
+}
+
+// MiddlewareOption configures LoggedInMiddleware
+type MiddlewareOption func(*middlewareOptions)
+
+type middlewareOptions struct {
+	redirect string
+	json     bool
+	scope    string
+}
+
+// WithRedirect sets the url to redirect not logged-in users to, "/" by default
+func WithRedirect(url string) MiddlewareOption {
+	return func(o *middlewareOptions) {
+		o.redirect = url
+	}
+}
+
+// WithJSONUnauthorized answers 401 with a JSON error instead of the redirect, for API routes
+func WithJSONUnauthorized() MiddlewareOption {
+	return func(o *middlewareOptions) {
+		o.json = true
+	}
+}
+
+// WithScope lets through only sessions of the scope, e.g. a recovery session, instead of regular ones
+func WithScope(scope string) MiddlewareOption {
+	return func(o *middlewareOptions) {
+		o.scope = scope
+	}
+}
+
+// LoggedInMiddleware lets through only requests with a valid session and puts the Principal into the request context
+func LoggedInMiddleware(next http.Handler, opts ...MiddlewareOption) http.Handler {
+	o := middlewareOptions{redirect: "/"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := sessions.Check(r)
+		if ok {
+			var err error
+			if session, err = sessions.Touch(w, r, session); err != nil {
+				l.Printf("[ERRO] can't renew session: %s", err.Error())
+				ok = false
+			}
+		}
+		// a session outlives its user if the user is deleted, it doesn't bring the user back
+		var user PasskeyUser
+		if ok {
+			user, ok = tenantFor(r).Store.GetUser(string(session.UserID))
 		}
+		if !ok || session.Scope != o.scope {
+			if o.json {
+				JSONResponse(w, map[string]string{"error": "login_required"}, http.StatusUnauthorized)
+
+				return
+			}
 
-		if session.Expires.Before(time.Now()) {
-			http.Redirect(w, r, "/", http.StatusSeeOther)
+			http.Redirect(w, r, o.redirect, http.StatusSeeOther)
 
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), newPrincipal(session, user))))
 	})
 }
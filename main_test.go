@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	testRPID   = "localhost"
+	testOrigin = "http://localhost:8080"
+)
+
+// newTestTenant sets up the default tenant with an in-memory store, as main does
+func newTestTenant(t *testing.T) *Tenant {
+	t.Helper()
+
+	l = testLogger()
+
+	w, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "Go Webauthn",
+		RPID:          testRPID,
+		RPOrigins:     []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatalf("can't create webauthn: %s", err)
+	}
+
+	datastore = NewInMem(l)
+	ceremonies = NewMemCeremonies(datastore, time.Minute)
+	defaultTenant = &Tenant{
+		ID:          "default",
+		RPID:        testRPID,
+		DisplayName: "Go Webauthn",
+		Origins:     []string{testOrigin},
+		WebAuthn:    w,
+		Store:       datastore,
+	}
+
+	return defaultTenant
+}
+
+// newTestSessions sets up server sessions in the store of the default tenant
+func newTestSessions(t *testing.T) *ServerSessions {
+	t.Helper()
+
+	sm := NewServerSessions(datastore, SessionTimeouts{Idle: time.Hour, Absolute: 12 * time.Hour})
+	sessions = sm
+
+	return sm
+}
+
+// sessionRequest is a helper function to make a request carrying a session of the user with the scope
+func sessionRequest(t *testing.T, method, target string, body []byte, user PasskeyUser, scope string) *http.Request {
+	t.Helper()
+
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	if err := sessions.IssueScoped(httptest.NewRecorder(), r, user, scope, 0); err != nil {
+		t.Fatalf("can't issue session: %s", err)
+	}
+
+	return r
+}
+
+// testLogger discards the log of the tests
+func testLogger() Logger {
+	return log.New(io.Discard, "", 0)
+}
+
+// softAuthenticator is a software passkey with an ES256 key
+type softAuthenticator struct {
+	id    []byte
+	key   *ecdsa.PrivateKey
+	count uint32
+	// origin is the origin of the client, testOrigin if empty
+	origin string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %s", err)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		t.Fatalf("can't generate credential id: %s", err)
+	}
+
+	return &softAuthenticator{id: id, key: key}
+}
+
+// register adds the passkey to the user, as a finished registration would
+func (a *softAuthenticator) register(t *testing.T, user PasskeyUser) {
+	t.Helper()
+
+	pub, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatalf("can't encode public key: %s", err)
+	}
+
+	user.AddCredential(&webauthn.Credential{
+		ID:              a.id,
+		PublicKey:       pub,
+		AttestationType: "none",
+		Flags:           webauthn.CredentialFlags{UserPresent: true, UserVerified: true},
+	})
+}
+
+// assert signs an assertion for the challenge of the options with user presence and verification
+func (a *softAuthenticator) assert(t *testing.T, challenge protocol.URLEncodedBase64, userID []byte) []byte {
+	t.Helper()
+
+	return a.assertWithExtensions(t, challenge, userID, nil)
+}
+
+// assertWithExtensions is assert with the client extension results the browser would add
+func (a *softAuthenticator) assertWithExtensions(t *testing.T, challenge protocol.URLEncodedBase64, userID []byte, ext map[string]interface{}) []byte {
+	t.Helper()
+
+	origin := a.origin
+	if origin == "" {
+		origin = testOrigin
+	}
+	clientData, err := json.Marshal(map[string]string{
+		"type":      "webauthn.get",
+		"challenge": challenge.String(),
+		"origin":    origin,
+	})
+	if err != nil {
+		t.Fatalf("can't encode client data: %s", err)
+	}
+
+	a.count++
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	authData := append(rpIDHash[:], byte(protocol.FlagUserPresent|protocol.FlagUserVerified))
+	authData = binary.BigEndian.AppendUint32(authData, a.count)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("can't sign assertion: %s", err)
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString
+	body, err := json.Marshal(map[string]interface{}{
+		"id":    enc(a.id),
+		"rawId": enc(a.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    enc(clientData),
+			"authenticatorData": enc(authData),
+			"signature":         enc(sig),
+			"userHandle":        enc(userID),
+		},
+		"clientExtensionResults": ext,
+	})
+	if err != nil {
+		t.Fatalf("can't encode assertion: %s", err)
+	}
+
+	return body
+}
+
+// principalRequest is a helper function to make a request of the logged-in user
+func principalRequest(method, target string, body []byte, user PasskeyUser) *http.Request {
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+
+	return r.WithContext(WithPrincipal(r.Context(), Principal{
+		TenantID: defaultTenant.ID,
+		UserID:   user.WebAuthnID(),
+		Name:     user.WebAuthnName(),
+	}))
+}
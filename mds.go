@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/mitchellh/mapstructure"
+)
+
+// mds is the FIDO metadata loaded from the local blob file, nil if METADATA_BLOB is not set
+var mds *MetadataBLOB
+
+// MetadataBLOB is a FIDO Metadata Service BLOB read from a local file
+type MetadataBLOB struct {
+	path   string
+	verify bool
+
+	mu         sync.RWMutex
+	entries    map[uuid.UUID]metadata.MetadataBLOBPayloadEntry
+	number     int
+	nextUpdate time.Time
+	loadedAt   time.Time
+}
+
+// NewMetadataBLOB makes a MetadataBLOB for the file at path, verify enables checking the signature
+// against the FIDO MDS root, it should be off only for test blobs
+func NewMetadataBLOB(path string, verify bool) *MetadataBLOB {
+	return &MetadataBLOB{path: path, verify: verify}
+}
+
+// Load reads and parses the blob file and replaces the entries
+func (m *MetadataBLOB) Load() error {
+	raw, err := os.ReadFile(m.path)
+	if err != nil {
+		return fmt.Errorf("can't read metadata blob: %w", err)
+	}
+
+	payload, err := parseMetadataBLOB(string(raw), m.verify)
+	if err != nil {
+		return fmt.Errorf("can't parse metadata blob: %w", err)
+	}
+
+	nextUpdate, err := time.Parse("2006-01-02", payload.NextUpdate)
+	if err != nil {
+		return fmt.Errorf("can't parse nextUpdate %q: %w", payload.NextUpdate, err)
+	}
+
+	entries := make(map[uuid.UUID]metadata.MetadataBLOBPayloadEntry, len(payload.Entries))
+	for _, e := range payload.Entries {
+		if e.AaGUID == "" {
+			continue
+		}
+
+		id, err := uuid.Parse(e.AaGUID)
+		if err != nil {
+			continue
+		}
+		entries[id] = e
+	}
+
+	m.mu.Lock()
+	m.entries = entries
+	m.number = payload.Number
+	m.nextUpdate = nextUpdate
+	m.loadedAt = time.Now()
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Install feeds the entries to the webauthn library, which checks new attestations against them. The library
+// reads its map without a lock, so it is called once before serving: reloads only update Entry.
+func (m *MetadataBLOB) Install() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for id, e := range m.entries {
+		metadata.Metadata[id] = e
+	}
+}
+
+// Entry returns the metadata entry of the authenticator model
+func (m *MetadataBLOB) Entry(aaguid uuid.UUID) (metadata.MetadataBLOBPayloadEntry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	e, ok := m.entries[aaguid]
+
+	return e, ok
+}
+
+// Fresh returns an error if the blob is not loaded or its nextUpdate date has passed
+func (m *MetadataBLOB) Fresh() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.loadedAt.IsZero() {
+		return errors.New("metadata blob is not loaded")
+	}
+
+	if time.Now().After(m.nextUpdate.Add(24 * time.Hour)) {
+		return fmt.Errorf("metadata blob #%d is stale, nextUpdate was %s", m.number, m.nextUpdate.Format("2006-01-02"))
+	}
+
+	return nil
+}
+
+// parseMetadataBLOB parses the blob JWT the same way as the webauthn library does, with verify it checks
+// the x5c chain against metadata.MDSRoot. Revocation of the chain is not checked, the blob is supposed
+// to be fetched by a trusted job.
+func parseMetadataBLOB(raw string, verify bool) (metadata.MetadataBLOBPayload, error) {
+	var payload metadata.MetadataBLOBPayload
+
+	if !verify {
+		token, _, err := jwt.NewParser().ParseUnverified(raw, jwt.MapClaims{})
+		if err != nil {
+			return payload, err
+		}
+
+		return payload, mapstructure.Decode(token.Claims, &payload)
+	}
+
+	token, err := jwt.Parse(raw, func(t *jwt.Token) (interface{}, error) {
+		x5c, ok := t.Header["x5c"].([]interface{})
+		if !ok || len(x5c) == 0 {
+			return nil, errors.New("no x5c in the header")
+		}
+
+		certs := make([]*x509.Certificate, 0, len(x5c))
+		for _, c := range x5c {
+			s, _ := c.(string)
+			der, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, err
+			}
+
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+
+		rootDER, err := base64.StdEncoding.DecodeString(metadata.MDSRoot)
+		if err != nil {
+			return nil, err
+		}
+		root, err := x509.ParseCertificate(rootDER)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := x509.VerifyOptions{Roots: x509.NewCertPool(), Intermediates: x509.NewCertPool()}
+		opts.Roots.AddCert(root)
+		for _, c := range certs[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+
+		if _, err := certs[0].Verify(opts); err != nil {
+			return nil, fmt.Errorf("can't verify blob signing certificate: %w", err)
+		}
+
+		return certs[0].PublicKey, nil
+	})
+	if err != nil {
+		return payload, err
+	}
+
+	return payload, mapstructure.Decode(token.Claims, &payload)
+}
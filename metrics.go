@@ -0,0 +1,511 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// metrics collects counters and histograms in memory and writes them in the Prometheus text format
+var metrics = NewMetrics()
+
+type Metrics struct {
+	ceremonies    *counterVec
+	duration      *histogramVec
+	cloneWarnings *counterVec
+	rateLimited   *counterVec
+	storeOps      *counterVec
+	passkeyStore  *counterVec
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		ceremonies: newCounterVec("passkey_ceremony_total",
+			"WebAuthn ceremony requests by phase and outcome.", "ceremony", "phase", "outcome", "code"),
+		duration: newHistogramVec("passkey_ceremony_duration_seconds",
+			"Time between begin and finish of a ceremony.", []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300}, "ceremony"),
+		cloneWarnings: newCounterVec("passkey_clone_warnings_total",
+			"Assertions with a sign counter that went backwards.", "ceremony"),
+		rateLimited: newCounterVec("passkey_rate_limit_rejections_total",
+			"Requests rejected by the rate limiter.", "route"),
+		storeOps: newCounterVec("passkey_ceremony_store_operations_total",
+			"Ceremony store operations by store and outcome.", "store", "op", "outcome"),
+		passkeyStore: newCounterVec("passkey_store_operations_total",
+			"Passkey store operations by outcome.", "op", "outcome"),
+	}
+}
+
+// ServeHTTP writes all metrics, store gauges are collected at scrape time
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.ceremonies.write(w)
+	m.duration.write(w)
+	m.cloneWarnings.write(w)
+	m.rateLimited.write(w)
+	m.storeOps.write(w)
+	m.passkeyStore.write(w)
+	writeStoreGauges(w, datastore, tenants.All())
+}
+
+// MetricsAuth requires "Authorization: Bearer <token>" for the metrics, without a token only
+// clients on the loopback interface get them
+func MetricsAuth(next http.Handler, token string) http.Handler {
+	if token == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isLoopback(r) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback reports whether the request comes from the loopback interface
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// writeStoreGauges writes gauges for the datastore content, users and credentials are counted per tenant
+func writeStoreGauges(w io.Writer, store PasskeyStore, list []*Tenant) {
+	stats := store.Stats()
+
+	// in JWT mode sessions live in tokens and can't be counted
+	if _, ok := sessions.(*ServerSessions); ok {
+		writeGauge(w, "passkey_sessions_active", "Active login sessions.", nil, []gaugeSample{
+			{value: float64(stats.AuthSessions)},
+		})
+	}
+
+	// the store counts under its lock, the handlers may change users meanwhile
+	users := make([]gaugeSample, 0, len(list))
+	var samples []gaugeSample
+	for _, t := range list {
+		ts := t.Store.Stats()
+		users = append(users, gaugeSample{labels: []string{t.ID}, value: float64(ts.Users)})
+
+		for k, v := range ts.Credentials {
+			samples = append(samples, gaugeSample{
+				labels: []string{t.ID, k.AAGUID, strconv.FormatBool(k.BackupEligible), strconv.FormatBool(k.BackupState)},
+				value:  float64(v),
+			})
+		}
+	}
+	writeGauge(w, "passkey_users", "Registered users.", []string{"tenant"}, users)
+
+	writeGauge(w, "passkey_credentials", "Registered credentials by authenticator model and backup state.",
+		[]string{"tenant", "aaguid", "backup_eligible", "backup_state"}, samples)
+}
+
+// InstrumentCeremony counts outcomes of a ceremony handler, the outcome is taken from the response status
+// and the error code from setErrorCode
+func (m *Metrics) InstrumentCeremony(ceremony, phase string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		outcome, code := "success", ""
+		if rec.status >= http.StatusBadRequest {
+			outcome, code = "error", rec.code
+			if code == "" {
+				code = "http_" + strconv.Itoa(rec.status)
+			}
+		}
+		m.ceremonies.Inc(ceremony, phase, outcome, code)
+	})
+}
+
+// statusRecorder remembers the response status and the error code of the request
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	code   string
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// setErrorCode is a helper function to label the ceremony metrics of the request with the error code of err
+func setErrorCode(w http.ResponseWriter, err error) {
+	if rec, ok := w.(*statusRecorder); ok {
+		rec.code = errorCode(err)
+	}
+}
+
+func errorCode(err error) string {
+	var perr *protocol.Error
+	var herr *HookError
+	switch {
+	case errors.As(err, &perr):
+		return perr.Type
+	case errors.As(err, &herr):
+		return "hook_" + herr.Code
+	case errors.Is(err, errNoCeremony):
+		return "no_ceremony"
+	case errors.Is(err, errCeremonyExpired):
+		return "ceremony_expired"
+	case errors.Is(err, errCeremonyReplay):
+		return "ceremony_replay"
+	default:
+		return "internal"
+	}
+}
+
+// instrumentedCeremonies counts operations of a CeremonyStore and measures begin to finish latency
+type instrumentedCeremonies struct {
+	CeremonyStore
+	name string
+
+	mu      sync.Mutex
+	started map[string]time.Time // by challenge
+}
+
+func newInstrumentedCeremonies(store CeremonyStore, name string) *instrumentedCeremonies {
+	return &instrumentedCeremonies{
+		CeremonyStore: store,
+		name:          name,
+		started:       make(map[string]time.Time),
+	}
+}
+
+func (c *instrumentedCeremonies) Save(w http.ResponseWriter, ceremony string, data webauthn.SessionData) error {
+	err := c.CeremonyStore.Save(w, ceremony, data)
+	metrics.storeOps.Inc(c.name, "save", outcome(err))
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// ceremonies that were never finished are dropped after an hour
+	now := time.Now()
+	for k, t := range c.started {
+		if now.Sub(t) > time.Hour {
+			delete(c.started, k)
+		}
+	}
+	c.started[data.Challenge] = now
+
+	return nil
+}
+
+func (c *instrumentedCeremonies) Load(w http.ResponseWriter, r *http.Request, ceremony string) (webauthn.SessionData, error) {
+	data, err := c.CeremonyStore.Load(w, r, ceremony)
+	metrics.storeOps.Inc(c.name, "load", outcome(err))
+	if err != nil {
+		return data, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// begin could be served by another instance
+	if t, ok := c.started[data.Challenge]; ok {
+		metrics.duration.Observe(time.Since(t).Seconds(), ceremony)
+		delete(c.started, data.Challenge)
+	}
+
+	return data, nil
+}
+
+// instrumentedStore counts the operations of a PasskeyStore, lookups by hit and miss
+type instrumentedStore struct {
+	PasskeyStore
+}
+
+func newInstrumentedStore(store PasskeyStore) PasskeyStore {
+	return instrumentedStore{store}
+}
+
+func (s instrumentedStore) GetOrCreateUser(userName string) PasskeyUser {
+	metrics.passkeyStore.Inc("get_or_create_user", "success")
+
+	return s.PasskeyStore.GetOrCreateUser(userName)
+}
+
+func (s instrumentedStore) GetUser(userName string) (PasskeyUser, bool) {
+	user, ok := s.PasskeyStore.GetUser(userName)
+	metrics.passkeyStore.Inc("get_user", found(ok))
+
+	return user, ok
+}
+
+func (s instrumentedStore) SaveUser(user PasskeyUser) {
+	s.PasskeyStore.SaveUser(user)
+	metrics.passkeyStore.Inc("save_user", "success")
+}
+
+func (s instrumentedStore) GenSessionID() (string, error) {
+	id, err := s.PasskeyStore.GenSessionID()
+	metrics.passkeyStore.Inc("gen_session_id", outcome(err))
+
+	return id, err
+}
+
+func (s instrumentedStore) GetSession(token string) (webauthn.SessionData, bool) {
+	data, ok := s.PasskeyStore.GetSession(token)
+	metrics.passkeyStore.Inc("get_session", found(ok))
+
+	return data, ok
+}
+
+func (s instrumentedStore) SaveSession(token string, data webauthn.SessionData) {
+	s.PasskeyStore.SaveSession(token, data)
+	metrics.passkeyStore.Inc("save_session", "success")
+}
+
+func (s instrumentedStore) DeleteSession(token string) {
+	s.PasskeyStore.DeleteSession(token)
+	metrics.passkeyStore.Inc("delete_session", "success")
+}
+
+func (s instrumentedStore) GetAuthSession(token string) (AuthSession, bool) {
+	data, ok := s.PasskeyStore.GetAuthSession(token)
+	metrics.passkeyStore.Inc("get_auth_session", found(ok))
+
+	return data, ok
+}
+
+func (s instrumentedStore) SaveAuthSession(token string, data AuthSession) {
+	s.PasskeyStore.SaveAuthSession(token, data)
+	metrics.passkeyStore.Inc("save_auth_session", "success")
+}
+
+func (s instrumentedStore) DeleteAuthSession(token string) {
+	s.PasskeyStore.DeleteAuthSession(token)
+	metrics.passkeyStore.Inc("delete_auth_session", "success")
+}
+
+func (s instrumentedStore) MarkUsed(id string, until time.Time) bool {
+	ok := s.PasskeyStore.MarkUsed(id, until)
+	result := "success"
+	if !ok {
+		result = "replay"
+	}
+	metrics.passkeyStore.Inc("mark_used", result)
+
+	return ok
+}
+
+func (s instrumentedStore) IsUsed(id string) bool {
+	used := s.PasskeyStore.IsUsed(id)
+	metrics.passkeyStore.Inc("is_used", found(used))
+
+	return used
+}
+
+func found(ok bool) string {
+	if ok {
+		return "hit"
+	}
+
+	return "miss"
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // by label values joined with labelSep
+}
+
+const labelSep = "\xff"
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[strings.Join(labelValues, labelSep)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitLabels(k)), formatValue(c.values[k]))
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	k := strings.Join(labelValues, labelSep)
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	leLabels := append(append([]string{}, h.labels...), "le")
+	for _, k := range keys {
+		s, values := h.series[k], splitLabels(k)
+
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(leLabels, append(append([]string{}, values...), formatValue(b))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(leLabels, append(append([]string{}, values...), "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+type gaugeSample struct {
+	labels []string
+	value  float64
+}
+
+func writeGauge(w io.Writer, name, help string, labels []string, samples []gaugeSample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, labelSep) < strings.Join(samples[j].labels, labelSep)
+	})
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, s.labels), formatValue(s.value))
+	}
+}
+
+func splitLabels(k string) []string {
+	if k == "" {
+		return nil
+	}
+
+	return strings.Split(k, labelSep)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(v))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
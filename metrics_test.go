@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsAuth(t *testing.T) {
+	h := MetricsAuth(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}), "s3cret")
+
+	for _, tc := range []struct {
+		header string
+		want   int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Fatalf("Authorization %q: status %d, want %d", tc.header, w.Code, tc.want)
+		}
+	}
+}
+
+func TestMetricsLoopbackWithoutToken(t *testing.T) {
+	h := MetricsAuth(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}), "")
+
+	for _, tc := range []struct {
+		remote string
+		want   int
+	}{
+		{"127.0.0.1:4242", http.StatusOK},
+		{"[::1]:4242", http.StatusOK},
+		{"192.0.2.1:4242", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		r.RemoteAddr = tc.remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Fatalf("client %s: status %d, want %d", tc.remote, w.Code, tc.want)
+		}
+	}
+}
+
+func TestInstrumentedStore(t *testing.T) {
+	l = testLogger()
+	metrics = NewMetrics()
+	t.Cleanup(func() { metrics = NewMetrics() })
+
+	store := newInstrumentedStore(NewInMem(l))
+	store.GetUser("alice")
+	store.SaveUser(store.GetOrCreateUser("alice"))
+	store.GetUser("alice")
+	store.MarkUsed("id", time.Now().Add(time.Minute))
+	store.MarkUsed("id", time.Now().Add(time.Minute))
+
+	var buf bytes.Buffer
+	metrics.passkeyStore.write(&buf)
+	for _, want := range []string{
+		`passkey_store_operations_total{op="get_user",outcome="miss"} 1`,
+		`passkey_store_operations_total{op="get_user",outcome="hit"} 1`,
+		`passkey_store_operations_total{op="save_user",outcome="success"} 1`,
+		`passkey_store_operations_total{op="mark_used",outcome="replay"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("counters don't contain %s:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestStoreGaugesCountCredentials(t *testing.T) {
+	tenant := newTestTenant(t)
+
+	for _, name := range []string{"alice", "bob"} {
+		user := tenant.Store.GetOrCreateUser(name)
+		newSoftAuthenticator(t).register(t, user)
+		tenant.Store.SaveUser(user)
+	}
+
+	var buf bytes.Buffer
+	writeStoreGauges(&buf, tenant.Store, []*Tenant{tenant})
+
+	for _, want := range []string{
+		`passkey_users{tenant="default"} 2`,
+		`passkey_credentials{tenant="default",aaguid="unknown",backup_eligible="false",backup_state="false"} 2`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("gauges don't contain %s:\n%s", want, buf.String())
+		}
+	}
+}
@@ -1,13 +1,27 @@
 package main
 
-import "github.com/go-webauthn/webauthn/webauthn"
+import (
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
 
 type User struct {
 	ID          []byte
 	DisplayName string
 	Name        string
 
-	creds []webauthn.Credential
+	// mu guards the passkeys and their meta, background jobs update them next to the handlers
+	mu            sync.RWMutex
+	creds         []webauthn.Credential
+	credMeta      map[string]CredentialMeta
+	recoveryCodes []RecoveryCode
+	email         string
+	emailVerified bool
+	password      LegacyPassword
+	totp          TOTPSecret
+	roles         []string
 }
 
 func (o *User) WebAuthnID() []byte {
@@ -27,17 +41,173 @@ func (o *User) WebAuthnIcon() string {
 }
 
 func (o *User) WebAuthnCredentials() []webauthn.Credential {
-	return o.creds
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return append([]webauthn.Credential(nil), o.creds...)
 }
 
 func (o *User) AddCredential(credential *webauthn.Credential) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
 	o.creds = append(o.creds, *credential)
 }
 
+func (o *User) RemoveCredential(id []byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i, c := range o.creds {
+		if string(c.ID) == string(id) {
+			o.creds = append(o.creds[:i], o.creds[i+1:]...)
+			delete(o.credMeta, string(id))
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (o *User) CredentialMeta(id []byte) CredentialMeta {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	return o.credMeta[string(id)]
+}
+
+func (o *User) UpdateCredentialMeta(id []byte, fn func(m *CredentialMeta)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.credMeta == nil {
+		o.credMeta = map[string]CredentialMeta{}
+	}
+	m := o.credMeta[string(id)]
+	fn(&m)
+	o.credMeta[string(id)] = m
+}
+
+func (o *User) RecoveryCodes() []RecoveryCode {
+	return o.recoveryCodes
+}
+
+func (o *User) SetRecoveryCodes(codes []RecoveryCode) {
+	o.recoveryCodes = codes
+}
+
+func (o *User) EmailAddress() (string, bool) {
+	return o.email, o.emailVerified
+}
+
+func (o *User) SetEmailAddress(addr string, verified bool) {
+	o.email, o.emailVerified = addr, verified
+}
+
+func (o *User) Password() LegacyPassword {
+	return o.password
+}
+
+func (o *User) SetPassword(p LegacyPassword) {
+	o.password = p
+}
+
+func (o *User) TOTP() TOTPSecret {
+	return o.totp
+}
+
+func (o *User) SetTOTP(s TOTPSecret) {
+	o.totp = s
+}
+
+func (o *User) Roles() []string {
+	return o.roles
+}
+
+func (o *User) SetRoles(roles []string) {
+	o.roles = roles
+}
+
 func (o *User) UpdateCredential(credential *webauthn.Credential) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
 	for i, c := range o.creds {
 		if string(c.ID) == string(credential.ID) {
 			o.creds[i] = *credential
 		}
 	}
 }
+
+// AuthSession is the login session created after a successful FinishLogin
+type AuthSession struct {
+	ID           string
+	TenantID     string
+	UserID       []byte
+	CredentialID []byte
+	// AuthTime is the time of the last passkey assertion, UserVerified is its UV flag
+	AuthTime     time.Time
+	UserVerified bool
+	// Expires is the idle expiration, it slides with activity up to MaxExpires, the absolute one
+	Expires    time.Time
+	MaxExpires time.Time
+	// RotatedAt is when the session got its id, Rotated is set on the old id of a rotated session
+	RotatedAt time.Time
+	Rotated   bool
+	// Predecessor and Successor link the old and the new id of a rotation, a logout revokes both
+	Predecessor string
+	Successor   string
+	// Scope limits the session to the routes of the scope, empty for a regular login session
+	Scope string
+}
+
+// CredentialMeta is what we keep about a passkey besides webauthn.Credential
+type CredentialMeta struct {
+	Name      string
+	CreatedAt time.Time
+	// Discoverable is the rk property reported by credProps at registration, nil if the client didn't report it
+	Discoverable *bool
+	// PRF is set if the passkey supports the prf extension, WrappedKey is the data key of the user
+	// wrapped by the client with the PRF output for PRFSalt
+	PRF        bool
+	PRFSalt    []byte
+	WrappedKey []byte
+	// LargeBlob is set if the passkey supports the largeBlob extension, PendingBlob waits for the next login
+	// with it to be written, it is dropped after largeBlobMaxAttempts failed writes or largeBlobPendingTTL.
+	// BlobSHA256 is the hash of the last written one.
+	LargeBlob       bool
+	PendingBlob     []byte
+	PendingSince    time.Time
+	PendingAttempts int
+	BlobSHA256      []byte
+	BlobWrittenAt   time.Time
+	// Attestation is the attestation verified at registration
+	Attestation *AttestationInfo
+	// Compromised is set while the metadata reports the authenticator model of the passkey compromised
+	Compromised *AuthenticatorStatus
+}
+
+// RecoveryCode is a single-use recovery code, only its argon2id hash is kept. ID is the plain prefix
+// of the code, it picks the one hash to check.
+type RecoveryCode struct {
+	ID     string
+	Salt   []byte
+	Hash   []byte
+	UsedAt time.Time
+}
+
+// StoreStats is a snapshot of the datastore size
+type StoreStats struct {
+	Users        int
+	Sessions     int // ceremonies in progress
+	AuthSessions int // not expired login sessions
+	Credentials  map[CredentialKind]int
+}
+
+// CredentialKind groups the credentials of StoreStats by authenticator model and backup flags
+type CredentialKind struct {
+	AAGUID         string
+	BackupEligible bool
+	BackupState    bool
+}
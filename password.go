@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password policies. The global one is PASSWORD_MODE, a user policy can only make it stricter.
+const (
+	passwordOff          = "off"           // no password logins
+	passwordOn           = "on"            // password login stays available
+	passwordUntilPasskey = "until_passkey" // password login is refused once the user has a passkey
+)
+
+const ceremonyUpgrade = "upgrade"
+
+// passwordMode is the global password policy
+var passwordMode = passwordOff
+
+// LegacyPassword is the password of a user migrated from the old system. Hash is a bcrypt ($2a$, $2b$, $2y$)
+// or PHC argon2 ($argon2id$, $argon2i$) hash, Policy is empty to follow PASSWORD_MODE.
+type LegacyPassword struct {
+	Hash   string
+	Policy string
+}
+
+// passwordStrictness orders the policies, the stricter of the global and the user one applies
+var passwordStrictness = map[string]int{passwordOn: 0, passwordUntilPasskey: 1, passwordOff: 2}
+
+var (
+	// passwordLockout locks a client out of the password of a username after failed logins,
+	// PASSWORD_MAX_FAILURES and PASSWORD_LOCKOUT
+	passwordLockout = NewLockout(5, 15*time.Minute)
+
+	// dummyPassword is verified for users without a password, it is a hash like the imported ones,
+	// so the time doesn't tell whether the user exists or has a password
+	dummyPasswordMu    sync.Mutex
+	dummyPassword      string
+	dummyPasswordShape string
+)
+
+// passwordPolicy returns the policy of the user, the stricter of its own and PASSWORD_MODE
+func passwordPolicy(user PasskeyUser) string {
+	p := user.Password().Policy
+	if p == "" || passwordStrictness[passwordMode] >= passwordStrictness[p] {
+		return passwordMode
+	}
+
+	return p
+}
+
+// passwordAllowed reports whether the user may log in with the password
+func passwordAllowed(user PasskeyUser) bool {
+	if user.Password().Hash == "" {
+		return false
+	}
+
+	switch passwordPolicy(user) {
+	case passwordOn:
+		return true
+	case passwordUntilPasskey:
+		return len(user.WebAuthnCredentials()) == 0
+	default:
+		return false
+	}
+}
+
+// verifyPassword compares the password with the hash
+func verifyPassword(hash, password string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+
+		return err == nil, err
+	case strings.HasPrefix(hash, "$argon2"):
+		h, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false, err
+		}
+
+		var key []byte
+		if h.variant == "argon2id" {
+			key = argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		} else {
+			key = argon2.Key([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		}
+
+		return subtle.ConstantTimeCompare(key, h.key) == 1, nil
+	default:
+		return false, errors.New("unknown password hash format")
+	}
+}
+
+// Bounds of imported argon2 parameters, a hash outside of them would make every login attempt too expensive
+const (
+	argon2MaxMemory = 256 * 1024 // KiB
+	argon2MaxTime   = 16
+)
+
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2Hash parses "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>" with unpadded base64
+func parseArgon2Hash(hash string) (argon2Hash, error) {
+	var h argon2Hash
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || (parts[1] != "argon2id" && parts[1] != "argon2i") {
+		return h, errors.New("invalid argon2 hash")
+	}
+	h.variant = parts[1]
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return h, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return h, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+	if h.time < 1 || h.time > argon2MaxTime || h.threads < 1 || h.memory > argon2MaxMemory {
+		return h, fmt.Errorf("argon2 parameters %q out of bounds (t=1..%d, p>=1, m<=%d)", parts[3], argon2MaxTime, argon2MaxMemory)
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return h, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return h, errors.New("invalid argon2 key")
+	}
+
+	return h, nil
+}
+
+// checkPasswordHash checks that the hash can be verified
+func checkPasswordHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2") {
+		_, err := parseArgon2Hash(hash)
+
+		return err
+	}
+
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("invalid bcrypt hash: %w", err)
+	}
+
+	return nil
+}
+
+// hashShape is the algorithm and the parameters of the hash, what the time to verify it depends on
+func hashShape(hash string) string {
+	if strings.HasPrefix(hash, "$argon2") {
+		if parts := strings.Split(hash, "$"); len(parts) == 6 {
+			return strings.Join(parts[:4], "$")
+		}
+
+		return ""
+	}
+
+	cost, _ := bcrypt.Cost([]byte(hash))
+
+	return fmt.Sprintf("bcrypt:%d", cost)
+}
+
+// setDummyPassword makes the dummy hash one with the algorithm and the parameters of hash
+func setDummyPassword(hash string) error {
+	shape := hashShape(hash)
+
+	dummyPasswordMu.Lock()
+	defer dummyPasswordMu.Unlock()
+
+	if shape == dummyPasswordShape {
+		return nil
+	}
+
+	var dummy string
+	if strings.HasPrefix(hash, "$argon2") {
+		h, err := parseArgon2Hash(hash)
+		if err != nil {
+			return err
+		}
+		enc := base64.RawStdEncoding
+		dummy = fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", h.variant, argon2.Version, h.memory, h.time, h.threads,
+			enc.EncodeToString(make([]byte, len(h.salt))), enc.EncodeToString(make([]byte, len(h.key))))
+	} else {
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return err
+		}
+		b, err := bcrypt.GenerateFromPassword([]byte("dummy"), cost)
+		if err != nil {
+			return err
+		}
+		dummy = string(b)
+	}
+	dummyPassword, dummyPasswordShape = dummy, shape
+
+	return nil
+}
+
+// verifyDummyPassword does the work of verifying the password of a user without one
+func verifyDummyPassword(password string) {
+	dummyPasswordMu.Lock()
+	dummy := dummyPassword
+	dummyPasswordMu.Unlock()
+
+	if dummy == "" {
+		// nothing was imported, bcrypt with the default cost is the common case
+		b, _ := bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		dummyPasswordMu.Lock()
+		if dummyPassword == "" {
+			dummyPassword, dummyPasswordShape = string(b), hashShape(string(b))
+		}
+		dummy = dummyPassword
+		dummyPasswordMu.Unlock()
+	}
+
+	_, _ = verifyPassword(dummy, password)
+}
+
+// ImportPasswords reads CSV lines "username,hash[,policy[,tenant]]" and sets the passwords of the users,
+// an empty tenant is the fallback one
+func ImportPasswords(reg *TenantRegistry, in io.Reader) (int, error) {
+	cr := csv.NewReader(in)
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+
+	imported := 0
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, fmt.Errorf("can't read password import: %w", err)
+		}
+
+		line, _ := cr.FieldPos(0)
+		if len(rec) < 2 || rec[0] == "" {
+			return imported, fmt.Errorf("line %d: username and hash are required", line)
+		}
+
+		username, hash := rec[0], rec[1]
+		if err := checkPasswordHash(hash); err != nil {
+			return imported, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		policy := ""
+		if len(rec) > 2 {
+			policy = rec[2]
+		}
+		switch policy {
+		case "", passwordOff, passwordOn, passwordUntilPasskey:
+		default:
+			return imported, fmt.Errorf("line %d: unknown policy %q", line, policy)
+		}
+
+		t := reg.fallback
+		if len(rec) > 3 && rec[3] != "" {
+			t = reg.byID[rec[3]]
+		}
+		if t == nil {
+			return imported, fmt.Errorf("line %d: unknown tenant", line)
+		}
+
+		// the dummy hash follows the imported ones, the last one if they differ
+		if err := setDummyPassword(hash); err != nil {
+			return imported, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		user := t.Store.GetOrCreateUser(username)
+		user.SetPassword(LegacyPassword{Hash: hash, Policy: policy})
+		t.Store.SaveUser(user)
+		imported++
+	}
+}
+
+// PasswordLogin logs in with the legacy password. Users without a passkey are offered to enroll one.
+func PasswordLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		JSONResponse(w, "username and password are required", http.StatusBadRequest)
+
+		return
+	}
+
+	// unknown users are counted and checked like known ones, so the answer doesn't tell whether the user exists
+	key := clientUserKey(r, req.Username)
+	if lockedOut(w, passwordLockout, key, "password_locked") {
+		return
+	}
+
+	user, found := tenantFor(r).Store.GetUser(req.Username)
+	ok := verifyOrDummy(found && passwordAllowed(user), func() bool {
+		ok, err := verifyPassword(user.Password().Hash, req.Password)
+		if err != nil {
+			l.Printf("[ERRO] can't verify password of %s: %s", user.WebAuthnName(), err.Error())
+		}
+
+		return ok
+	}, func() { verifyDummyPassword(req.Password) })
+
+	if !ok {
+		Audit(r, "password.login_failed", user, map[string]interface{}{"username": req.Username})
+		if passwordLockout.Fail(key) {
+			l.Printf("[WARN] password of %s is locked after failed logins", req.Username)
+			Audit(r, "password.locked", user, map[string]interface{}{"username": req.Username})
+		}
+		JSONResponse(w, map[string]string{"error": "invalid_credentials"}, http.StatusUnauthorized)
+
+		return
+	}
+	passwordLockout.Reset(key)
+
+	if loginVetoed(w, r, user) {
+		return
+	}
+
+	scope := loginScope(user)
+	if err := sessions.IssueScoped(w, r, user, scope, 0); err != nil {
+		msg := fmt.Sprintf("can't issue session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	// the login of a TOTP session completes with the second factor, promoteSession runs the hook then
+	if scope != scopeTOTP {
+		hooks.AfterFinishLogin(r, user, nil)
+	}
+	Audit(r, "password.login", user, nil)
+
+	if scope == scopeTOTP {
+		JSONResponse(w, totpChallenge(user), http.StatusOK)
+
+		return
+	}
+
+	resp := map[string]interface{}{"message": "Login Success"}
+	if len(user.WebAuthnCredentials()) == 0 {
+		resp["upgrade"] = map[string]string{
+			"start":  "/api/password/upgrade/registerStart",
+			"finish": "/api/password/upgrade/registerFinish",
+		}
+	}
+	JSONResponse(w, resp, http.StatusOK)
+}
+
+// BeginPasskeyUpgrade starts enrolling the first passkey of the logged-in user
+func BeginPasskeyUpgrade(w http.ResponseWriter, r *http.Request) {
+	if upgradeRefused(w, r) {
+		return
+	}
+
+	beginEnrollment(w, r, ceremonyUpgrade)
+}
+
+// FinishPasskeyUpgrade stores the new passkey, the first one gets recovery codes like a regular registration
+func FinishPasskeyUpgrade(w http.ResponseWriter, r *http.Request) {
+	if upgradeRefused(w, r) {
+		return
+	}
+
+	user, credential, ok := finishEnrollment(w, r, ceremonyUpgrade)
+	if !ok {
+		return
+	}
+
+	Audit(r, "password.upgraded", user, map[string]interface{}{
+		"credentialId":    encodeCredentialID(credential.ID),
+		"passwordAllowed": passwordAllowed(user),
+	})
+
+	resp := map[string]interface{}{"message": "Passkey Enrolled", "passwordAllowed": passwordAllowed(user)}
+	if len(user.RecoveryCodes()) == 0 {
+		codes, err := issueRecoveryCodes(r, user, "recovery.codes_generated")
+		if err != nil {
+			l.Printf("[ERRO] %s", err.Error())
+			JSONResponse(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+		resp["recoveryCodes"] = codes
+	}
+
+	JSONResponse(w, resp, http.StatusOK)
+}
+
+// upgradeRefused answers 403 if the logged-in user already has a passkey. A password session may only enroll
+// the first one, more passkeys need a passkey login.
+func upgradeRefused(w http.ResponseWriter, r *http.Request) bool {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return true
+	}
+
+	if len(user.WebAuthnCredentials()) == 0 {
+		return false
+	}
+
+	Audit(r, "password.upgrade_refused", user, nil)
+	JSONResponse(w, map[string]string{
+		"error":   "passkey_exists",
+		"message": "the account already has a passkey, log in with it to add another one",
+	}, http.StatusForbidden)
+
+	return true
+}
+
+// DisablePassword removes the password of the logged-in user, it needs a recent passkey assertion
+func DisablePassword(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	user.SetPassword(LegacyPassword{})
+	tenantFor(r).Store.SaveUser(user)
+
+	Audit(r, "password.disabled", user, nil)
+	JSONResponse(w, "Password Disabled", http.StatusOK)
+}
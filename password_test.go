@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPasswordHashArgon2Bounds(t *testing.T) {
+	const salt, key = "c29tZXNhbHQ", "aGFzaGhhc2hoYXNoaGFzaA"
+	tests := []struct {
+		params string
+		ok     bool
+	}{
+		{"m=65536,t=3,p=4", true},
+		{"m=65536,t=0,p=4", false},
+		{"m=65536,t=17,p=4", false},
+		{"m=65536,t=3,p=0", false},
+		{"m=4194304,t=3,p=4", false},
+	}
+
+	for _, tt := range tests {
+		hash := strings.Join([]string{"", "argon2id", "v=19", tt.params, salt, key}, "$")
+		if err := checkPasswordHash(hash); (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %t", tt.params, err, tt.ok)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	l = testLogger()
+	t.Cleanup(func() { passwordMode = passwordOff })
+
+	for _, tc := range []struct {
+		global, user, want string
+	}{
+		{passwordOn, "", passwordOn},
+		{passwordOn, passwordUntilPasskey, passwordUntilPasskey},
+		{passwordOn, passwordOff, passwordOff},
+		{passwordUntilPasskey, passwordOn, passwordUntilPasskey},
+		{passwordOff, passwordOn, passwordOff},
+	} {
+		passwordMode = tc.global
+		user := NewInMem(l).GetOrCreateUser("alice")
+		user.SetPassword(LegacyPassword{Hash: "$2a$04$x", Policy: tc.user})
+		if got := passwordPolicy(user); got != tc.want {
+			t.Errorf("global %s, user %q: got %s, want %s", tc.global, tc.user, got, tc.want)
+		}
+	}
+}
+
+func TestDummyPasswordFollowsImport(t *testing.T) {
+	t.Cleanup(func() { dummyPassword, dummyPasswordShape = "", "" })
+
+	argon := "$argon2id$v=19$m=1024,t=2,p=1$c29tZXNhbHQ$aGFzaGhhc2hoYXNoaGFzaA"
+	if err := setDummyPassword(argon); err != nil {
+		t.Fatalf("can't set dummy: %s", err)
+	}
+	if !strings.HasPrefix(dummyPassword, "$argon2id$v=19$m=1024,t=2,p=1$") || checkPasswordHash(dummyPassword) != nil {
+		t.Fatalf("dummy %q is not like %q", dummyPassword, argon)
+	}
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("can't hash: %s", err)
+	}
+	if err := setDummyPassword(string(bcryptHash)); err != nil {
+		t.Fatalf("can't set dummy: %s", err)
+	}
+	if cost, err := bcrypt.Cost([]byte(dummyPassword)); err != nil || cost != bcrypt.MinCost {
+		t.Fatalf("dummy %q has cost %d, want %d", dummyPassword, cost, bcrypt.MinCost)
+	}
+}
+
+func TestPasswordLockout(t *testing.T) {
+	tenant := newTestTenant(t)
+	newTestSessions(t)
+	passwordMode, passwordLockout = passwordOn, NewLockout(3, time.Minute)
+	t.Cleanup(func() { passwordMode, passwordLockout = passwordOff, NewLockout(5, 15*time.Minute) })
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("can't hash: %s", err)
+	}
+	user := tenant.Store.GetOrCreateUser("alice")
+	user.SetPassword(LegacyPassword{Hash: string(hash)})
+	tenant.Store.SaveUser(user)
+
+	login := func(remote, password string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/password/login", strings.NewReader(`{"username":"alice","password":"`+password+`"}`))
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		PasswordLogin(w, r)
+
+		return w.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := login("192.0.2.1:1234", "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d, want %d", i, code, http.StatusUnauthorized)
+		}
+	}
+	if code := login("192.0.2.1:1234", "secret"); code != http.StatusTooManyRequests {
+		t.Fatalf("locked client: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	// other clients aren't locked out of the user
+	if code := login("198.51.100.1:1234", "secret"); code != http.StatusOK {
+		t.Fatalf("other client: status %d, want %d", code, http.StatusOK)
+	}
+}
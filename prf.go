@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	extensionPRF = "prf"
+
+	prfSaltLen = 32
+	// maxWrappedKeyLen is enough for a wrapped 256-bit key with nonce, tag and a small header
+	maxWrappedKeyLen = 512
+)
+
+// recordPRF marks the passkey as PRF capable if the registration reported it, and gives it its salt.
+// The salt is public, the PRF output for it is the secret and never reaches the server.
+func recordPRF(user PasskeyUser, id []byte, ext protocol.AuthenticationExtensionsClientOutputs) error {
+	out := extensionOutput(ext, extensionPRF)
+	if enabled, _ := out["enabled"].(bool); !enabled {
+		return nil
+	}
+
+	salt := make([]byte, prfSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("can't generate PRF salt: %w", err)
+	}
+
+	user.UpdateCredentialMeta(id, func(m *CredentialMeta) {
+		m.PRF = true
+		m.PRFSalt = salt
+	})
+
+	return nil
+}
+
+// prfLoginInput asks every PRF capable passkey of the allowed ones to evaluate the PRF with its salt,
+// nil if there are none
+func prfLoginInput(user PasskeyUser, allowed []webauthn.Credential) map[string]interface{} {
+	byCredential := map[string]interface{}{}
+	for _, c := range allowed {
+		if meta := user.CredentialMeta(c.ID); meta.PRF {
+			byCredential[encodeCredentialID(c.ID)] = map[string]interface{}{
+				"first": protocol.URLEncodedBase64(meta.PRFSalt),
+			}
+		}
+	}
+	if len(byCredential) == 0 {
+		return nil
+	}
+
+	return map[string]interface{}{"evalByCredential": byCredential}
+}
+
+// prfKeyView is a PRF capable passkey with the data key wrapped by its PRF output
+type prfKeyView struct {
+	CredentialID string                    `json:"credentialId"`
+	Salt         protocol.URLEncodedBase64 `json:"salt"`
+	WrappedKey   protocol.URLEncodedBase64 `json:"wrappedKey,omitempty"`
+}
+
+// PRFKeys returns the PRF capable passkeys of the logged-in user with their salts and wrapped data keys.
+// The client unwraps the key with the PRF output of the login, and wraps it for passkeys without one.
+func PRFKeys(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	keys := []prfKeyView{}
+	for _, c := range user.WebAuthnCredentials() {
+		if meta := user.CredentialMeta(c.ID); meta.PRF {
+			keys = append(keys, prfKeyView{
+				CredentialID: encodeCredentialID(c.ID),
+				Salt:         meta.PRFSalt,
+				WrappedKey:   meta.WrappedKey,
+			})
+		}
+	}
+
+	JSONResponse(w, keys, http.StatusOK)
+}
+
+// SetWrappedKey stores the data key of the logged-in user wrapped by the PRF output of one of the passkeys.
+// The server can't unwrap it, it only keeps the blob.
+func SetWrappedKey(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		CredentialID string                    `json:"credentialId"`
+		WrappedKey   protocol.URLEncodedBase64 `json:"wrappedKey"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "can't decode request: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+	if len(req.WrappedKey) == 0 || len(req.WrappedKey) > maxWrappedKeyLen {
+		JSONResponse(w, fmt.Sprintf("wrappedKey must be 1 to %d bytes", maxWrappedKeyLen), http.StatusBadRequest)
+
+		return
+	}
+
+	id, err := decodeCredentialID(req.CredentialID)
+	if err != nil {
+		JSONResponse(w, "can't decode credential id: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	meta := user.CredentialMeta(id)
+	if !meta.PRF {
+		JSONResponse(w, map[string]string{"error": "prf_not_supported"}, http.StatusConflict)
+
+		return
+	}
+	user.UpdateCredentialMeta(id, func(m *CredentialMeta) { m.WrappedKey = req.WrappedKey })
+	tenantFor(r).Store.SaveUser(user)
+
+	Audit(r, "prf.key_wrapped", user, map[string]interface{}{"credentialId": req.CredentialID})
+	JSONResponse(w, "Wrapped Key Saved", http.StatusOK)
+}
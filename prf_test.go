@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestRecordPRF(t *testing.T) {
+	l = testLogger()
+	user := NewInMem(l).GetOrCreateUser("alice")
+	with, without := &webauthn.Credential{ID: []byte("with")}, &webauthn.Credential{ID: []byte("without")}
+	user.AddCredential(with)
+	user.AddCredential(without)
+
+	if err := recordPRF(user, with.ID, protocol.AuthenticationExtensionsClientOutputs{
+		extensionPRF: map[string]interface{}{"enabled": true},
+	}); err != nil {
+		t.Fatalf("can't record PRF: %s", err)
+	}
+	if err := recordPRF(user, without.ID, nil); err != nil {
+		t.Fatalf("can't record PRF: %s", err)
+	}
+
+	if meta := user.CredentialMeta(with.ID); !meta.PRF || len(meta.PRFSalt) != prfSaltLen {
+		t.Fatalf("PRF capable passkey: %+v", meta)
+	}
+	if meta := user.CredentialMeta(without.ID); meta.PRF || meta.PRFSalt != nil {
+		t.Fatalf("passkey without PRF: %+v", meta)
+	}
+
+	// the login asks only the capable passkey, with its own salt
+	input := prfLoginInput(user, user.WebAuthnCredentials())
+	byCredential, _ := input["evalByCredential"].(map[string]interface{})
+	if len(byCredential) != 1 {
+		t.Fatalf("unexpected PRF input %v", input)
+	}
+	eval, _ := byCredential[encodeCredentialID(with.ID)].(map[string]interface{})
+	if salt, _ := eval["first"].(protocol.URLEncodedBase64); string(salt) != string(user.CredentialMeta(with.ID).PRFSalt) {
+		t.Fatalf("unexpected PRF input %v", input)
+	}
+	if prfLoginInput(user, []webauthn.Credential{*without}) != nil {
+		t.Fatal("PRF is requested from passkeys without it")
+	}
+}
+
+func TestWrappedKeys(t *testing.T) {
+	tenant := newTestTenant(t)
+	user := tenant.Store.GetOrCreateUser("alice")
+	with, without := &webauthn.Credential{ID: []byte("with")}, &webauthn.Credential{ID: []byte("without")}
+	user.AddCredential(with)
+	user.AddCredential(without)
+	user.UpdateCredentialMeta(with.ID, func(m *CredentialMeta) { m.PRF, m.PRFSalt = true, []byte("salt") })
+	tenant.Store.SaveUser(user)
+
+	set := func(id []byte, key string) int {
+		body := []byte(`{"credentialId":"` + encodeCredentialID(id) + `","wrappedKey":"` + key + `"}`)
+		w := httptest.NewRecorder()
+		SetWrappedKey(w, principalRequest(http.MethodPost, "/api/prf/keys", body, user))
+
+		return w.Code
+	}
+
+	if code := set(without.ID, "d3JhcHBlZA"); code != http.StatusConflict {
+		t.Fatalf("passkey without PRF: status %d, want %d", code, http.StatusConflict)
+	}
+	if code := set(with.ID, ""); code != http.StatusBadRequest {
+		t.Fatalf("empty key: status %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := set(with.ID, "d3JhcHBlZA"); code != http.StatusOK {
+		t.Fatalf("wrapped key: status %d, want %d", code, http.StatusOK)
+	}
+
+	w := httptest.NewRecorder()
+	PRFKeys(w, principalRequest(http.MethodGet, "/api/prf/keys", nil, user))
+	var keys []prfKeyView
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil {
+		t.Fatalf("can't decode keys: %s", err)
+	}
+	if len(keys) != 1 || string(keys[0].Salt) != "salt" || string(keys[0].WrappedKey) != "wrapped" {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*rateLimiter{}
+)
+
+// RateLimitMiddleware allows at most perMinute requests per client IP in a fixed one minute window,
+// perMinute <= 0 disables the limit. Routes wrapped with the same route name share one limit.
+func RateLimitMiddleware(next http.Handler, route string, perMinute int) http.Handler {
+	if perMinute <= 0 {
+		return next
+	}
+
+	limitersMu.Lock()
+	lim, ok := limiters[route]
+	if !ok {
+		lim = &rateLimiter{limit: perMinute, hits: make(map[string]int)}
+		limiters[route] = lim
+	}
+	limitersMu.Unlock()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		if retry, ok := lim.Allow(ip); !ok {
+			metrics.rateLimited.Inc(route)
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+			JSONResponse(w, map[string]string{"error": "rate_limited"}, http.StatusTooManyRequests)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type rateLimiter struct {
+	limit int
+
+	mu     sync.Mutex
+	window time.Time
+	hits   map[string]int
+}
+
+// Allow counts the hit of the key and returns time until the next window if the limit is exceeded
+func (rl *rateLimiter) Allow(key string) (time.Duration, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.window) >= time.Minute {
+		rl.window = now.Truncate(time.Minute)
+		rl.hits = make(map[string]int)
+	}
+
+	rl.hits[key]++
+	if rl.hits[key] > rl.limit {
+		return rl.window.Add(time.Minute).Sub(now), false
+	}
+
+	return 0, true
+}
+
+// Lockout counts failures per key and locks the key for duration after max failures in a row,
+// failures older than duration are forgotten. max <= 0 disables it.
+type Lockout struct {
+	max      int
+	duration time.Duration
+
+	mu      sync.Mutex
+	entries map[string]lockoutEntry
+}
+
+type lockoutEntry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// NewLockout makes a Lockout
+func NewLockout(max int, duration time.Duration) *Lockout {
+	return &Lockout{max: max, duration: duration, entries: make(map[string]lockoutEntry)}
+}
+
+// Locked returns the time left if the key is locked
+func (lo *Lockout) Locked(key string) (time.Duration, bool) {
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+
+	left := time.Until(lo.entries[key].until)
+
+	return left, left > 0
+}
+
+// Fail counts a failure of the key and reports whether it locked the key
+func (lo *Lockout) Fail(key string) bool {
+	if lo.max <= 0 {
+		return false
+	}
+
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range lo.entries {
+		if now.Sub(e.last) > lo.duration && now.After(e.until) {
+			delete(lo.entries, k)
+		}
+	}
+
+	e := lo.entries[key]
+	e.failures++
+	e.last = now
+	locked := e.failures >= lo.max
+	if locked {
+		e.failures = 0
+		e.until = now.Add(lo.duration)
+	}
+	lo.entries[key] = e
+
+	return locked
+}
+
+// Reset forgets the failures of the key
+func (lo *Lockout) Reset(key string) {
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+
+	delete(lo.entries, key)
+}
+
+// clientUserKey is the key of the client and the username in the lockouts of unauthenticated routes,
+// so guessing from one client doesn't lock the user out everywhere
+func clientUserKey(r *http.Request, username string) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return ip + ":" + tenantFor(r).ID + ":" + username
+}
+
+// lockedOut answers 429 with the error code if the key is locked
+func lockedOut(w http.ResponseWriter, lo *Lockout, key, code string) bool {
+	left, locked := lo.Locked(key)
+	if !locked {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+	JSONResponse(w, map[string]string{"error": code}, http.StatusTooManyRequests)
+
+	return true
+}
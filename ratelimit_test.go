@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitSharedByRouteName(t *testing.T) {
+	l = testLogger()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	a := RateLimitMiddleware(ok, "test.shared", 2)
+	b := RateLimitMiddleware(ok, "test.shared", 2)
+
+	codes := []int{}
+	for _, h := range []http.Handler{a, b, a} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", nil))
+		codes = append(codes, w.Code)
+	}
+
+	if codes[2] != http.StatusTooManyRequests {
+		t.Fatalf("got %v, want the third request over both routes limited", codes)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	lo := NewLockout(3, time.Minute)
+
+	for i := 1; i < 3; i++ {
+		if lo.Fail("alice") {
+			t.Fatalf("locked after %d failures", i)
+		}
+	}
+	lo.Reset("alice")
+	lo.Fail("alice")
+	lo.Fail("alice")
+	if _, locked := lo.Locked("alice"); locked {
+		t.Fatal("failures before the reset counted")
+	}
+
+	if !lo.Fail("alice") {
+		t.Fatal("not locked after 3 failures")
+	}
+	if left, locked := lo.Locked("alice"); !locked || left > time.Minute {
+		t.Fatalf("locked %t for %s, want a minute", locked, left)
+	}
+	if _, locked := lo.Locked("bob"); locked {
+		t.Fatal("other keys are locked")
+	}
+}
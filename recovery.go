@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	ceremonyRecovery = "recovery"
+	// scopeRecovery sessions are issued for a recovery code and only allow enrolling a new passkey
+	scopeRecovery = "recovery"
+
+	recoveryCodeCount = 10
+	recoveryCodeIDLen = 2
+	recoveryCodeLen   = 10
+	// crockford base32, no i, l, o, u
+	recoveryCodeAlphabet = "0123456789abcdefghjkmnpqrstvwxyz"
+)
+
+// argon2id parameters of the recovery code hashes, the OWASP minimum
+const (
+	recoveryArgonTime    = 2
+	recoveryArgonMemory  = 19 * 1024
+	recoveryArgonThreads = 1
+	recoveryArgonKeyLen  = 32
+)
+
+// recoveryLocks serialize checking and marking the codes of a user, so a code can't be used twice by
+// parallel requests
+var recoveryLocks = &keyedMutex{locks: make(map[string]*keyedLock)}
+
+// dummyRecoverySalt is hashed with the code of an unknown user, so the time doesn't tell the user exists
+var dummyRecoverySalt = make([]byte, 16)
+
+// verifyOrDummy runs verify if the user was found, else it spends the same time on dummy, so the answer
+// doesn't tell whether the user exists. Unknown users always fail.
+func verifyOrDummy(found bool, verify func() bool, dummy func()) bool {
+	if !found {
+		dummy()
+
+		return false
+	}
+
+	return verify()
+}
+
+// generateRecoveryCodes returns new codes "id-xxxxx-xxxxx" to show to the user once, and their hashes to store
+func generateRecoveryCodes() ([]string, []RecoveryCode, error) {
+	plain := make([]string, 0, recoveryCodeCount)
+	codes := make([]RecoveryCode, 0, recoveryCodeCount)
+	taken := map[string]bool{}
+
+	for len(codes) < recoveryCodeCount {
+		id, err := randomRecoveryString(recoveryCodeIDLen)
+		if err != nil {
+			return nil, nil, err
+		}
+		if taken[id] {
+			continue
+		}
+		taken[id] = true
+
+		code, err := randomRecoveryString(recoveryCodeLen)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+
+		plain = append(plain, id+"-"+code[:5]+"-"+code[5:])
+		codes = append(codes, RecoveryCode{ID: id, Salt: salt, Hash: hashRecoveryCode(code, salt)})
+	}
+
+	return plain, codes, nil
+}
+
+// randomRecoveryString is n random characters of recoveryCodeAlphabet
+func randomRecoveryString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = recoveryCodeAlphabet[int(b[i])%len(recoveryCodeAlphabet)]
+	}
+
+	return string(b), nil
+}
+
+// hashRecoveryCode is argon2id of the normalized code
+func hashRecoveryCode(code string, salt []byte) []byte {
+	return argon2.IDKey([]byte(normalizeRecoveryCode(code)), salt,
+		recoveryArgonTime, recoveryArgonMemory, recoveryArgonThreads, recoveryArgonKeyLen)
+}
+
+// normalizeRecoveryCode drops separators and case, and maps look-alike letters like crockford base32 does
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "", "i", "1", "l", "1", "o", "0").Replace(strings.ToLower(code))
+}
+
+// useRecoveryCode marks the matching unused code as used, it returns the number of codes left
+// or false if no code matches. The id of the code picks the one hash to compute, an unknown id
+// costs the same hash.
+func useRecoveryCode(user PasskeyUser, code string) (int, bool) {
+	id, secret := "", normalizeRecoveryCode(code)
+	if len(secret) == recoveryCodeIDLen+recoveryCodeLen {
+		id, secret = secret[:recoveryCodeIDLen], secret[recoveryCodeIDLen:]
+	}
+
+	codes := user.RecoveryCodes()
+	match, left := -1, 0
+	for i, c := range codes {
+		if !c.UsedAt.IsZero() {
+			continue
+		}
+		if id != "" && c.ID == id {
+			match = i
+		} else {
+			left++
+		}
+	}
+
+	salt, hash := dummyRecoverySalt, []byte(nil)
+	if match >= 0 {
+		salt, hash = codes[match].Salt, codes[match].Hash
+	}
+	if subtle.ConstantTimeCompare(hashRecoveryCode(secret, salt), hash) != 1 {
+		return 0, false
+	}
+
+	updated := append([]RecoveryCode(nil), codes...)
+	updated[match].UsedAt = time.Now()
+	user.SetRecoveryCodes(updated)
+
+	return left, true
+}
+
+// issueRecoveryCodes replaces the recovery codes of the user and returns the new ones
+func issueRecoveryCodes(r *http.Request, user PasskeyUser, event string) ([]string, error) {
+	plain, codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("can't generate recovery codes: %w", err)
+	}
+
+	unlock := recoveryLocks.Lock(tenantFor(r).ID + ":" + user.WebAuthnName())
+	user.SetRecoveryCodes(codes)
+	tenantFor(r).Store.SaveUser(user)
+	unlock()
+
+	Audit(r, event, user, map[string]interface{}{"count": len(codes)})
+
+	return plain, nil
+}
+
+// Recover checks a recovery code and issues a recovery session, it only allows enrolling a new passkey
+func Recover(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" || req.Code == "" {
+		JSONResponse(w, "username and code are required", http.StatusBadRequest)
+
+		return
+	}
+
+	left := 0
+	user, found := tenantFor(r).Store.GetUser(req.Username)
+	ok := verifyOrDummy(found, func() bool {
+		unlock := recoveryLocks.Lock(tenantFor(r).ID + ":" + user.WebAuthnName())
+		defer unlock()
+
+		var ok bool
+		if left, ok = useRecoveryCode(user, req.Code); ok {
+			tenantFor(r).Store.SaveUser(user)
+		}
+
+		return ok
+	}, func() { hashRecoveryCode(req.Code, dummyRecoverySalt) })
+
+	if !ok {
+		Audit(r, "recovery.code_failed", user, map[string]interface{}{"username": req.Username})
+		JSONResponse(w, map[string]string{"error": "invalid_recovery_code"}, http.StatusUnauthorized)
+
+		return
+	}
+
+	Audit(r, "recovery.code_used", user, map[string]interface{}{"left": left})
+
+	if loginVetoed(w, r, user) {
+		return
+	}
+
+	ttl := getEnvDuration("RECOVERY_SESSION_TTL", 10*time.Minute)
+	if err := sessions.IssueScoped(w, r, user, scopeRecovery, ttl); err != nil {
+		msg := fmt.Sprintf("can't issue recovery session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	hooks.AfterFinishLogin(r, user, nil)
+
+	JSONResponse(w, map[string]interface{}{
+		"message": "Recovery Success, enroll a new passkey",
+		"left":    left,
+		"start":   "/api/passkey/recover/registerStart",
+		"finish":  "/api/passkey/recover/registerFinish",
+	}, http.StatusOK)
+}
+
+// BeginRecoveryRegistration starts enrolling a passkey for the user of the recovery session
+func BeginRecoveryRegistration(w http.ResponseWriter, r *http.Request) {
+	beginEnrollment(w, r, ceremonyRecovery)
+}
+
+// FinishRecoveryRegistration stores the new passkey and ends the recovery session, the user logs in with it then
+func FinishRecoveryRegistration(w http.ResponseWriter, r *http.Request) {
+	user, credential, ok := finishEnrollment(w, r, ceremonyRecovery)
+	if !ok {
+		return
+	}
+	sessions.Revoke(w, r)
+
+	Audit(r, "recovery.passkey_enrolled", user, map[string]interface{}{"credentialId": encodeCredentialID(credential.ID)})
+	JSONResponse(w, "Passkey Enrolled, log in with it", http.StatusOK)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the logged-in user, the old ones stop working
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := issueRecoveryCodes(r, user, "recovery.codes_regenerated")
+	if err != nil {
+		l.Printf("[ERRO] %s", err.Error())
+		JSONResponse(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	JSONResponse(w, map[string][]string{"recoveryCodes": codes}, http.StatusOK)
+}
+
+// keyedMutex is a mutex per key, the mutex of a key is dropped when nobody holds or waits for it
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks the mutex of the key and returns the function to unlock it
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		k.locks[key] = lock
+	}
+	lock.refs++
+	k.mu.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		k.mu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
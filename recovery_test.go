@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUseRecoveryCode(t *testing.T) {
+	tenant := newTestTenant(t)
+	user := tenant.Store.GetOrCreateUser("alice")
+
+	plain, codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("can't generate codes: %s", err)
+	}
+	user.SetRecoveryCodes(codes)
+
+	if _, ok := useRecoveryCode(user, plain[0][:3]+"00000-00000"); ok {
+		t.Fatal("wrong code accepted")
+	}
+	left, ok := useRecoveryCode(user, strings.ToUpper(plain[0]))
+	if !ok || left != recoveryCodeCount-1 {
+		t.Fatalf("code: ok %t, left %d", ok, left)
+	}
+	if _, ok := useRecoveryCode(user, plain[0]); ok {
+		t.Fatal("code accepted twice")
+	}
+}
+
+func TestRecoverUnknownUser(t *testing.T) {
+	tenant := newTestTenant(t)
+
+	w := httptest.NewRecorder()
+	Recover(w, httptest.NewRequest(http.MethodPost, "/api/passkey/recover", strings.NewReader(`{"username":"mallory","code":"k3-7fq2m-x9d0a"}`)))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if _, ok := tenant.Store.GetUser("mallory"); ok {
+		t.Fatal("recovery attempt created the user")
+	}
+}
+
+func TestRecoverySessionOnlyOnRecoveryRoutes(t *testing.T) {
+	tenant := newTestTenant(t)
+	newTestSessions(t)
+
+	user := tenant.Store.GetOrCreateUser("alice")
+	newSoftAuthenticator(t).register(t, user)
+	plain, codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("can't generate codes: %s", err)
+	}
+	user.SetRecoveryCodes(codes)
+	tenant.Store.SaveUser(user)
+
+	w := httptest.NewRecorder()
+	Recover(w, httptest.NewRequest(http.MethodPost, "/api/passkey/recover", strings.NewReader(`{"username":"alice","code":"`+plain[0]+`"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("recover: status %d: %s", w.Code, w.Body)
+	}
+	cookies := w.Result().Cookies()
+
+	request := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"username":"alice"}`))
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+
+		return r
+	}
+
+	// the public registration doesn't take the recovery session
+	w = httptest.NewRecorder()
+	BeginRegistration(w, request())
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "recovery_session") {
+		t.Fatalf("public registration: status %d: %s", w.Code, w.Body)
+	}
+
+	// the recovery route does
+	w = httptest.NewRecorder()
+	LoggedInMiddleware(http.HandlerFunc(BeginRecoveryRegistration), WithJSONUnauthorized(), WithScope(scopeRecovery)).ServeHTTP(w, request())
+	if w.Code != http.StatusOK {
+		t.Fatalf("recovery registration: status %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistrationOfExistingAccounts(t *testing.T) {
+	tenant := newTestTenant(t)
+	newTestSessions(t)
+
+	withPasskey := tenant.Store.GetOrCreateUser("alice")
+	newSoftAuthenticator(t).register(t, withPasskey)
+	tenant.Store.SaveUser(withPasskey)
+
+	withPassword := tenant.Store.GetOrCreateUser("bob")
+	withPassword.SetPassword(LegacyPassword{Hash: "$2a$10$abcdefghijklmnopqrstuu5UBvsRYc1sT1lPhO7mO0f0ZTmLUj3zq"})
+	tenant.Store.SaveUser(withPassword)
+
+	body := func(name string) []byte { return []byte(`{"username":"` + name + `"}`) }
+
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"new user", httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body("carol"))), http.StatusOK},
+		{"passkey user without session", httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body("alice"))), http.StatusForbidden},
+		{"password user without session", httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body("bob"))), http.StatusForbidden},
+		{"session of another user", sessionRequest(t, http.MethodPost, "/", body("bob"), withPasskey, ""), http.StatusForbidden},
+		{"recovery session", sessionRequest(t, http.MethodPost, "/", body("alice"), withPasskey, scopeRecovery), http.StatusForbidden},
+		{"TOTP session", sessionRequest(t, http.MethodPost, "/", body("alice"), withPasskey, scopeTOTP), http.StatusForbidden},
+		{"own session", sessionRequest(t, http.MethodPost, "/", body("alice"), withPasskey, ""), http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		BeginRegistration(w, tc.r)
+		if w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+
+	if len(withPassword.WebAuthnCredentials()) != 0 {
+		t.Fatal("a passkey was added to the password user")
+	}
+}
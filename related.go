@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxRelatedLabels is the number of distinct registrable domain labels browsers accept in the
+// related origins document, the rest are ignored
+const maxRelatedLabels = 5
+
+// secondLevels are common second-level names under country code TLDs, used to find the registrable
+// domain without the public suffix list
+var secondLevels = map[string]bool{"co": true, "com": true, "org": true, "net": true, "gov": true, "edu": true, "ac": true}
+
+// RelatedOrigins serves /.well-known/webauthn of the request tenant, the list of other origins that may
+// use its RP ID. Browsers fetch it from https://{rpId}/.well-known/webauthn.
+func RelatedOrigins(w http.ResponseWriter, r *http.Request) {
+	t := tenantFor(r)
+	if len(t.RelatedOrigins) == 0 {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	JSONResponse(w, map[string][]string{"origins": t.RelatedOrigins}, http.StatusOK)
+}
+
+// checkRelatedOrigins checks that the origins are valid, are not already within rpID and that browsers
+// will accept them all
+func checkRelatedOrigins(rpID string, origins []string) error {
+	seen := make(map[string]bool, len(origins))
+	labels := make(map[string]bool)
+
+	for _, o := range origins {
+		u, err := url.Parse(o)
+		if err != nil {
+			return fmt.Errorf("related origin %q: %w", o, err)
+		}
+		if u.Scheme != "https" && u.Hostname() != "localhost" {
+			return fmt.Errorf("related origin %q must be https", o)
+		}
+		if u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return fmt.Errorf("related origin %q must be scheme://host[:port] only", o)
+		}
+
+		origin := u.Scheme + "://" + u.Host
+		if seen[origin] {
+			return fmt.Errorf("related origin %q is listed twice", o)
+		}
+		seen[origin] = true
+
+		host := u.Hostname()
+		if host == rpID || strings.HasSuffix(host, "."+rpID) {
+			return fmt.Errorf("related origin %q is within rp id %s, list it in the origins instead", o, rpID)
+		}
+
+		labels[registrableLabel(host)] = true
+	}
+
+	if len(labels) > maxRelatedLabels {
+		return fmt.Errorf("related origins use %d registrable domain labels, browsers accept only %d", len(labels), maxRelatedLabels)
+	}
+
+	return nil
+}
+
+// registrableLabel returns the label in front of the public suffix, "example" for "shop.example.co.uk".
+// It is a guess without the public suffix list, good enough to count the labels.
+func registrableLabel(host string) string {
+	parts := strings.Split(host, ".")
+	switch {
+	case len(parts) >= 3 && secondLevels[parts[len(parts)-2]] && len(parts[len(parts)-1]) == 2:
+		return parts[len(parts)-3]
+	case len(parts) >= 2:
+		return parts[len(parts)-2]
+	default:
+		return host
+	}
+}
+
+// splitList is a helper function to parse a comma separated list
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+func TestCheckRelatedOrigins(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		origins []string
+		ok      bool
+	}{
+		{"country domains", []string{"https://example.de", "https://example.co.uk", "https://shop.example.fr"}, true},
+		{"http", []string{"http://example.de"}, false},
+		{"path", []string{"https://example.de/login"}, false},
+		{"twice", []string{"https://example.de", "https://example.de"}, false},
+		{"within rp id", []string{"https://login.example.com"}, false},
+		{"too many labels", []string{"https://a.de", "https://b.de", "https://c.de", "https://d.de", "https://e.de", "https://f.de"}, false},
+		{"one label on many tlds", []string{"https://a.de", "https://a.fr", "https://a.it", "https://a.es", "https://a.nl", "https://a.co.uk"}, true},
+	} {
+		if err := checkRelatedOrigins("example.com", tc.origins); (err == nil) != tc.ok {
+			t.Errorf("%s: got error %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestRelatedOriginsDocument(t *testing.T) {
+	tenant := newTestTenant(t)
+
+	w := httptest.NewRecorder()
+	RelatedOrigins(w, httptest.NewRequest(http.MethodGet, "/.well-known/webauthn", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("without related origins: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	tenant.RelatedOrigins = []string{"https://example.de"}
+	w = httptest.NewRecorder()
+	RelatedOrigins(w, httptest.NewRequest(http.MethodGet, "/.well-known/webauthn", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"origins":["https://example.de"]}`+"\n" {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCeremonyAcceptsExtraOrigins(t *testing.T) {
+	l = testLogger()
+	app := AndroidApp{Package: "com.example.app", Fingerprints: []string{
+		"FA:C6:17:45:DC:09:03:78:6F:B9:ED:E6:2A:96:2B:39:9F:73:48:F0:BB:6F:89:9B:83:32:66:75:91:03:3B:9C",
+	}}
+	appOrigins, err := app.origins()
+	if err != nil {
+		t.Fatalf("can't get app origins: %s", err)
+	}
+
+	tenant := &Tenant{ID: "a", RPID: testRPID, DisplayName: "a", Origins: []string{testOrigin},
+		RelatedOrigins: []string{"https://example.de"}, AndroidApps: []AndroidApp{app}}
+	if err := tenant.init(); err != nil {
+		t.Fatalf("can't init tenant: %s", err)
+	}
+	tenant.Store = NewInMem(l)
+	user := tenant.Store.GetOrCreateUser("alice")
+
+	for _, tc := range []struct {
+		origin string
+		ok     bool
+	}{
+		{testOrigin, true},
+		{"https://example.de", true},
+		{appOrigins[0], true},
+		{"https://example.fr", false},
+	} {
+		auth := newSoftAuthenticator(t)
+		auth.origin = tc.origin
+		auth.register(t, user)
+
+		_, session, err := tenant.WebAuthn.BeginLogin(user)
+		if err != nil {
+			t.Fatalf("can't begin login: %s", err)
+		}
+		var challenge protocol.URLEncodedBase64
+		if err := challenge.UnmarshalJSON([]byte(`"` + session.Challenge + `"`)); err != nil {
+			t.Fatalf("can't decode challenge: %s", err)
+		}
+		parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(auth.assert(t, challenge, user.WebAuthnID())))
+		if err != nil {
+			t.Fatalf("can't parse assertion: %s", err)
+		}
+
+		if _, err := finishAssertion(tenant, user, *session, parsed); (err == nil) != tc.ok {
+			t.Errorf("origin %s: got error %v, want ok %v", tc.origin, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// Revocation policies of attestation certificates, REVOCATION_POLICY
+const (
+	revocationOff        = "off"         // no checks
+	revocationFailOpen   = "fail_open"   // a revoked certificate is rejected, an unknown status is logged
+	revocationFailClosed = "fail_closed" // a certificate without a fresh CRL of its issuer is rejected too
+)
+
+// revocationFormats are the attestation formats with an x5c chain we check
+var revocationFormats = map[string]bool{
+	"packed":      true,
+	"tpm":         true,
+	"android-key": true,
+}
+
+// crls is the local CRL store, nil if REVOCATION_POLICY is off
+var crls *CRLStore
+
+// CRLStore keeps the CRLs read from a local directory. The vendored revoke package fetches CRLs and OCSP
+// responses from the URLs in the certificates during the ceremony and caches them process-wide; the store
+// works offline instead: the CRLs are dropped into the directory by a job and reloaded by Run. The files
+// are not trusted by themselves, every CRL must be signed by the issuer of the certificate it is used for.
+type CRLStore struct {
+	dir    string
+	policy string
+
+	mu       sync.RWMutex
+	byIssuer map[string][]*x509.RevocationList
+	loadedAt time.Time
+}
+
+// NewCRLStore makes a CRLStore for the *.crl and *.pem files in dir
+func NewCRLStore(dir, policy string) *CRLStore {
+	return &CRLStore{dir: dir, policy: policy}
+}
+
+// Load reads all CRLs of the directory and replaces the loaded ones, DER and PEM ("X509 CRL") are supported
+func (s *CRLStore) Load() error {
+	var files []string
+	for _, pattern := range []string{"*.crl", "*.pem"} {
+		matches, err := filepath.Glob(filepath.Join(s.dir, pattern))
+		if err != nil {
+			return fmt.Errorf("can't list CRLs: %w", err)
+		}
+		files = append(files, matches...)
+	}
+
+	byIssuer := map[string][]*x509.RevocationList{}
+	for _, f := range files {
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("can't read CRL %s: %w", f, err)
+		}
+
+		ders := [][]byte{raw}
+		if bytes.Contains(raw, []byte("-----BEGIN")) {
+			ders = nil
+			for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+				if block.Type == "X509 CRL" {
+					ders = append(ders, block.Bytes)
+				}
+			}
+		}
+
+		for _, der := range ders {
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				return fmt.Errorf("can't parse CRL %s: %w", f, err)
+			}
+			issuer := string(crl.RawIssuer)
+			byIssuer[issuer] = append(byIssuer[issuer], crl)
+		}
+	}
+
+	s.mu.Lock()
+	s.byIssuer = byIssuer
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Run reloads the CRLs every interval until ctx is done, a failed reload keeps the loaded ones
+func (s *CRLStore) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Load(); err != nil {
+				l.Printf("[ERRO] can't reload CRLs: %s", err.Error())
+			}
+		}
+	}
+}
+
+// Status checks the certificate against the CRLs of its issuer, only CRLs signed by issuer count.
+// known is false if there is no valid fresh CRL, always so when the issuer is nil (unknown).
+func (s *CRLStore) Status(cert, issuer *x509.Certificate) (revoked, known bool) {
+	if issuer == nil {
+		return false, false
+	}
+
+	s.mu.RLock()
+	lists := s.byIssuer[string(cert.RawIssuer)]
+	s.mu.RUnlock()
+
+	now := time.Now()
+	for _, crl := range lists {
+		if crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+			continue
+		}
+
+		known = true
+		for _, rc := range crl.RevokedCertificateEntries {
+			if rc.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return true, true
+			}
+		}
+	}
+
+	return false, known
+}
+
+// checkAttestationRevocation checks every certificate of the x5c chain of the attestation. A revoked one
+// is always an error, an unknown status is an error only by the fail_closed policy. The issuer of the last
+// certificate is looked up in the trust store and metadata roots of the AAGUID.
+func checkAttestationRevocation(r *http.Request, user PasskeyUser, credential *webauthn.Credential, att protocol.AttestationObject) error {
+	if crls == nil || !revocationFormats[att.Format] {
+		return nil
+	}
+
+	chain, err := attestationChain(att)
+	if err != nil {
+		return err
+	}
+
+	for i, cert := range chain {
+		var issuer *x509.Certificate
+		if i+1 < len(chain) {
+			issuer = chain[i+1]
+		} else if id, err := uuid.FromBytes(credential.Authenticator.AAGUID); err == nil {
+			issuer = rootIssuer(cert, id)
+		}
+
+		data := map[string]interface{}{
+			"format":  att.Format,
+			"subject": cert.Subject.String(),
+			"serial":  hex.EncodeToString(cert.SerialNumber.Bytes()),
+		}
+
+		revoked, known := crls.Status(cert, issuer)
+		switch {
+		case revoked:
+			l.Printf("[WARN] attestation certificate %s of %s is revoked", cert.Subject, user.WebAuthnName())
+			Audit(r, "attestation.revoked", user, data)
+
+			return &protocol.Error{
+				Type:    "certificate_revoked",
+				Details: fmt.Sprintf("attestation certificate %s is revoked", cert.Subject),
+			}
+		case !known && crls.policy == revocationFailClosed:
+			Audit(r, "attestation.revocation_unknown", user, data)
+
+			return &protocol.Error{
+				Type:    "revocation_unknown",
+				Details: fmt.Sprintf("no fresh CRL for attestation certificate %s", cert.Subject),
+			}
+		case !known:
+			l.Printf("[WARN] no fresh CRL for attestation certificate %s, accepted by fail_open", cert.Subject)
+		}
+	}
+
+	return nil
+}
+
+// rootIssuer returns the certificate that issued cert from the trust store and metadata roots of the AAGUID,
+// cert itself if it is one of them, nil if there are no roots or cert doesn't chain to them
+func rootIssuer(cert *x509.Certificate, aaguid uuid.UUID) *x509.Certificate {
+	roots := x509.NewCertPool()
+	found := false
+	if pool, ok := trustStore[aaguid]; ok {
+		roots, found = pool.Clone(), true
+	}
+	if mds != nil {
+		if e, ok := mds.Entry(aaguid); ok {
+			for _, s := range e.MetadataStatement.AttestationRootCertificates {
+				der, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					continue
+				}
+				if root, err := x509.ParseCertificate(der); err == nil {
+					roots.AddCert(root)
+					found = true
+				}
+			}
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	c := *cert
+	// the TPM names of AIK certificates are unknown to x509, the library checked them
+	c.UnhandledCriticalExtensions = nil
+	chains, err := c.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return nil
+	}
+	if len(chains[0]) > 1 {
+		return chains[0][1]
+	}
+
+	return chains[0][0]
+}
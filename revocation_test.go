@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// testCA is a certificate with its key, to issue certificates and CRLs
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var testSerial int64
+
+// newTestCert issues a certificate signed by parent, a self-signed CA without parent
+func newTestCert(t *testing.T, name string, ca bool, parent *testCA) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("can't generate key: %s", err)
+	}
+
+	testSerial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	if ca {
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("can't create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("can't parse certificate: %s", err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+// writeCRL writes a CRL of ca revoking the certificates to dir
+func writeCRL(t *testing.T, dir, name string, ca *testCA, nextUpdate time.Time, revoked ...*x509.Certificate) {
+	t.Helper()
+
+	var entries []x509.RevocationListEntry
+	for _, c := range revoked {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: c.SerialNumber, RevocationTime: time.Now()})
+	}
+
+	testSerial++
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(testSerial),
+		ThisUpdate:                time.Now().Add(-time.Hour),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatalf("can't create CRL: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), der, 0o600); err != nil {
+		t.Fatalf("can't write CRL: %s", err)
+	}
+}
+
+// newTestCRLStore loads the CRLs of dir with the policy into crls
+func newTestCRLStore(t *testing.T, dir, policy string) {
+	t.Helper()
+
+	crls = NewCRLStore(dir, policy)
+	if err := crls.Load(); err != nil {
+		t.Fatalf("can't load CRLs: %s", err)
+	}
+	t.Cleanup(func() { crls = nil })
+}
+
+// checkChain runs checkAttestationRevocation for a packed attestation with the chain
+func checkChain(t *testing.T, aaguid uuid.UUID, chain ...*x509.Certificate) error {
+	t.Helper()
+
+	var x5c []interface{}
+	for _, c := range chain {
+		x5c = append(x5c, c.Raw)
+	}
+	att := protocol.AttestationObject{Format: "packed", AttStatement: map[string]interface{}{"x5c": x5c}}
+	credential := &webauthn.Credential{Authenticator: webauthn.Authenticator{AAGUID: aaguid[:]}}
+	r := httptest.NewRequest(http.MethodPost, "/api/passkey/registerFinish", nil)
+
+	return checkAttestationRevocation(r, &User{Name: "alice"}, credential, att)
+}
+
+func errorType(err error) string {
+	if perr, ok := err.(*protocol.Error); ok {
+		return perr.Type
+	}
+
+	return ""
+}
+
+func TestCRLStoreStatus(t *testing.T) {
+	newTestTenant(t)
+	dir := t.TempDir()
+
+	root := newTestCert(t, "root", true, nil)
+	inter := newTestCert(t, "intermediate", true, root)
+	leaf := newTestCert(t, "leaf", false, inter)
+	other := newTestCert(t, "other", false, inter)
+	forger := newTestCert(t, "intermediate", true, nil) // same name as the issuer, other key
+
+	writeCRL(t, dir, "inter.crl", inter, time.Now().Add(time.Hour), leaf.cert)
+	newTestCRLStore(t, dir, revocationFailOpen)
+
+	if revoked, known := crls.Status(leaf.cert, inter.cert); !revoked || !known {
+		t.Fatalf("leaf: revoked %v known %v, want revoked", revoked, known)
+	}
+	if revoked, known := crls.Status(other.cert, inter.cert); revoked || !known {
+		t.Fatalf("other: revoked %v known %v, want known and not revoked", revoked, known)
+	}
+
+	// a CRL with the issuer name isn't trusted without the issuer to verify it
+	if revoked, known := crls.Status(leaf.cert, nil); revoked || known {
+		t.Fatalf("without issuer: revoked %v known %v, want unknown", revoked, known)
+	}
+	if revoked, known := crls.Status(leaf.cert, forger.cert); revoked || known {
+		t.Fatalf("forged issuer: revoked %v known %v, want unknown", revoked, known)
+	}
+}
+
+func TestCRLStoreIgnoresForgedAndStale(t *testing.T) {
+	newTestTenant(t)
+	dir := t.TempDir()
+
+	root := newTestCert(t, "root", true, nil)
+	inter := newTestCert(t, "intermediate", true, root)
+	leaf := newTestCert(t, "leaf", false, inter)
+	forger := newTestCert(t, "intermediate", true, nil)
+
+	writeCRL(t, dir, "forged.crl", forger, time.Now().Add(time.Hour), leaf.cert)
+	writeCRL(t, dir, "stale.crl", inter, time.Now().Add(-time.Minute), leaf.cert)
+	newTestCRLStore(t, dir, revocationFailClosed)
+
+	if revoked, known := crls.Status(leaf.cert, inter.cert); revoked || known {
+		t.Fatalf("revoked %v known %v, want unknown", revoked, known)
+	}
+	if err := checkChain(t, uuid.New(), leaf.cert, inter.cert); errorType(err) != "revocation_unknown" {
+		t.Fatalf("fail_closed: got %v, want revocation_unknown", err)
+	}
+}
+
+func TestAttestationRevocationLastCertificate(t *testing.T) {
+	newTestTenant(t)
+	dir := t.TempDir()
+
+	root := newTestCert(t, "root", true, nil)
+	inter := newTestCert(t, "intermediate", true, root)
+	leaf := newTestCert(t, "leaf", false, inter)
+	forger := newTestCert(t, "root", true, nil) // same name as the root, other key
+
+	// the root revoked the intermediate, the last certificate of the chain
+	writeCRL(t, dir, "inter.crl", inter, time.Now().Add(time.Hour))
+	writeCRL(t, dir, "root.crl", root, time.Now().Add(time.Hour), inter.cert)
+	newTestCRLStore(t, dir, revocationFailOpen)
+
+	aaguid := uuid.New()
+
+	// without a root for the AAGUID the CRL of the root can't be verified, fail_open accepts
+	if err := checkChain(t, aaguid, leaf.cert, inter.cert); err != nil {
+		t.Fatalf("without roots: %v, want accepted as unknown", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(root.cert)
+	trustStore = TrustStore{aaguid: pool}
+	t.Cleanup(func() { trustStore = nil })
+
+	if err := checkChain(t, aaguid, leaf.cert, inter.cert); errorType(err) != "certificate_revoked" {
+		t.Fatalf("with the root: got %v, want certificate_revoked", err)
+	}
+
+	// a CRL with the root name signed by another key doesn't revoke anything
+	dir = t.TempDir()
+	writeCRL(t, dir, "inter.crl", inter, time.Now().Add(time.Hour))
+	writeCRL(t, dir, "root.crl", forger, time.Now().Add(time.Hour), inter.cert)
+	newTestCRLStore(t, dir, revocationFailClosed)
+
+	if err := checkChain(t, aaguid, leaf.cert, inter.cert); errorType(err) != "revocation_unknown" {
+		t.Fatalf("forged root CRL: got %v, want revocation_unknown", err)
+	}
+}
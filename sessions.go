@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	sessionModeServer = "server"
+	sessionModeJWT    = "jwt"
+
+	// sessionRotationGrace keeps the old id of a rotated session valid for requests that were already in flight
+	sessionRotationGrace = 30 * time.Second
+)
+
+// SessionTimeouts limit the lifetime of login sessions
+type SessionTimeouts struct {
+	// Idle ends a session without activity, requests of logged-in routes slide it forward
+	Idle time.Duration
+	// Absolute ends a session regardless of activity, counted from the login
+	Absolute time.Duration
+	// Rotate is how often an active session gets a new id, 0 disables periodic rotation.
+	// The id is also rotated on privilege change: promotion of a scoped session and step-up.
+	Rotate time.Duration
+}
+
+// expires returns the idle expiration of the session active at now, it never passes the absolute one
+func (t SessionTimeouts) expires(now, absolute time.Time) time.Time {
+	if exp := now.Add(t.Idle); exp.Before(absolute) {
+		return exp
+	}
+
+	return absolute
+}
+
+// renew reports whether the session active at now should get a new cookie: its id is due for rotation,
+// or less than half of the idle timeout is left and it can still be slid forward
+func (t SessionTimeouts) renew(session AuthSession, now time.Time) (renew, rotate bool) {
+	if session.Rotated {
+		return false, false
+	}
+	if t.Rotate > 0 && now.Sub(session.RotatedAt) >= t.Rotate {
+		return true, true
+	}
+
+	return session.Expires.Sub(now) < t.Idle/2 && session.Expires.Before(session.MaxExpires), false
+}
+
+// newSessionManager makes the SessionManager selected by SESSION_MODE
+func newSessionManager(origin string) (SessionManager, error) {
+	timeouts := SessionTimeouts{
+		Idle:     getEnvDuration("SESSION_IDLE_TIMEOUT", getEnvDuration("SESSION_TTL", time.Hour)),
+		Absolute: getEnvDuration("SESSION_MAX_LIFETIME", 12*time.Hour),
+		Rotate:   getEnvDuration("SESSION_ROTATE_INTERVAL", 15*time.Minute),
+	}
+	if timeouts.Idle <= 0 || timeouts.Absolute < timeouts.Idle || timeouts.Rotate < 0 {
+		return nil, fmt.Errorf("bad session timeouts: idle %s, max lifetime %s, rotate %s",
+			timeouts.Idle, timeouts.Absolute, timeouts.Rotate)
+	}
+
+	switch mode := getEnv("SESSION_MODE", sessionModeServer); mode {
+	case sessionModeServer:
+		return NewServerSessions(datastore, timeouts), nil
+	case sessionModeJWT:
+		keys, err := parseJWTKeys(getEnv("JWT_KEYS", ""))
+		if err != nil {
+			return nil, err
+		}
+
+		return NewJWTSessions(JWTConfig{
+			Issuer:   getEnv("JWT_ISSUER", origin),
+			Audience: getEnv("JWT_AUDIENCE", origin),
+			Timeouts: timeouts,
+			Keys:     keys,
+			Denylist: newStoreReplayCache(datastore, "jwt:"),
+		}, l)
+	default:
+		return nil, fmt.Errorf("unknown SESSION_MODE %q", mode)
+	}
+}
+
+// setSessionCookie sets the session cookie of the response, and replaces the one of the request, so handlers
+// further down the chain see the session the client will hold
+func setSessionCookie(w http.ResponseWriter, r *http.Request, name, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(time.Until(expires).Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // TODO: SameSiteStrictMode maybe?
+	})
+
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+	r.AddCookie(&http.Cookie{Name: name, Value: value})
+}
+
+// ServerSessions keeps login sessions in the datastore and hands out an opaque session id cookie
+type ServerSessions struct {
+	store    PasskeyStore
+	timeouts SessionTimeouts
+}
+
+func NewServerSessions(store PasskeyStore, timeouts SessionTimeouts) *ServerSessions {
+	return &ServerSessions{
+		store:    store,
+		timeouts: timeouts,
+	}
+}
+
+func (s *ServerSessions) Issue(w http.ResponseWriter, r *http.Request, user PasskeyUser, credential *webauthn.Credential, scope string) error {
+	now := time.Now()
+	absolute := now.Add(s.timeouts.Absolute)
+
+	return s.issue(w, r, AuthSession{
+		TenantID:     tenantFor(r).ID,
+		UserID:       user.WebAuthnID(),
+		CredentialID: credential.ID,
+		AuthTime:     now,
+		UserVerified: credential.Flags.UserVerified,
+		Expires:      s.timeouts.expires(now, absolute),
+		MaxExpires:   absolute,
+		Scope:        scope,
+	})
+}
+
+func (s *ServerSessions) IssueScoped(w http.ResponseWriter, r *http.Request, user PasskeyUser, scope string, ttl time.Duration) error {
+	now := time.Now()
+	// a scoped ttl is fixed, only the default one slides
+	absolute, expires := now.Add(ttl), now.Add(ttl)
+	if ttl <= 0 {
+		absolute = now.Add(s.timeouts.Absolute)
+		expires = s.timeouts.expires(now, absolute)
+	}
+
+	return s.issue(w, r, AuthSession{
+		TenantID:   tenantFor(r).ID,
+		UserID:     user.WebAuthnID(),
+		AuthTime:   now,
+		Expires:    expires,
+		MaxExpires: absolute,
+		Scope:      scope,
+	})
+}
+
+// issue saves the session with a new id and sets the session cookie
+func (s *ServerSessions) issue(w http.ResponseWriter, r *http.Request, session AuthSession) error {
+	t, err := s.store.GenSessionID()
+	if err != nil {
+		return fmt.Errorf("can't generate session id: %w", err)
+	}
+
+	s.save(w, r, t, session)
+
+	return nil
+}
+
+// save stores the session under the id and sets the session cookie
+func (s *ServerSessions) save(w http.ResponseWriter, r *http.Request, id string, session AuthSession) {
+	session.ID = id
+	session.RotatedAt = time.Now()
+	s.store.SaveAuthSession(id, session)
+	setSessionCookie(w, r, "sid", id, session.Expires)
+}
+
+// rotate moves the session to a new id, the old one stays valid for sessionRotationGrace.
+// The ids are linked, so a logout with either of them revokes both.
+func (s *ServerSessions) rotate(w http.ResponseWriter, r *http.Request, session AuthSession) error {
+	t, err := s.store.GenSessionID()
+	if err != nil {
+		return fmt.Errorf("can't generate session id: %w", err)
+	}
+
+	old := session
+	old.Rotated = true
+	old.Successor = t
+	if grace := time.Now().Add(sessionRotationGrace); grace.Before(old.Expires) {
+		old.Expires = grace
+	}
+	s.store.SaveAuthSession(old.ID, old)
+
+	session.Predecessor = old.ID
+	s.save(w, r, t, session)
+
+	return nil
+}
+
+func (s *ServerSessions) Check(r *http.Request) (AuthSession, bool) {
+	sid, err := r.Cookie("sid")
+	if err != nil {
+		return AuthSession{}, false
+	}
+
+	session, ok := s.store.GetAuthSession(sid.Value)
+	if !ok {
+		return AuthSession{}, false
+	}
+
+	if session.Expires.Before(time.Now()) {
+		s.store.DeleteAuthSession(sid.Value)
+
+		return AuthSession{}, false
+	}
+
+	if session.TenantID != tenantFor(r).ID {
+		return AuthSession{}, false
+	}
+
+	return session, true
+}
+
+func (s *ServerSessions) Touch(w http.ResponseWriter, r *http.Request, session AuthSession) (AuthSession, error) {
+	now := time.Now()
+	renew, rotate := s.timeouts.renew(session, now)
+	if !renew {
+		return session, nil
+	}
+
+	session.Expires = s.timeouts.expires(now, session.MaxExpires)
+	if rotate {
+		if err := s.rotate(w, r, session); err != nil {
+			return AuthSession{}, err
+		}
+		session, ok := s.Check(r)
+		if !ok {
+			return AuthSession{}, errors.New("rotated session is not valid")
+		}
+
+		return session, nil
+	}
+
+	s.store.SaveAuthSession(session.ID, session)
+	setSessionCookie(w, r, "sid", session.ID, session.Expires)
+
+	return session, nil
+}
+
+func (s *ServerSessions) Reauthenticate(w http.ResponseWriter, r *http.Request, credential *webauthn.Credential) error {
+	session, ok := s.Check(r)
+	if !ok || session.Rotated {
+		return errors.New("no session")
+	}
+
+	// a fresh assertion is a privilege change, the session gets a new id
+	now := time.Now()
+	session.CredentialID = credential.ID
+	session.AuthTime = now
+	session.UserVerified = credential.Flags.UserVerified
+	session.Expires = s.timeouts.expires(now, session.MaxExpires)
+
+	return s.rotate(w, r, session)
+}
+
+func (s *ServerSessions) Promote(w http.ResponseWriter, r *http.Request) error {
+	session, ok := s.Check(r)
+	if !ok || session.Rotated {
+		return errors.New("no session")
+	}
+
+	// the login is complete only now, so are its timeouts
+	now := time.Now()
+	s.store.DeleteAuthSession(session.ID)
+	session.Scope = ""
+	session.MaxExpires = now.Add(s.timeouts.Absolute)
+	session.Expires = s.timeouts.expires(now, session.MaxExpires)
+
+	return s.issue(w, r, session)
+}
+
+func (s *ServerSessions) Revoke(w http.ResponseWriter, r *http.Request) {
+	if sid, err := r.Cookie("sid"); err == nil {
+		s.revoke(sid.Value)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   "sid",
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// revoke deletes the session with the ids it was rotated from and to, so the logout is final
+// for the ids still in their grace period too
+func (s *ServerSessions) revoke(id string) {
+	session, ok := s.store.GetAuthSession(id)
+	s.store.DeleteAuthSession(id)
+	if !ok {
+		return
+	}
+
+	for _, link := range []func(AuthSession) string{
+		func(a AuthSession) string { return a.Predecessor },
+		func(a AuthSession) string { return a.Successor },
+	} {
+		for next := link(session); next != ""; {
+			linked, ok := s.store.GetAuthSession(next)
+			s.store.DeleteAuthSession(next)
+			if !ok {
+				break
+			}
+			next = link(linked)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// rotatedSession logs the user in with the manager and rotates the session by a step-up,
+// it returns requests carrying the old and the new session cookie
+func rotatedSession(t *testing.T, sm SessionManager, cookie string) (old, rotated *http.Request) {
+	t.Helper()
+
+	user := defaultTenant.Store.GetOrCreateUser("alice")
+	credential := &webauthn.Credential{ID: []byte("alice-passkey"), Flags: webauthn.CredentialFlags{UserVerified: true}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := sm.Issue(httptest.NewRecorder(), r, user, credential, ""); err != nil {
+		t.Fatalf("can't issue session: %s", err)
+	}
+	c, err := r.Cookie(cookie)
+	if err != nil {
+		t.Fatalf("no session cookie: %s", err)
+	}
+	if err := sm.Reauthenticate(httptest.NewRecorder(), r, credential); err != nil {
+		t.Fatalf("can't rotate session: %s", err)
+	}
+
+	old = httptest.NewRequest(http.MethodGet, "/", nil)
+	old.AddCookie(&http.Cookie{Name: cookie, Value: c.Value})
+	if _, ok := sm.Check(old); !ok {
+		t.Fatal("the old id is not valid in its grace period")
+	}
+	if _, ok := sm.Check(r); !ok {
+		t.Fatal("the new id is not valid")
+	}
+
+	return old, r
+}
+
+func testLogoutIsFinal(t *testing.T, newManager func() SessionManager, cookie string) {
+	t.Run("logout with the new id", func(t *testing.T) {
+		newTestTenant(t)
+		sm := newManager()
+		old, rotated := rotatedSession(t, sm, cookie)
+
+		sm.Revoke(httptest.NewRecorder(), rotated)
+		if _, ok := sm.Check(rotated); ok {
+			t.Fatal("the new id is valid after logout")
+		}
+		if _, ok := sm.Check(old); ok {
+			t.Fatal("the old id is valid after logout")
+		}
+	})
+
+	t.Run("logout with the old id", func(t *testing.T) {
+		newTestTenant(t)
+		sm := newManager()
+		old, rotated := rotatedSession(t, sm, cookie)
+
+		sm.Revoke(httptest.NewRecorder(), old)
+		if _, ok := sm.Check(old); ok {
+			t.Fatal("the old id is valid after logout")
+		}
+		if _, ok := sm.Check(rotated); ok {
+			t.Fatal("the new id is valid after logout")
+		}
+	})
+}
+
+func TestServerSessionsLogoutIsFinal(t *testing.T) {
+	testLogoutIsFinal(t, func() SessionManager {
+		return NewServerSessions(datastore, SessionTimeouts{Idle: time.Hour, Absolute: 12 * time.Hour})
+	}, "sid")
+}
+
+func TestJWTSessionsLogoutIsFinal(t *testing.T) {
+	testLogoutIsFinal(t, func() SessionManager {
+		sm, err := NewJWTSessions(JWTConfig{Timeouts: SessionTimeouts{Idle: time.Hour, Absolute: 12 * time.Hour}}, testLogger())
+		if err != nil {
+			t.Fatalf("can't create sessions: %s", err)
+		}
+
+		return sm
+	}, jwtCookieName)
+}
+
+func TestJWTSessionsRevokedAcrossInstances(t *testing.T) {
+	newTestTenant(t)
+
+	// two instances with the same keys and store
+	cfg := JWTConfig{
+		Timeouts: SessionTimeouts{Idle: time.Hour, Absolute: 12 * time.Hour},
+		Keys:     []JWTKey{{ID: "k1", Secret: []byte("0123456789abcdef0123456789abcdef")}},
+		Denylist: newStoreReplayCache(datastore, "jwt:"),
+	}
+	a, err := NewJWTSessions(cfg, testLogger())
+	if err != nil {
+		t.Fatalf("can't create sessions: %s", err)
+	}
+	b, err := NewJWTSessions(cfg, testLogger())
+	if err != nil {
+		t.Fatalf("can't create sessions: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := a.IssueScoped(httptest.NewRecorder(), r, defaultTenant.Store.GetOrCreateUser("alice"), "", 0); err != nil {
+		t.Fatalf("can't issue session: %s", err)
+	}
+	if _, ok := b.Check(r); !ok {
+		t.Fatal("the token is not valid on the other instance")
+	}
+
+	a.Revoke(httptest.NewRecorder(), r)
+	if _, ok := b.Check(r); ok {
+		t.Fatal("the logged-out token is valid on the other instance")
+	}
+}
+
+// newTestJWTSessions is a helper function to make JWT sessions with the keys, the first one signs
+func newTestJWTSessions(t *testing.T, timeouts SessionTimeouts, keys ...JWTKey) *JWTSessions {
+	t.Helper()
+
+	sm, err := NewJWTSessions(JWTConfig{Issuer: "test", Audience: "test", Timeouts: timeouts, Keys: keys}, testLogger())
+	if err != nil {
+		t.Fatalf("can't create sessions: %s", err)
+	}
+
+	return sm
+}
+
+func TestJWTSessionsIssue(t *testing.T) {
+	newTestTenant(t)
+	sm := newTestJWTSessions(t, SessionTimeouts{Idle: time.Hour, Absolute: 12 * time.Hour})
+	credential := &webauthn.Credential{ID: []byte("alice-passkey"), Flags: webauthn.CredentialFlags{UserVerified: true}}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := sm.Issue(httptest.NewRecorder(), r, defaultTenant.Store.GetOrCreateUser("alice"), credential, scopeTOTP); err != nil {
+		t.Fatalf("can't issue session: %s", err)
+	}
+
+	session, ok := sm.Check(r)
+	if !ok {
+		t.Fatal("the issued token is not valid")
+	}
+	if string(session.UserID) != "alice" || string(session.CredentialID) != "alice-passkey" || !session.UserVerified ||
+		session.Scope != scopeTOTP || session.TenantID != defaultTenant.ID {
+		t.Fatalf("unexpected session %+v", session)
+	}
+	if d := time.Until(session.Expires); d <= 59*time.Minute || d > time.Hour {
+		t.Fatalf("session expires in %s, want the idle timeout", d)
+	}
+
+	// the token of a tenant is not valid for another one
+	other := &Tenant{ID: "other"}
+	if _, ok := sm.Check(r.WithContext(WithTenant(r.Context(), other))); ok {
+		t.Fatal("the token is valid for another tenant")
+	}
+}
+
+func TestJWTSessionsTouchRotates(t *testing.T) {
+	newTestTenant(t)
+	sm := newTestJWTSessions(t, SessionTimeouts{Idle: time.Hour, Absolute: 12 * time.Hour, Rotate: time.Nanosecond})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := sm.IssueScoped(httptest.NewRecorder(), r, defaultTenant.Store.GetOrCreateUser("alice"), "", 0); err != nil {
+		t.Fatalf("can't issue session: %s", err)
+	}
+	c, _ := r.Cookie(jwtCookieName)
+	old := httptest.NewRequest(http.MethodGet, "/", nil)
+	old.AddCookie(c)
+	before, _ := sm.Check(old)
+
+	after, err := sm.Touch(httptest.NewRecorder(), r, before)
+	if err != nil {
+		t.Fatalf("can't touch session: %s", err)
+	}
+
+	// Touch returns the session of the new token
+	if after.ID == before.ID || after.Rotated {
+		t.Fatalf("touch returned %+v, want the rotated session", after)
+	}
+	if current, ok := sm.Check(r); !ok || current.ID != after.ID {
+		t.Fatalf("the new token is %+v, touch returned %+v", current, after)
+	}
+	if session, ok := sm.Check(old); !ok || !session.Rotated {
+		t.Fatal("the old token is not valid in its grace period")
+	}
+}
+
+func TestJWTSessionsKeyRollover(t *testing.T) {
+	newTestTenant(t)
+	timeouts := SessionTimeouts{Idle: time.Hour, Absolute: 12 * time.Hour}
+	k1 := JWTKey{ID: "k1", Secret: []byte("0123456789abcdef0123456789abcdef")}
+	k2 := JWTKey{ID: "k2", Secret: []byte("fedcba9876543210fedcba9876543210")}
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := newTestJWTSessions(t, timeouts, k1).IssueScoped(httptest.NewRecorder(), r, defaultTenant.Store.GetOrCreateUser("alice"), "", 0); err != nil {
+		t.Fatalf("can't issue session: %s", err)
+	}
+
+	// a new signing key keeps the tokens of the old one valid while it is configured
+	if _, ok := newTestJWTSessions(t, timeouts, k2, k1).Check(r); !ok {
+		t.Fatal("the token of the old key is not valid")
+	}
+	if _, ok := newTestJWTSessions(t, timeouts, k2).Check(r); ok {
+		t.Fatal("the token of a removed key is valid")
+	}
+
+	// a key with the id of another one doesn't verify its tokens
+	if _, ok := newTestJWTSessions(t, timeouts, JWTKey{ID: "k1", Secret: k2.Secret}).Check(r); ok {
+		t.Fatal("the token is valid with another secret")
+	}
+}
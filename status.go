@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// Policies for passkeys of authenticator models the metadata reports compromised, MDS_STATUS_POLICY
+const (
+	statusFlag       = "flag"       // the passkey is marked and keeps working
+	statusReregister = "reregister" // a login with it only allows enrolling a new passkey
+	statusDisable    = "disable"    // the passkey can't be used anymore
+)
+
+// statusPolicy is the policy for passkeys of compromised models
+var statusPolicy = statusFlag
+
+// AuthenticatorStatus is the undesired status of the authenticator model of a passkey
+type AuthenticatorStatus struct {
+	Status        string    `json:"status"`
+	EffectiveDate string    `json:"effectiveDate,omitempty"`
+	FlaggedAt     time.Time `json:"flaggedAt"`
+}
+
+// undesiredStatus returns the first status report of the entry the library treats as undesired,
+// the same check it makes for new registrations
+func undesiredStatus(e metadata.MetadataBLOBPayloadEntry) (metadata.StatusReport, bool) {
+	for _, s := range e.StatusReports {
+		if metadata.IsUndesiredAuthenticatorStatus(s.Status) {
+			return s, true
+		}
+	}
+
+	return metadata.StatusReport{}, false
+}
+
+// checkAuthenticatorStatus refuses a new passkey of a model the loaded metadata reports compromised. The library
+// checks its copy of the metadata, which is installed once, this one follows the reloads of the blob.
+func checkAuthenticatorStatus(r *http.Request, user PasskeyUser, credential *webauthn.Credential) error {
+	if mds == nil {
+		return nil
+	}
+
+	id, err := uuid.FromBytes(credential.Authenticator.AAGUID)
+	if err != nil || id == uuid.Nil {
+		return nil
+	}
+	e, ok := mds.Entry(id)
+	if !ok {
+		return nil
+	}
+
+	if report, bad := undesiredStatus(e); bad {
+		data := credentialEventData(credential)
+		data["status"] = string(report.Status)
+		Audit(r, "registration.authenticator_compromised", user, data)
+
+		return protocol.ErrAttestation.WithDetails(fmt.Sprintf("authenticator %s has status %s", id, report.Status))
+	}
+
+	return nil
+}
+
+// RunStatusChecks reloads the metadata blob every interval and re-evaluates the stored passkeys, until ctx is done.
+// A failed reload keeps the loaded blob, the passkeys are checked against it anyway.
+func RunStatusChecks(ctx context.Context, m *MetadataBLOB, reg *TenantRegistry, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Load(); err != nil {
+				l.Printf("[ERRO] can't reload metadata blob: %s", err.Error())
+			}
+			flagged, cleared := ReevaluateCredentials(m, reg)
+			l.Printf("[INFO] authenticator status checked: %d passkeys flagged, %d cleared", flagged, cleared)
+		}
+	}
+}
+
+// ReevaluateCredentials checks the passkeys of every tenant against the metadata. A passkey of a model with an
+// undesired status is flagged once, its user is notified by the audit log and webhooks. The flag is cleared
+// when the entry of the model no longer has such a status, passkeys of models missing from the blob keep it.
+// Each flag is changed by UpdateCredentialMeta, so concurrent logins can't undo it.
+func ReevaluateCredentials(m *MetadataBLOB, reg *TenantRegistry) (flagged, cleared int) {
+	for _, t := range reg.All() {
+		for _, user := range t.Store.ListUsers() {
+			changed := false
+			for _, c := range user.WebAuthnCredentials() {
+				id, err := uuid.FromBytes(c.Authenticator.AAGUID)
+				if err != nil || id == uuid.Nil {
+					continue
+				}
+				e, ok := m.Entry(id)
+				if !ok {
+					continue
+				}
+
+				report, bad := undesiredStatus(e)
+				var status *AuthenticatorStatus
+				var wasFlagged, wasCleared bool
+				user.UpdateCredentialMeta(c.ID, func(meta *CredentialMeta) {
+					switch {
+					case bad && meta.Compromised == nil:
+						meta.Compromised = &AuthenticatorStatus{
+							Status:        string(report.Status),
+							EffectiveDate: report.EffectiveDate,
+							FlaggedAt:     time.Now(),
+						}
+						status, wasFlagged = meta.Compromised, true
+					case !bad && meta.Compromised != nil:
+						meta.Compromised = nil
+						wasCleared = true
+					}
+				})
+
+				data := credentialEventData(&c)
+				switch {
+				case wasFlagged:
+					data["status"] = status.Status
+					data["policy"] = statusPolicy
+					AuditJob(t, "passkey.authenticator_compromised", user, data)
+					webhooks.Emit(EventAuthenticatorCompromised, user, data)
+					flagged++
+				case wasCleared:
+					AuditJob(t, "passkey.authenticator_status_cleared", user, data)
+					cleared++
+				default:
+					continue
+				}
+				changed = true
+			}
+			if changed {
+				t.Store.SaveUser(user)
+			}
+		}
+	}
+
+	return flagged, cleared
+}
+
+// credentialDisabled reports whether the passkey may not be used by the status policy, the refusal is audited
+func credentialDisabled(r *http.Request, user PasskeyUser, credential *webauthn.Credential) bool {
+	status := user.CredentialMeta(credential.ID).Compromised
+	if status == nil || statusPolicy != statusDisable {
+		return false
+	}
+
+	l.Printf("[WARN] passkey of %s is disabled, its authenticator is %s", user.WebAuthnName(), status.Status)
+	data := credentialEventData(credential)
+	data["status"] = status.Status
+	Audit(r, "passkey.disabled_use", user, data)
+
+	return true
+}
+
+// statusScope is the session scope of a login with the passkey by the status policy: a passkey of a compromised
+// model only allows enrolling a new one with the reregister policy
+func statusScope(user PasskeyUser, credential *webauthn.Credential, scope string) string {
+	if statusPolicy == statusReregister && user.CredentialMeta(credential.ID).Compromised != nil {
+		return scopeRecovery
+	}
+
+	return scope
+}
+
+// disabledResponse is a helper function to answer an assertion with a disabled passkey
+func disabledResponse(w http.ResponseWriter) {
+	JSONResponse(w, map[string]string{
+		"error":   "authenticator_compromised",
+		"message": "this passkey's authenticator is reported compromised, use another passkey or recover the account",
+	}, http.StatusForbidden)
+}
+
+// reregisterChallenge tells the client the login only allows enrolling a new passkey
+func reregisterChallenge() map[string]interface{} {
+	return map[string]interface{}{
+		"message": "Passkey Replacement Required",
+		"reregister": map[string]interface{}{
+			"registerStart":  "/api/passkey/recover/registerStart",
+			"registerFinish": "/api/passkey/recover/registerFinish",
+		},
+	}
+}
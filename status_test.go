@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// testBLOB is a helper function to make loaded metadata with the status of each model
+func testBLOB(statuses map[uuid.UUID]metadata.AuthenticatorStatus) *MetadataBLOB {
+	entries := map[uuid.UUID]metadata.MetadataBLOBPayloadEntry{}
+	for id, status := range statuses {
+		entries[id] = metadata.MetadataBLOBPayloadEntry{
+			AaGUID:        id.String(),
+			StatusReports: []metadata.StatusReport{{Status: status}},
+		}
+	}
+
+	return &MetadataBLOB{entries: entries}
+}
+
+func TestReevaluateCredentials(t *testing.T) {
+	tenant := newTestTenant(t)
+	reg, err := NewTenantRegistry(nil, tenant)
+	if err != nil {
+		t.Fatalf("can't make registry: %s", err)
+	}
+
+	model, unlisted := uuid.New(), uuid.New()
+	user := tenant.Store.GetOrCreateUser("alice")
+	user.AddCredential(&webauthn.Credential{ID: []byte("listed"), Authenticator: webauthn.Authenticator{AAGUID: model[:]}})
+	user.AddCredential(&webauthn.Credential{ID: []byte("unlisted"), Authenticator: webauthn.Authenticator{AAGUID: unlisted[:]}})
+	tenant.Store.SaveUser(user)
+
+	steps := []struct {
+		status           metadata.AuthenticatorStatus
+		flagged, cleared int
+		compromised      bool
+	}{
+		{metadata.FidoCertified, 0, 0, false},
+		{metadata.Revoked, 1, 0, true},
+		{metadata.UserKeyRemoteCompromise, 0, 0, true}, // flagged once
+		{metadata.FidoCertifiedL1, 0, 1, false},
+	}
+	for _, s := range steps {
+		flagged, cleared := ReevaluateCredentials(testBLOB(map[uuid.UUID]metadata.AuthenticatorStatus{model: s.status}), reg)
+		if flagged != s.flagged || cleared != s.cleared {
+			t.Fatalf("%s: flagged %d, cleared %d, want %d and %d", s.status, flagged, cleared, s.flagged, s.cleared)
+		}
+		if got := user.CredentialMeta([]byte("listed")).Compromised != nil; got != s.compromised {
+			t.Fatalf("%s: compromised %v, want %v", s.status, got, s.compromised)
+		}
+		if user.CredentialMeta([]byte("unlisted")).Compromised != nil {
+			t.Fatalf("%s: passkey of a model missing from the blob is flagged", s.status)
+		}
+	}
+}
+
+func TestStatusPolicies(t *testing.T) {
+	tenant := newTestTenant(t)
+	user := tenant.Store.GetOrCreateUser("alice")
+	credential := &webauthn.Credential{ID: []byte("passkey")}
+	user.AddCredential(credential)
+	user.UpdateCredentialMeta(credential.ID, func(m *CredentialMeta) {
+		m.Compromised = &AuthenticatorStatus{Status: string(metadata.Revoked)}
+	})
+	r := httptest.NewRequest(http.MethodPost, "/api/passkey/loginFinish", nil)
+	t.Cleanup(func() { statusPolicy = statusFlag })
+
+	for _, tc := range []struct {
+		policy   string
+		disabled bool
+		scope    string
+	}{
+		{statusFlag, false, ""},
+		{statusReregister, false, scopeRecovery},
+		{statusDisable, true, ""},
+	} {
+		statusPolicy = tc.policy
+		if got := credentialDisabled(r, user, credential); got != tc.disabled {
+			t.Errorf("%s: disabled %v, want %v", tc.policy, got, tc.disabled)
+		}
+		if got := statusScope(user, credential, ""); got != tc.scope {
+			t.Errorf("%s: scope %q, want %q", tc.policy, got, tc.scope)
+		}
+	}
+}
+
+func TestCheckAuthenticatorStatus(t *testing.T) {
+	newTestTenant(t)
+	bad, good := uuid.New(), uuid.New()
+	mds = testBLOB(map[uuid.UUID]metadata.AuthenticatorStatus{bad: metadata.AttestationKeyCompromise, good: metadata.FidoCertified})
+	t.Cleanup(func() { mds = nil })
+
+	r := httptest.NewRequest(http.MethodPost, "/api/passkey/registerFinish", nil)
+	user := &User{Name: "alice"}
+	if err := checkAuthenticatorStatus(r, user, &webauthn.Credential{Authenticator: webauthn.Authenticator{AAGUID: bad[:]}}); err == nil {
+		t.Fatal("passkey of a compromised model is accepted")
+	}
+	if err := checkAuthenticatorStatus(r, user, &webauthn.Credential{Authenticator: webauthn.Authenticator{AAGUID: good[:]}}); err != nil {
+		t.Fatalf("passkey of a certified model: %s", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const ceremonyStepUp = "stepup"
+
+// ReauthRequired is the response for a request with a stale assertion, the client should run
+// the step-up ceremony at Start and Finish and then repeat the request
+type ReauthRequired struct {
+	Error            string `json:"error"`
+	MaxAge           int    `json:"max_age"`
+	UserVerification bool   `json:"user_verification"`
+	Start            string `json:"start"`
+	Finish           string `json:"finish"`
+}
+
+// StepUpMiddleware lets the request through only if the last passkey assertion of the session
+// is not older than maxAge and, if requireUV is set, was made with user verification.
+// It must be wrapped by LoggedInMiddleware.
+func StepUpMiddleware(next http.Handler, maxAge time.Duration, requireUV bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := PrincipalFromContext(r.Context())
+		if !ok {
+			JSONResponse(w, map[string]string{"error": "login_required"}, http.StatusUnauthorized)
+
+			return
+		}
+
+		if time.Since(p.AuthTime) > maxAge || (requireUV && !p.UserVerified) {
+			// a bearer token can't be stepped up, the client needs a new login instead
+			if bearerSession(r) {
+				JSONResponse(w, map[string]interface{}{
+					"error":             "login_required",
+					"message":           errBearerStepUp.Error(),
+					"max_age":           int(maxAge.Seconds()),
+					"user_verification": requireUV,
+				}, http.StatusUnauthorized)
+
+				return
+			}
+
+			start := "/api/passkey/stepupStart"
+			if requireUV {
+				start += "?uv=required"
+			}
+
+			JSONResponse(w, ReauthRequired{
+				Error:            "reauth_required",
+				MaxAge:           int(maxAge.Seconds()),
+				UserVerification: requireUV,
+				Start:            start,
+				Finish:           "/api/passkey/stepupFinish",
+			}, http.StatusUnauthorized)
+
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func BeginStepUp(w http.ResponseWriter, r *http.Request) {
+	l.Printf("[INFO] begin step-up ----------------------\\")
+
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	if bearerSession(r) {
+		bearerStepUpResponse(w)
+
+		return
+	}
+
+	var opts []webauthn.LoginOption
+	if r.URL.Query().Get("uv") == "required" {
+		opts = append(opts, webauthn.WithUserVerification(protocol.VerificationRequired))
+	}
+
+	options, session, err := tenantFor(r).WebAuthn.BeginLogin(user, opts...)
+	if err != nil {
+		msg := fmt.Sprintf("can't begin step-up: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	if err := ceremonies.Save(w, ceremonyStepUp, *session); err != nil {
+		msg := fmt.Sprintf("can't save step-up session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	JSONResponse(w, options, http.StatusOK)
+}
+
+func FinishStepUp(w http.ResponseWriter, r *http.Request) {
+	user, p, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	session, err := ceremonies.Load(w, r, ceremonyStepUp)
+	if err != nil {
+		msg := fmt.Sprintf("can't get step-up session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	// the step-up must be done by the user of the current session
+	if !bytes.Equal(session.UserID, p.UserID) {
+		l.Printf("[ERRO] step-up user doesn't match the session user")
+		JSONResponse(w, "step-up user doesn't match the session user", http.StatusForbidden)
+
+		return
+	}
+
+	if loginVetoed(w, r, user) {
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		msg := fmt.Sprintf("can't finish step-up: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	credential, err := finishAssertion(tenantFor(r), user, session, parsed)
+	if err != nil {
+		msg := fmt.Sprintf("can't finish step-up: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	if credentialDisabled(r, user, credential) {
+		disabledResponse(w)
+
+		return
+	}
+
+	if credential.Authenticator.CloneWarning {
+		cloneWarning(user, credential, ceremonyStepUp)
+	}
+
+	updateCredential(r, user, credential)
+	tenantFor(r).Store.SaveUser(user)
+
+	err = sessions.Reauthenticate(w, r, credential)
+	if errors.Is(err, errBearerStepUp) {
+		bearerStepUpResponse(w)
+
+		return
+	}
+	if err != nil {
+		msg := fmt.Sprintf("can't update session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	hooks.AfterFinishLogin(r, user, credential)
+
+	l.Printf("[INFO] finish step-up ----------------------/")
+	JSONResponse(w, "Step-up Success", http.StatusOK)
+}
+
+// bearerStepUpResponse is a helper function to refuse the step-up of a bearer token
+func bearerStepUpResponse(w http.ResponseWriter) {
+	JSONResponse(w, map[string]string{
+		"error":   "stepup_unsupported",
+		"message": errBearerStepUp.Error(),
+	}, http.StatusBadRequest)
+}
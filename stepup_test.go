@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+func TestStepUpMiddleware(t *testing.T) {
+	newTestTenant(t)
+	newTestSessions(t)
+	user := &User{ID: []byte("alice"), Name: "alice"}
+
+	for _, tc := range []struct {
+		name      string
+		authTime  time.Time
+		uv        bool
+		requireUV bool
+		status    int
+		errCode   string
+	}{
+		{"fresh", time.Now().Add(-time.Minute), false, false, http.StatusOK, ""},
+		{"stale", time.Now().Add(-10 * time.Minute), true, false, http.StatusUnauthorized, "reauth_required"},
+		{"fresh without UV", time.Now().Add(-time.Minute), false, true, http.StatusUnauthorized, "reauth_required"},
+		{"fresh with UV", time.Now().Add(-time.Minute), true, true, http.StatusOK, ""},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r = r.WithContext(WithPrincipal(r.Context(), Principal{
+			TenantID: defaultTenant.ID, UserID: user.ID, Name: user.Name, AuthTime: tc.authTime, UserVerified: tc.uv,
+		}))
+		w := httptest.NewRecorder()
+		StepUpMiddleware(okHandler, 5*time.Minute, tc.requireUV).ServeHTTP(w, r)
+
+		if w.Code != tc.status {
+			t.Fatalf("%s: status %d, want %d", tc.name, w.Code, tc.status)
+		}
+		if tc.errCode == "" {
+			continue
+		}
+
+		var resp ReauthRequired
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: can't decode response: %s", tc.name, err)
+		}
+		if resp.Error != tc.errCode || resp.MaxAge != 300 || strings.Contains(resp.Start, "uv=required") != tc.requireUV {
+			t.Fatalf("%s: unexpected response %+v", tc.name, resp)
+		}
+	}
+}
+
+func TestStepUpMiddlewareBearer(t *testing.T) {
+	newTestTenant(t)
+	sm, err := NewJWTSessions(JWTConfig{Timeouts: SessionTimeouts{Idle: time.Hour, Absolute: 12 * time.Hour}}, testLogger())
+	if err != nil {
+		t.Fatalf("can't create sessions: %s", err)
+	}
+	sessions = sm
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	r = r.WithContext(WithPrincipal(r.Context(), Principal{TenantID: defaultTenant.ID, UserID: []byte("alice")}))
+	w := httptest.NewRecorder()
+	StepUpMiddleware(okHandler, 5*time.Minute, false).ServeHTTP(w, r)
+
+	// the client can't step up a bearer token, it is told to log in again
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `"error":"login_required"`) {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestStepUpRenewsAuthTime(t *testing.T) {
+	tenant := newTestTenant(t)
+	newTestSessions(t)
+
+	user := tenant.Store.GetOrCreateUser("alice")
+	auth := newSoftAuthenticator(t)
+	auth.register(t, user)
+	tenant.Store.SaveUser(user)
+
+	// a session without an assertion is stale for the step-up window
+	cookies := sessionRequest(t, http.MethodPost, "/", nil, user, "").Cookies()
+	serve := func(h http.Handler, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		LoggedInMiddleware(h, WithJSONUnauthorized()).ServeHTTP(w, r)
+
+		return w
+	}
+	protected := StepUpMiddleware(okHandler, 5*time.Minute, true)
+
+	if w := serve(protected, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("stale session: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w := serve(http.HandlerFunc(BeginStepUp), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin step-up: status %d: %s", w.Code, w.Body)
+	}
+	var options protocol.CredentialAssertion
+	if err := json.Unmarshal(w.Body.Bytes(), &options); err != nil {
+		t.Fatalf("can't decode options: %s", err)
+	}
+	cookies = append(cookies, w.Result().Cookies()...)
+
+	w = serve(http.HandlerFunc(FinishStepUp), auth.assert(t, options.Response.Challenge, user.WebAuthnID()))
+	if w.Code != http.StatusOK {
+		t.Fatalf("finish step-up: status %d: %s", w.Code, w.Body)
+	}
+
+	// the step-up rotated the session, the new one passes
+	cookies = w.Result().Cookies()
+	if w := serve(protected, nil); w.Code != http.StatusOK {
+		t.Fatalf("after step-up: status %d: %s", w.Code, w.Body)
+	}
+}
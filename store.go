@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"sync"
+	"time"
 
 	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
 )
 
 type InMem struct {
-	// TODO: it would be nice to have a mutex here
 	// TODO: use pointers to avoid copying
-	users    map[string]PasskeyUser
-	sessions map[string]webauthn.SessionData
+	mu           sync.RWMutex
+	users        map[string]PasskeyUser
+	sessions     map[string]webauthn.SessionData
+	authSessions map[string]AuthSession
+	used         *replayCache
 
 	log Logger
 }
@@ -29,13 +35,18 @@ func (i *InMem) GenSessionID() (string, error) {
 
 func NewInMem(log Logger) *InMem {
 	return &InMem{
-		users:    make(map[string]PasskeyUser),
-		sessions: make(map[string]webauthn.SessionData),
-		log:      log,
+		users:        make(map[string]PasskeyUser),
+		sessions:     make(map[string]webauthn.SessionData),
+		authSessions: make(map[string]AuthSession),
+		used:         newReplayCache(),
+		log:          log,
 	}
 }
 
 func (i *InMem) GetSession(token string) (webauthn.SessionData, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
 	i.log.Printf("[DEBUG] GetSession: %v", i.sessions[token])
 	val, ok := i.sessions[token]
 
@@ -43,16 +54,127 @@ func (i *InMem) GetSession(token string) (webauthn.SessionData, bool) {
 }
 
 func (i *InMem) SaveSession(token string, data webauthn.SessionData) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	i.log.Printf("[DEBUG] SaveSession: %s - %v", token, data)
 	i.sessions[token] = data
 }
 
 func (i *InMem) DeleteSession(token string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	i.log.Printf("[DEBUG] DeleteSession: %v", token)
 	delete(i.sessions, token)
 }
 
+func (i *InMem) GetAuthSession(token string) (AuthSession, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	i.log.Printf("[DEBUG] GetAuthSession: %v", i.authSessions[token])
+	val, ok := i.authSessions[token]
+
+	return val, ok
+}
+
+func (i *InMem) SaveAuthSession(token string, data AuthSession) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.log.Printf("[DEBUG] SaveAuthSession: %s - %v", token, data)
+	i.authSessions[token] = data
+
+	// expired sessions, e.g. old ids of rotated ones, are dropped here
+	now := time.Now()
+	for t, s := range i.authSessions {
+		if s.Expires.Before(now) {
+			delete(i.authSessions, t)
+		}
+	}
+}
+
+func (i *InMem) DeleteAuthSession(token string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.log.Printf("[DEBUG] DeleteAuthSession: %v", token)
+	delete(i.authSessions, token)
+}
+
+func (i *InMem) MarkUsed(id string, until time.Time) bool {
+	return i.used.Use(id, until)
+}
+
+func (i *InMem) IsUsed(id string) bool {
+	return i.used.Seen(id)
+}
+
+func (i *InMem) ListUsers() []PasskeyUser {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	users := make([]PasskeyUser, 0, len(i.users))
+	for _, u := range i.users {
+		users = append(users, u)
+	}
+
+	return users
+}
+
+// Ping waits for the store lock, a handler holding it for too long makes the store unresponsive
+func (i *InMem) Ping(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		i.mu.RLock()
+		i.mu.RUnlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (i *InMem) Stats() StoreStats {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	active := 0
+	now := time.Now()
+	for _, s := range i.authSessions {
+		if s.Expires.After(now) && !s.Rotated {
+			active++
+		}
+	}
+
+	creds := map[CredentialKind]int{}
+	for _, u := range i.users {
+		for _, c := range u.WebAuthnCredentials() {
+			aaguid := "unknown"
+			if id, err := uuid.FromBytes(c.Authenticator.AAGUID); err == nil {
+				aaguid = id.String()
+			}
+			creds[CredentialKind{aaguid, c.Flags.BackupEligible, c.Flags.BackupState}]++
+		}
+	}
+
+	return StoreStats{
+		Users:        len(i.users),
+		Sessions:     len(i.sessions),
+		AuthSessions: active,
+		Credentials:  creds,
+	}
+}
+
 func (i *InMem) GetOrCreateUser(userName string) PasskeyUser {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	i.log.Printf("[DEBUG] GetOrCreateUser: %v", userName)
 	if _, ok := i.users[userName]; !ok {
 		i.log.Printf("[DEBUG] GetOrCreateUser: creating new user: %v", userName)
@@ -66,7 +188,20 @@ func (i *InMem) GetOrCreateUser(userName string) PasskeyUser {
 	return i.users[userName]
 }
 
+func (i *InMem) GetUser(userName string) (PasskeyUser, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	i.log.Printf("[DEBUG] GetUser: %v", userName)
+	user, ok := i.users[userName]
+
+	return user, ok
+}
+
 func (i *InMem) SaveUser(user PasskeyUser) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	i.log.Printf("[DEBUG] SaveUser: %v", user.WebAuthnName())
 	i.log.Printf("[DEBUG] SaveUser: %v", user)
 	i.users[user.WebAuthnName()] = user
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Tenant is a relying party served by this deployment. Every tenant has its own webauthn config and
+// its own store, so users and credentials of one tenant are never seen by another.
+type Tenant struct {
+	ID          string   `json:"id"`
+	RPID        string   `json:"rpId"`
+	DisplayName string   `json:"displayName"`
+	Origins     []string `json:"origins"`
+	// Hosts are the Host header values of the tenant, with or without port. The tenant is also
+	// served under /t/{id}/.
+	Hosts []string `json:"hosts"`
+	// RelatedOrigins are origins on other domains that may use RPID, they are accepted in ceremonies
+	// and served in /.well-known/webauthn
+	RelatedOrigins []string `json:"relatedOrigins"`
+	// AppleAppIDs ("TEAMID.bundle.id") and AndroidApps are native apps sharing the passkeys, they are served
+	// in the app association files, and the Android ones are accepted as origins
+	AppleAppIDs []string     `json:"appleAppIds"`
+	AndroidApps []AndroidApp `json:"androidApps"`
+
+	// Policy, empty values leave the library defaults
+	UserVerification string `json:"userVerification"` // required, preferred or discouraged
+	ResidentKey      string `json:"residentKey"`      // required, preferred or discouraged
+	Attestation      string `json:"attestation"`      // none, indirect, direct or enterprise
+
+	WebAuthn *webauthn.WebAuthn `json:"-"`
+	Store    PasskeyStore       `json:"-"`
+}
+
+// init makes the webauthn instance of the tenant from its config
+func (t *Tenant) init() error {
+	extra, err := t.extraOrigins()
+	if err != nil {
+		return fmt.Errorf("tenant %s: %w", t.ID, err)
+	}
+
+	if t.Attestation == "" {
+		t.Attestation = defaultAttestation()
+	}
+
+	cfg := &webauthn.Config{
+		RPID:                  t.RPID,
+		RPDisplayName:         t.DisplayName,
+		RPOrigins:             append(append([]string{}, t.Origins...), extra...),
+		AttestationPreference: protocol.ConveyancePreference(t.Attestation),
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			UserVerification: protocol.UserVerificationRequirement(t.UserVerification),
+			ResidentKey:      protocol.ResidentKeyRequirement(t.ResidentKey),
+		},
+	}
+	if t.ResidentKey == string(protocol.ResidentKeyRequirementRequired) {
+		cfg.AuthenticatorSelection.RequireResidentKey = protocol.ResidentKeyRequired()
+	}
+
+	wa, err := webauthn.New(cfg)
+	if err != nil {
+		return fmt.Errorf("tenant %s: %w", t.ID, err)
+	}
+	t.WebAuthn = wa
+
+	return nil
+}
+
+// extraOrigins checks the related origins and apps, and returns the origins they add to Origins
+func (t *Tenant) extraOrigins() ([]string, error) {
+	for i, o := range t.RelatedOrigins {
+		t.RelatedOrigins[i] = strings.TrimSuffix(o, "/")
+	}
+	if err := checkRelatedOrigins(t.RPID, t.RelatedOrigins); err != nil {
+		return nil, err
+	}
+	if err := checkAppleAppIDs(t.AppleAppIDs); err != nil {
+		return nil, err
+	}
+
+	extra := append([]string{}, t.RelatedOrigins...)
+	for _, a := range t.AndroidApps {
+		origins, err := a.origins()
+		if err != nil {
+			return nil, err
+		}
+		extra = append(extra, origins...)
+	}
+
+	return extra, nil
+}
+
+// TenantRegistry selects the tenant of a request
+type TenantRegistry struct {
+	byID   map[string]*Tenant
+	byHost map[string]*Tenant
+	// fallback serves requests that match no tenant, nil if such requests are rejected
+	fallback *Tenant
+}
+
+// tenants is the registry used by TenantMiddleware
+var tenants *TenantRegistry
+
+// NewTenantRegistry makes a registry of the tenants, fallback may be nil
+func NewTenantRegistry(list []*Tenant, fallback *Tenant) (*TenantRegistry, error) {
+	reg := &TenantRegistry{
+		byID:     make(map[string]*Tenant),
+		byHost:   make(map[string]*Tenant),
+		fallback: fallback,
+	}
+
+	for _, t := range list {
+		if t.ID == "" || strings.Contains(t.ID, "/") {
+			return nil, fmt.Errorf("invalid tenant id %q", t.ID)
+		}
+		if _, ok := reg.byID[t.ID]; ok {
+			return nil, fmt.Errorf("duplicate tenant id %q", t.ID)
+		}
+		reg.byID[t.ID] = t
+
+		for _, h := range t.Hosts {
+			h = strings.ToLower(h)
+			if other, ok := reg.byHost[h]; ok {
+				return nil, fmt.Errorf("host %q is used by tenants %s and %s", h, other.ID, t.ID)
+			}
+			reg.byHost[h] = t
+		}
+	}
+
+	return reg, nil
+}
+
+// All returns every tenant including the fallback
+func (reg *TenantRegistry) All() []*Tenant {
+	all := make([]*Tenant, 0, len(reg.byID)+1)
+	if reg.fallback != nil {
+		all = append(all, reg.fallback)
+	}
+	for _, t := range reg.byID {
+		all = append(all, t)
+	}
+
+	return all
+}
+
+// Local reports whether every tenant is served on localhost only, as in development
+func (reg *TenantRegistry) Local() bool {
+	list := make([]*Tenant, 0, len(reg.byID)+1)
+	for _, t := range reg.byID {
+		list = append(list, t)
+	}
+	if reg.fallback != nil {
+		list = append(list, reg.fallback)
+	}
+
+	for _, t := range list {
+		for _, o := range t.Origins {
+			if u, err := url.Parse(o); err != nil || u.Hostname() != "localhost" {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Resolve returns the tenant of the request and the request path without the /t/{id} prefix
+func (reg *TenantRegistry) Resolve(r *http.Request) (*Tenant, string, bool) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/t/"); ok {
+		id, path, _ := strings.Cut(rest, "/")
+		t, ok := reg.byID[id]
+
+		return t, "/" + path, ok
+	}
+
+	host := strings.ToLower(r.Host)
+	if t, ok := reg.byHost[host]; ok {
+		return t, r.URL.Path, true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if t, ok := reg.byHost[h]; ok {
+			return t, r.URL.Path, true
+		}
+	}
+
+	return reg.fallback, r.URL.Path, reg.fallback != nil
+}
+
+// TenantMiddleware puts the tenant of the request into the context, requests of unknown tenants get 404
+func TenantMiddleware(next http.Handler, reg *TenantRegistry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, path, ok := reg.Resolve(r)
+		if !ok {
+			JSONResponse(w, map[string]string{"error": "unknown_tenant"}, http.StatusNotFound)
+
+			return
+		}
+
+		r = r.WithContext(WithTenant(r.Context(), t))
+		if path != r.URL.Path {
+			r.URL.Path, r.URL.RawPath = path, ""
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type tenantCtxKey struct{}
+
+// WithTenant returns a copy of ctx carrying t
+func WithTenant(ctx context.Context, t *Tenant) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, t)
+}
+
+// tenantFor returns the tenant put by TenantMiddleware, or the default one
+func tenantFor(r *http.Request) *Tenant {
+	if t, ok := r.Context().Value(tenantCtxKey{}).(*Tenant); ok {
+		return t
+	}
+
+	return defaultTenant
+}
+
+// defaultTenant is built from PROTO, HOST and PORT and serves every request if TENANTS_CONFIG is not set
+var defaultTenant *Tenant
+
+// loadTenants reads the JSON list of tenants at path and makes their webauthn instances and stores
+func loadTenants(path string) ([]*Tenant, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read tenants config: %w", err)
+	}
+
+	var list []*Tenant
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("can't parse tenants config: %w", err)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("tenants config is empty")
+	}
+
+	for _, t := range list {
+		if len(t.Origins) == 0 {
+			return nil, fmt.Errorf("tenant %s needs at least one origin", t.ID)
+		}
+		if t.DisplayName == "" {
+			t.DisplayName = t.ID
+		}
+		if err := t.init(); err != nil {
+			return nil, err
+		}
+		t.Store = newInstrumentedStore(NewInMem(l))
+	}
+
+	return list, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTenantsRequiresOrigin(t *testing.T) {
+	l = testLogger()
+
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(path, []byte(`[{"id": "a", "rpId": "a.example.com", "hosts": ["a.example.com"]}]`), 0o600); err != nil {
+		t.Fatalf("can't write config: %s", err)
+	}
+
+	if _, err := loadTenants(path); err == nil {
+		t.Fatal("tenant without origins is accepted")
+	}
+}
+
+func TestTenantRegistryLocal(t *testing.T) {
+	local := &Tenant{ID: "dev", Origins: []string{"http://localhost:8080"}}
+	public := &Tenant{ID: "a", Origins: []string{"https://a.example.com"}}
+
+	for _, tc := range []struct {
+		list     []*Tenant
+		fallback *Tenant
+		want     bool
+	}{
+		{nil, local, true},
+		{nil, public, false},
+		{[]*Tenant{local, public}, nil, false},
+	} {
+		reg, err := NewTenantRegistry(tc.list, tc.fallback)
+		if err != nil {
+			t.Fatalf("can't make registry: %s", err)
+		}
+		if got := reg.Local(); got != tc.want {
+			t.Fatalf("Local() = %v, want %v", got, tc.want)
+		}
+	}
+}
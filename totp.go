@@ -0,0 +1,565 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// scopeTOTP sessions are issued by the passkey login of a user who must pass TOTP, they only allow
+	// verifying the code or, without TOTP yet, enrolling it
+	scopeTOTP = "totp"
+
+	// RFC 6238 defaults, the only ones most authenticator apps support
+	totpDigits    = 6
+	totpPeriod    = 30
+	totpSkew      = 1 // steps accepted before and after the current one
+	totpSecretLen = 20
+	totpModulus   = 1_000_000 // 10^totpDigits
+)
+
+// TOTPSecret is the TOTP secret of a user encrypted by TOTPVault, LastStep is the last accepted time step,
+// codes of it and older steps are rejected
+type TOTPSecret struct {
+	Nonce      []byte
+	Ciphertext []byte
+	Confirmed  bool
+	LastStep   int64
+}
+
+// TOTPPolicy flags the users that must pass TOTP after the passkey login, by name or role
+type TOTPPolicy struct {
+	Users map[string]bool
+	Roles map[string]bool
+}
+
+var (
+	totpVault  *TOTPVault
+	totpPolicy TOTPPolicy
+	// totpLocks serialize checking and saving the last step of a user, so a code can't be used twice by
+	// parallel requests
+	totpLocks = &keyedMutex{locks: make(map[string]*keyedLock)}
+	// totpLockout locks users out of TOTP after failed codes, TOTP_MAX_FAILURES and TOTP_LOCKOUT
+	totpLockout = NewLockout(5, 15*time.Minute)
+	// totpRecoveryLockout counts the failed codes of the unauthenticated recovery per client and username,
+	// so guessing from elsewhere doesn't lock the user out of the second factor
+	totpRecoveryLockout = NewLockout(5, 15*time.Minute)
+	// dummyTOTPSecret is checked for users without TOTP, so the time doesn't tell whether the user has one
+	dummyTOTPSecret = make([]byte, totpSecretLen)
+)
+
+// TOTPVault encrypts TOTP secrets with AES-GCM, the key must be shared by all instances
+type TOTPVault struct {
+	aead cipher.AEAD
+}
+
+// NewTOTPVault makes a TOTPVault with a 32 bytes key, without key an ephemeral one is generated
+func NewTOTPVault(key []byte) (*TOTPVault, error) {
+	if len(key) == 0 {
+		l.Printf("[WARN] TOTP_KEY is empty, use ephemeral key, TOTP secrets won't survive restart")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("can't generate TOTP key: %w", err)
+		}
+	}
+	if len(key) != 32 {
+		return nil, errors.New("TOTP_KEY must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TOTPVault{aead: aead}, nil
+}
+
+// Seal encrypts the secret of the user, the user id is authenticated too, so secrets can't be swapped
+func (v *TOTPVault) Seal(userID, secret []byte) (TOTPSecret, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return TOTPSecret{}, err
+	}
+
+	return TOTPSecret{Nonce: nonce, Ciphertext: v.aead.Seal(nil, nonce, secret, userID)}, nil
+}
+
+// Open decrypts the secret of the user
+func (v *TOTPVault) Open(userID []byte, s TOTPSecret) ([]byte, error) {
+	secret, err := v.aead.Open(nil, s.Nonce, s.Ciphertext, userID)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt TOTP secret: %w", err)
+	}
+
+	return secret, nil
+}
+
+// parseTOTPPolicy parses TOTP_REQUIRED_USERS and TOTP_REQUIRED_ROLES lists
+func parseTOTPPolicy(users, roles string) TOTPPolicy {
+	p := TOTPPolicy{Users: map[string]bool{}, Roles: map[string]bool{}}
+	for _, u := range splitList(users) {
+		p.Users[u] = true
+	}
+	for _, r := range splitList(roles) {
+		p.Roles[r] = true
+	}
+
+	return p
+}
+
+// Requires reports whether the user must pass TOTP after the passkey login
+func (p TOTPPolicy) Requires(user PasskeyUser) bool {
+	if p.Users[user.WebAuthnName()] {
+		return true
+	}
+	for _, r := range user.Roles() {
+		if p.Roles[r] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseUserRoles parses USER_ROLES in "name=role|role,tenant/name=role" format
+func parseUserRoles(s string) map[string][]string {
+	roles := map[string][]string{}
+	for _, item := range splitList(s) {
+		name, list, _ := strings.Cut(item, "=")
+		for _, r := range strings.Split(list, "|") {
+			if r = strings.TrimSpace(r); r != "" {
+				roles[name] = append(roles[name], r)
+			}
+		}
+	}
+
+	return roles
+}
+
+// ApplyUserRoles sets the roles of the users in their tenant, a name without tenant is set in every tenant
+func ApplyUserRoles(reg *TenantRegistry, roles map[string][]string) error {
+	for key, list := range roles {
+		targets := reg.All()
+		name := key
+		if id, n, ok := strings.Cut(key, "/"); ok {
+			t, found := reg.byID[id]
+			if !found {
+				return fmt.Errorf("USER_ROLES: unknown tenant %q", id)
+			}
+			targets, name = []*Tenant{t}, n
+		}
+
+		for _, t := range targets {
+			user := t.Store.GetOrCreateUser(name)
+			user.SetRoles(list)
+			t.Store.SaveUser(user)
+		}
+	}
+
+	return nil
+}
+
+// loginScope is the scope of the session issued by a login of the user
+func loginScope(user PasskeyUser) string {
+	if totpPolicy.Requires(user) {
+		return scopeTOTP
+	}
+
+	return ""
+}
+
+// totpChallenge is the answer to a login that still needs TOTP
+func totpChallenge(user PasskeyUser) map[string]interface{} {
+	return map[string]interface{}{
+		"message": "TOTP Required",
+		"totp": map[string]interface{}{
+			"enrolled": user.TOTP().Confirmed,
+			"verify":   "/api/totp/login/verify",
+			"enroll":   "/api/totp/login/enroll",
+			"confirm":  "/api/totp/login/confirm",
+		},
+	}
+}
+
+// totpCode is the RFC 4226 HOTP value of the step
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	h := hmac.New(sha1.New, secret)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, v%totpModulus)
+}
+
+// useTOTPCode checks the code against the steps around now and saves the matched step as the last one,
+// the caller holds the lock of the user and saves the user
+func useTOTPCode(user PasskeyUser, code string, now time.Time) (bool, error) {
+	s := user.TOTP()
+	if len(s.Ciphertext) == 0 {
+		return false, nil
+	}
+
+	secret, err := totpVault.Open(user.WebAuthnID(), s)
+	if err != nil {
+		return false, err
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= s.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			s.LastStep = step
+			user.SetTOTP(s)
+
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// verifyTOTP checks the code of the confirmed TOTP of the user, a code is accepted once
+func verifyTOTP(r *http.Request, user PasskeyUser, code string) bool {
+	defer lockTOTP(r, user)()
+
+	if !user.TOTP().Confirmed {
+		checkDummyTOTP(code)
+
+		return false
+	}
+
+	ok, err := useTOTPCode(user, code, time.Now())
+	if err != nil {
+		l.Printf("[ERRO] can't verify TOTP of %s: %s", user.WebAuthnName(), err.Error())
+	}
+	if ok {
+		totpLockout.Reset(totpLockoutKey(r, user))
+		tenantFor(r).Store.SaveUser(user)
+	}
+
+	return ok
+}
+
+// totpLockoutKey is the key of the user in totpLockout
+func totpLockoutKey(r *http.Request, user PasskeyUser) string {
+	return tenantFor(r).ID + ":" + string(user.WebAuthnID())
+}
+
+// lockTOTP locks the TOTP of the user and returns the unlock function
+func lockTOTP(r *http.Request, user PasskeyUser) func() {
+	return totpLocks.Lock(totpLockoutKey(r, user))
+}
+
+// checkDummyTOTP does the work of checking a code for a user without TOTP
+func checkDummyTOTP(code string) {
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		subtle.ConstantTimeCompare([]byte(totpCode(dummyTOTPSecret, step)), []byte(code))
+	}
+}
+
+// totpLocked answers 429 if the user is locked out of TOTP by failed codes
+func totpLocked(w http.ResponseWriter, r *http.Request, user PasskeyUser) bool {
+	left, locked := totpLockout.Locked(totpLockoutKey(r, user))
+	if !locked {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+	JSONResponse(w, map[string]string{"error": "totp_locked"}, http.StatusTooManyRequests)
+
+	return true
+}
+
+// totpFailed audits the failed code of the user as event and counts it, the lockout is audited too
+func totpFailed(r *http.Request, user PasskeyUser, event string) {
+	Audit(r, event, user, nil)
+	if totpLockout.Fail(totpLockoutKey(r, user)) {
+		l.Printf("[WARN] TOTP of %s is locked after failed codes", user.WebAuthnName())
+		Audit(r, "totp.locked", user, nil)
+	}
+}
+
+// totpURI is the otpauth:// provisioning URI for authenticator apps
+func totpURI(issuer, account string, secret []byte) string {
+	q := url.Values{}
+	q.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret))
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(issuer + ":" + account)
+
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// EnrollTOTP makes a new unconfirmed secret for the logged-in user and returns it with the provisioning URI.
+// An enrolled TOTP has to be disabled first.
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, p, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	if user.TOTP().Confirmed {
+		JSONResponse(w, map[string]string{"error": "totp_enrolled"}, http.StatusConflict)
+
+		return
+	}
+
+	secret := make([]byte, totpSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		msg := fmt.Sprintf("can't generate TOTP secret: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	sealed, err := totpVault.Seal(user.WebAuthnID(), secret)
+	if err != nil {
+		msg := fmt.Sprintf("can't encrypt TOTP secret: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	unlock := lockTOTP(r, user)
+	user.SetTOTP(sealed)
+	tenantFor(r).Store.SaveUser(user)
+	unlock()
+
+	confirm := "/api/totp/confirm"
+	if p.Scope == scopeTOTP {
+		confirm = "/api/totp/login/confirm"
+	}
+
+	JSONResponse(w, map[string]string{
+		"secret":  base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret),
+		"uri":     totpURI(tenantFor(r).DisplayName, user.WebAuthnName(), secret),
+		"confirm": confirm,
+	}, http.StatusOK)
+}
+
+// ConfirmTOTP checks the first code of the enrolled secret and confirms it. During a login that needs TOTP
+// it also completes the login.
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	user, p, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	code, err := getTOTPCode(r)
+	if err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if totpLocked(w, r, user) {
+		return
+	}
+
+	unlock := lockTOTP(r, user)
+	s := user.TOTP()
+	if s.Confirmed || len(s.Ciphertext) == 0 {
+		unlock()
+		JSONResponse(w, map[string]string{"error": "totp_not_pending"}, http.StatusConflict)
+
+		return
+	}
+	ok, err = useTOTPCode(user, code, time.Now())
+	if ok {
+		s = user.TOTP()
+		s.Confirmed = true
+		user.SetTOTP(s)
+		tenantFor(r).Store.SaveUser(user)
+	}
+	unlock()
+
+	if err != nil {
+		l.Printf("[ERRO] can't verify TOTP of %s: %s", user.WebAuthnName(), err.Error())
+	}
+	if !ok {
+		totpFailed(r, user, "totp.failed")
+		JSONResponse(w, map[string]string{"error": "invalid_totp"}, http.StatusUnauthorized)
+
+		return
+	}
+
+	Audit(r, "totp.enrolled", user, nil)
+
+	if p.Scope == scopeTOTP && !promoteSession(w, r, user, p) {
+		return
+	}
+
+	JSONResponse(w, "TOTP Enrolled", http.StatusOK)
+}
+
+// VerifyTOTP completes a login that needs TOTP
+func VerifyTOTP(w http.ResponseWriter, r *http.Request) {
+	user, p, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	code, err := getTOTPCode(r)
+	if err != nil {
+		JSONResponse(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if totpLocked(w, r, user) {
+		return
+	}
+	if !verifyTOTP(r, user, code) {
+		totpFailed(r, user, "totp.failed")
+		JSONResponse(w, map[string]string{"error": "invalid_totp"}, http.StatusUnauthorized)
+
+		return
+	}
+
+	if !promoteSession(w, r, user, p) {
+		return
+	}
+
+	Audit(r, "totp.verified", user, nil)
+	JSONResponse(w, "Login Success", http.StatusOK)
+}
+
+// DisableTOTP removes the TOTP of the logged-in user, unless the policy requires it
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	if totpPolicy.Requires(user) {
+		JSONResponse(w, map[string]string{"error": "totp_required"}, http.StatusForbidden)
+
+		return
+	}
+
+	unlock := lockTOTP(r, user)
+	user.SetTOTP(TOTPSecret{})
+	tenantFor(r).Store.SaveUser(user)
+	unlock()
+
+	Audit(r, "totp.disabled", user, nil)
+	JSONResponse(w, "TOTP Disabled", http.StatusOK)
+}
+
+// RecoverWithTOTP checks a TOTP code and issues a recovery session, like Recover does for a recovery code
+func RecoverWithTOTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string `json:"username"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" || req.Code == "" {
+		JSONResponse(w, "username and code are required", http.StatusBadRequest)
+
+		return
+	}
+
+	// unknown users are counted and checked like known ones, so the answer doesn't tell whether the user exists
+	key := clientUserKey(r, req.Username)
+	if lockedOut(w, totpRecoveryLockout, key, "totp_locked") {
+		return
+	}
+
+	user, found := tenantFor(r).Store.GetUser(req.Username)
+	ok := verifyOrDummy(found, func() bool { return verifyTOTP(r, user, req.Code) }, func() { checkDummyTOTP(req.Code) })
+	if !ok {
+		Audit(r, "totp.recovery_failed", user, map[string]interface{}{"username": req.Username})
+		if totpRecoveryLockout.Fail(key) {
+			l.Printf("[WARN] TOTP recovery of %s is locked after failed codes", req.Username)
+			Audit(r, "totp.recovery_locked", user, map[string]interface{}{"username": req.Username})
+		}
+		JSONResponse(w, map[string]string{"error": "invalid_totp"}, http.StatusUnauthorized)
+
+		return
+	}
+	totpRecoveryLockout.Reset(key)
+
+	if loginVetoed(w, r, user) {
+		return
+	}
+
+	ttl := getEnvDuration("RECOVERY_SESSION_TTL", 10*time.Minute)
+	if err := sessions.IssueScoped(w, r, user, scopeRecovery, ttl); err != nil {
+		msg := fmt.Sprintf("can't issue recovery session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return
+	}
+
+	hooks.AfterFinishLogin(r, user, nil)
+	Audit(r, "totp.recovery_used", user, nil)
+	JSONResponse(w, map[string]interface{}{
+		"message": "Recovery Success, enroll a new passkey",
+		"start":   "/api/passkey/recover/registerStart",
+		"finish":  "/api/passkey/recover/registerFinish",
+	}, http.StatusOK)
+}
+
+// promoteSession is a helper function to turn the TOTP session into a regular one, it answers on failure.
+// The login completes here, so the login hooks run here and not when the TOTP session was issued.
+func promoteSession(w http.ResponseWriter, r *http.Request, user PasskeyUser, p Principal) bool {
+	if loginVetoed(w, r, user) {
+		return false
+	}
+
+	if err := sessions.Promote(w, r); err != nil {
+		msg := fmt.Sprintf("can't promote session: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		JSONResponse(w, msg, http.StatusInternalServerError)
+
+		return false
+	}
+
+	hooks.AfterFinishLogin(r, user, findCredential(user, p.CredentialID))
+
+	return true
+}
+
+// getTOTPCode is a helper function to extract the code from json request
+func getTOTPCode(r *http.Request) (string, error) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		return "", errors.New("code is required")
+	}
+
+	return req.Code, nil
+}
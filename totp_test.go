@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// RFC 6238 Appendix B, SHA-1, the last 6 of the 8 digits
+	secret := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		if got := totpCode(secret, tc.time/totpPeriod); got != tc.code {
+			t.Errorf("T=%d: got %s, want %s", tc.time, got, tc.code)
+		}
+	}
+}
+
+// newTOTPUser is a helper function to make a user with a confirmed TOTP, it returns the secret
+func newTOTPUser(t *testing.T, tenant *Tenant, name string) (PasskeyUser, []byte) {
+	t.Helper()
+
+	var err error
+	if totpVault, err = NewTOTPVault(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatalf("can't make vault: %s", err)
+	}
+
+	secret := []byte("12345678901234567890")
+	user := tenant.Store.GetOrCreateUser(name)
+	sealed, err := totpVault.Seal(user.WebAuthnID(), secret)
+	if err != nil {
+		t.Fatalf("can't seal secret: %s", err)
+	}
+	sealed.Confirmed = true
+	user.SetTOTP(sealed)
+	tenant.Store.SaveUser(user)
+
+	return user, secret
+}
+
+func TestTOTPRecoveryLockoutSeparate(t *testing.T) {
+	tenant := newTestTenant(t)
+	newTestSessions(t)
+	totpLockout, totpRecoveryLockout = NewLockout(3, time.Minute), NewLockout(3, time.Minute)
+	t.Cleanup(func() {
+		totpLockout, totpRecoveryLockout = NewLockout(5, 15*time.Minute), NewLockout(5, 15*time.Minute)
+	})
+
+	user, secret := newTOTPUser(t, tenant, "alice")
+
+	recoverWith := func(username, code string) int {
+		w := httptest.NewRecorder()
+		RecoverWithTOTP(w, httptest.NewRequest(http.MethodPost, "/api/totp/recover", strings.NewReader(`{"username":"`+username+`","code":"`+code+`"}`)))
+
+		return w.Code
+	}
+
+	// wrong recovery codes lock the client out of the recovery, unknown users like known ones
+	for _, name := range []string{"alice", "mallory"} {
+		for i := 0; i < 3; i++ {
+			if code := recoverWith(name, "000000"); code != http.StatusUnauthorized {
+				t.Fatalf("%s attempt %d: status %d, want %d", name, i, code, http.StatusUnauthorized)
+			}
+		}
+		if code := recoverWith(name, "000000"); code != http.StatusTooManyRequests {
+			t.Fatalf("%s locked: status %d, want %d", name, code, http.StatusTooManyRequests)
+		}
+	}
+	if _, ok := tenant.Store.GetUser("mallory"); ok {
+		t.Fatal("recovery attempt created the user")
+	}
+
+	// the second factor of the login still works for the user
+	body := []byte(`{"code":"` + totpCode(secret, time.Now().Unix()/totpPeriod) + `"}`)
+	w := httptest.NewRecorder()
+	LoggedInMiddleware(http.HandlerFunc(VerifyTOTP), WithJSONUnauthorized(), WithScope(scopeTOTP)).
+		ServeHTTP(w, sessionRequest(t, http.MethodPost, "/api/totp/login/verify", body, user, scopeTOTP))
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify: status %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestApplyUserRoles(t *testing.T) {
+	l = testLogger()
+	a := &Tenant{ID: "a", Store: NewInMem(l), Hosts: []string{"a.example.com"}}
+	b := &Tenant{ID: "b", Store: NewInMem(l), Hosts: []string{"b.example.com"}}
+	reg, err := NewTenantRegistry([]*Tenant{a, b}, nil)
+	if err != nil {
+		t.Fatalf("can't make registry: %s", err)
+	}
+
+	if err := ApplyUserRoles(reg, parseUserRoles("alice=admin,b/bob=ops|admin")); err != nil {
+		t.Fatalf("can't apply roles: %s", err)
+	}
+
+	for _, tenant := range []*Tenant{a, b} {
+		if user, ok := tenant.Store.GetUser("alice"); !ok || len(user.Roles()) != 1 {
+			t.Fatalf("tenant %s: alice has no roles", tenant.ID)
+		}
+	}
+	if _, ok := a.Store.GetUser("bob"); ok {
+		t.Fatal("roles of tenant b were set in tenant a")
+	}
+	if user, ok := b.Store.GetUser("bob"); !ok || len(user.Roles()) != 2 {
+		t.Fatal("bob has no roles in tenant b")
+	}
+
+	if err := ApplyUserRoles(reg, parseUserRoles("c/carol=admin")); err == nil {
+		t.Fatal("roles of an unknown tenant are accepted")
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const ceremonyTx = "tx"
+
+// txDomain separates transaction challenges from anything else hashed with sha256
+const txDomain = "go-passkey/tx/v1"
+
+// VerifiedOperation is an operation the user approved with a passkey assertion
+type VerifiedOperation struct {
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	Payload      json.RawMessage `json:"payload"`
+	UserID       []byte          `json:"user_id"`
+	CredentialID []byte          `json:"credential_id"`
+	UserVerified bool            `json:"user_verified"`
+	ConfirmedAt  time.Time       `json:"confirmed_at"`
+}
+
+// OperationHandler executes an operation once it is confirmed
+type OperationHandler func(w http.ResponseWriter, r *http.Request, op VerifiedOperation)
+
+// pendingOperation is an operation waiting for the assertion
+type pendingOperation struct {
+	Type    string
+	Payload []byte // canonical JSON
+	Nonce   []byte
+	Session webauthn.SessionData
+	Expires time.Time
+}
+
+var (
+	opHandlers = map[string]OperationHandler{}
+	pendingOps = &operationStore{ops: make(map[string]pendingOperation)}
+)
+
+// HandleOperation registers the handler for the operation type, only registered types can be confirmed
+func HandleOperation(opType string, h OperationHandler) {
+	opHandlers[opType] = h
+}
+
+// BeginOperation starts a confirmation of {"type": ..., "payload": ...} by the logged-in user.
+// The WebAuthn challenge is derived from the operation, so the assertion can't be used for anything else.
+func BeginOperation(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		JSONResponse(w, "can't decode operation: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if _, ok := opHandlers[req.Type]; !ok {
+		JSONResponse(w, fmt.Sprintf("unknown operation type %q", req.Type), http.StatusBadRequest)
+
+		return
+	}
+
+	payload, err := canonicalJSON(req.Payload)
+	if err != nil {
+		JSONResponse(w, "can't canonicalize payload: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		l.Printf("[ERRO] can't generate nonce: %s", err.Error())
+		JSONResponse(w, "can't generate nonce", http.StatusInternalServerError)
+
+		return
+	}
+
+	challenge := operationChallenge(req.Type, payload, nonce)
+
+	options, session, err := tenantFor(r).WebAuthn.BeginLogin(user,
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+		func(o *protocol.PublicKeyCredentialRequestOptions) { o.Challenge = challenge },
+	)
+	if err != nil {
+		msg := fmt.Sprintf("can't begin operation: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+	// the library keeps its own random challenge in the session, the assertion must be checked against ours
+	session.Challenge = challenge.String()
+
+	id, err := datastore.GenSessionID()
+	if err != nil {
+		l.Printf("[ERRO] can't generate operation id: %s", err.Error())
+		JSONResponse(w, "can't generate operation id", http.StatusInternalServerError)
+
+		return
+	}
+
+	pendingOps.Put(id, pendingOperation{
+		Type:    req.Type,
+		Payload: payload,
+		Nonce:   nonce,
+		Session: *session,
+		Expires: time.Now().Add(time.Duration(options.Response.Timeout) * time.Millisecond),
+	})
+
+	l.Printf("[INFO] begin operation %s (%s) for %s", id, req.Type, user.WebAuthnName())
+	JSONResponse(w, struct {
+		ID string `json:"id"`
+		*protocol.CredentialAssertion
+	}{id, options}, http.StatusOK)
+}
+
+// FinishOperation verifies the assertion for the operation ?id= and passes it to the registered handler
+func FinishOperation(w http.ResponseWriter, r *http.Request) {
+	user, p, ok := userFromPrincipal(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	op, ok := pendingOps.Take(id)
+	if !ok {
+		JSONResponse(w, "unknown or expired operation", http.StatusBadRequest)
+
+		return
+	}
+
+	if !bytes.Equal(op.Session.UserID, p.UserID) {
+		JSONResponse(w, "operation belongs to another user", http.StatusForbidden)
+
+		return
+	}
+
+	// the stored session must still carry the challenge derived from the stored operation
+	if op.Session.Challenge != operationChallenge(op.Type, op.Payload, op.Nonce).String() {
+		l.Printf("[ERRO] operation %s challenge mismatch", id)
+		JSONResponse(w, "operation challenge mismatch", http.StatusBadRequest)
+
+		return
+	}
+
+	if loginVetoed(w, r, user) {
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		msg := fmt.Sprintf("can't confirm operation: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	credential, err := finishAssertion(tenantFor(r), user, op.Session, parsed)
+	if err != nil {
+		msg := fmt.Sprintf("can't confirm operation: %s", err.Error())
+		l.Printf("[ERRO] %s", msg)
+		setErrorCode(w, err)
+		JSONResponse(w, msg, http.StatusBadRequest)
+
+		return
+	}
+
+	if credentialDisabled(r, user, credential) {
+		disabledResponse(w)
+
+		return
+	}
+
+	if credential.Authenticator.CloneWarning {
+		cloneWarning(user, credential, ceremonyTx)
+	}
+
+	updateCredential(r, user, credential)
+	tenantFor(r).Store.SaveUser(user)
+	hooks.AfterFinishLogin(r, user, credential)
+
+	l.Printf("[INFO] operation %s (%s) confirmed by %s", id, op.Type, user.WebAuthnName())
+	opHandlers[op.Type](w, r, VerifiedOperation{
+		ID:           id,
+		Type:         op.Type,
+		Payload:      op.Payload,
+		UserID:       user.WebAuthnID(),
+		CredentialID: credential.ID,
+		UserVerified: credential.Flags.UserVerified,
+		ConfirmedAt:  time.Now(),
+	})
+}
+
+// operationChallenge is sha256(domain || 0 || type || 0 || canonical payload || nonce)
+func operationChallenge(opType string, payload, nonce []byte) protocol.URLEncodedBase64 {
+	h := sha256.New()
+	h.Write([]byte(txDomain))
+	h.Write([]byte{0})
+	h.Write([]byte(opType))
+	h.Write([]byte{0})
+	h.Write(payload)
+	h.Write(nonce)
+
+	return h.Sum(nil)
+}
+
+// canonicalJSON re-encodes JSON with sorted object keys and without insignificant whitespace
+func canonicalJSON(raw json.RawMessage) ([]byte, error) {
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty payload")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// operationStore keeps pending operations until they are confirmed or expired
+type operationStore struct {
+	mu  sync.Mutex
+	ops map[string]pendingOperation
+}
+
+func (s *operationStore) Put(id string, op pendingOperation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range s.ops {
+		if v.Expires.Before(now) {
+			delete(s.ops, k)
+		}
+	}
+	s.ops[id] = op
+}
+
+// Take returns and removes the operation, so it can be confirmed only once
+func (s *operationStore) Take(id string) (pendingOperation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op, ok := s.ops[id]
+	delete(s.ops, id)
+	if !ok || op.Expires.Before(time.Now()) {
+		return pendingOperation{}, false
+	}
+
+	return op, true
+}
+
+// EchoOperation is an example OperationHandler, it just returns the confirmed operation
+func EchoOperation(w http.ResponseWriter, _ *http.Request, op VerifiedOperation) {
+	JSONResponse(w, op, http.StatusOK)
+}
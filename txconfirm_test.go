@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// beginTestOperation starts the confirmation of the operation and returns its id and challenge
+func beginTestOperation(t *testing.T, user PasskeyUser, body string) (string, protocol.URLEncodedBase64) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	BeginOperation(w, principalRequest(http.MethodPost, "/api/tx/begin", []byte(body), user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin: status %d: %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		ID        string `json:"id"`
+		PublicKey struct {
+			Challenge protocol.URLEncodedBase64 `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("begin: can't decode response: %s", err)
+	}
+
+	return resp.ID, resp.PublicKey.Challenge
+}
+
+func TestOperationBeginFinish(t *testing.T) {
+	tenant := newTestTenant(t)
+	HandleOperation("test.transfer", EchoOperation)
+
+	user := tenant.Store.GetOrCreateUser("alice")
+	auth := newSoftAuthenticator(t)
+	auth.register(t, user)
+	tenant.Store.SaveUser(user)
+
+	id, challenge := beginTestOperation(t, user, `{"type":"test.transfer","payload":{"to":"bob","amount":10}}`)
+
+	op, ok := pendingOps.Take(id)
+	if !ok {
+		t.Fatal("operation is not pending")
+	}
+	pendingOps.Put(id, op)
+	if want := operationChallenge("test.transfer", []byte(`{"amount":10,"to":"bob"}`), op.Nonce); challenge.String() != want.String() {
+		t.Fatalf("challenge %s is not derived from the operation, want %s", challenge, want)
+	}
+	if op.Session.Challenge != challenge.String() {
+		t.Fatalf("session challenge %s, want %s", op.Session.Challenge, challenge)
+	}
+
+	w := httptest.NewRecorder()
+	FinishOperation(w, principalRequest(http.MethodPost, "/api/tx/finish?id="+id, auth.assert(t, challenge, user.WebAuthnID()), user))
+	if w.Code != http.StatusOK {
+		t.Fatalf("finish: status %d: %s", w.Code, w.Body)
+	}
+
+	var got VerifiedOperation
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("finish: can't decode response: %s", err)
+	}
+	if got.ID != id || got.Type != "test.transfer" || string(got.Payload) != `{"amount":10,"to":"bob"}` || !got.UserVerified {
+		t.Fatalf("unexpected verified operation %+v", got)
+	}
+
+	// the operation can be confirmed only once
+	w = httptest.NewRecorder()
+	FinishOperation(w, principalRequest(http.MethodPost, "/api/tx/finish?id="+id, auth.assert(t, challenge, user.WebAuthnID()), user))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("second finish: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOperationAssertionBoundToOperation(t *testing.T) {
+	tenant := newTestTenant(t)
+	HandleOperation("test.transfer", EchoOperation)
+
+	user := tenant.Store.GetOrCreateUser("alice")
+	auth := newSoftAuthenticator(t)
+	auth.register(t, user)
+	tenant.Store.SaveUser(user)
+
+	_, small := beginTestOperation(t, user, `{"type":"test.transfer","payload":{"to":"bob","amount":10}}`)
+	big, _ := beginTestOperation(t, user, `{"type":"test.transfer","payload":{"to":"mallory","amount":10000}}`)
+
+	// an assertion over the challenge of one operation doesn't confirm another
+	w := httptest.NewRecorder()
+	FinishOperation(w, principalRequest(http.MethodPost, "/api/tx/finish?id="+big, auth.assert(t, small, user.WebAuthnID()), user))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("finish: status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+}
+
+func TestOperationRefusesPasskeyOfAnotherUser(t *testing.T) {
+	tenant := newTestTenant(t)
+	HandleOperation("test.transfer", EchoOperation)
+
+	alice, mallory := tenant.Store.GetOrCreateUser("alice"), tenant.Store.GetOrCreateUser("mallory")
+	newSoftAuthenticator(t).register(t, alice)
+	other := newSoftAuthenticator(t)
+	other.register(t, mallory)
+	tenant.Store.SaveUser(alice)
+	tenant.Store.SaveUser(mallory)
+
+	id, challenge := beginTestOperation(t, alice, `{"type":"test.transfer","payload":{"to":"mallory","amount":10}}`)
+
+	w := httptest.NewRecorder()
+	FinishOperation(w, principalRequest(http.MethodPost, "/api/tx/finish?id="+id, other.assert(t, challenge, alice.WebAuthnID()), alice))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("finish: status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+}
@@ -1,5 +1,6 @@
 document.getElementById('registerButton').addEventListener('click', register);
 document.getElementById('loginButton').addEventListener('click', login);
+document.getElementById('passwordLoginButton').addEventListener('click', passwordLogin);
 
 
 function showMessage(message, isError = false) {
@@ -14,7 +15,7 @@ async function register() {
 
     try {
         // Get registration options from your server. Here, we also receive the challenge.
-        const response = await fetch('/api/passkey/registerStart', {
+        const response = await fetch('api/passkey/registerStart', {
             method: 'POST', headers: {'Content-Type': 'application/json'},
             body: JSON.stringify({username: username})
         });
@@ -33,7 +34,7 @@ async function register() {
         const attestationResponse = await SimpleWebAuthnBrowser.startRegistration(options.publicKey);
 
         // Send attestationResponse back to server for verification and storage.
-        const verificationResponse = await fetch('/api/passkey/registerFinish', {
+        const verificationResponse = await fetch('api/passkey/registerFinish', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
@@ -43,7 +44,9 @@ async function register() {
 
 
         const msg = await verificationResponse.json();
-        if (verificationResponse.ok) {
+        if (verificationResponse.ok && msg.recoveryCodes) {
+            showMessage(msg.message + '. Save your recovery codes, they are shown only once: ' + msg.recoveryCodes.join(' '), false);
+        } else if (verificationResponse.ok) {
             showMessage(msg, false);
         } else {
             showMessage(msg, true);
@@ -60,7 +63,7 @@ async function login() {
 
     try {
         // Get login options from your server. Here, we also receive the challenge.
-        const response = await fetch('/api/passkey/loginStart', {
+        const response = await fetch('api/passkey/loginStart', {
             method: 'POST', headers: {'Content-Type': 'application/json'},
             body: JSON.stringify({username: username})
         });
@@ -72,12 +75,30 @@ async function login() {
         // Convert the login options to JSON.
         const options = await response.json();
 
+        // PRF salts come as base64url, the browser wants bytes.
+        const extensions = options.publicKey.extensions || {};
+        if (extensions.prf) {
+            for (const id in extensions.prf.evalByCredential) {
+                extensions.prf.evalByCredential[id].first = fromBase64url(extensions.prf.evalByCredential[id].first);
+            }
+        }
+
         // This triggers the browser to display the passkey / WebAuthn modal (e.g. Face ID, Touch ID, Windows Hello).
         // A new assertionResponse is created. This also means that the challenge has been signed.
         const assertionResponse = await SimpleWebAuthnBrowser.startAuthentication(options.publicKey);
 
+        // The PRF output is the key material for the data key, it never leaves the browser.
+        const ext = assertionResponse.clientExtensionResults || {};
+        const prfOutput = ext.prf && ext.prf.results && ext.prf.results.first;
+        delete ext.prf;
+        // The blob read from a security key is for the page, the server only needs to know a write succeeded.
+        if (ext.largeBlob && ext.largeBlob.blob) {
+            largeBlob = new Uint8Array(ext.largeBlob.blob);
+            delete ext.largeBlob.blob;
+        }
+
         // Send assertionResponse back to server for verification.
-        const verificationResponse = await fetch('/api/passkey/loginFinish', {
+        const verificationResponse = await fetch('api/passkey/loginFinish', {
             method: 'POST',
             headers: {
                 'Content-Type': 'application/json',
@@ -86,12 +107,212 @@ async function login() {
         });
 
         const msg = await verificationResponse.json();
-        if (verificationResponse.ok) {
-            showMessage(msg, false);
+        if (verificationResponse.ok && msg.totp) {
+            await secondFactor(msg.totp);
+        } else if (verificationResponse.ok && msg.reregister) {
+            // The authenticator of this passkey is reported compromised, the session only allows replacing it.
+            showMessage(msg.message, true);
+            await enroll(msg.reregister.registerStart, msg.reregister.registerFinish);
+        } else if (verificationResponse.ok) {
+            showMessage(msg.message || msg, false);
+            if (prfOutput) {
+                await unlockDataKey(assertionResponse.id, prfOutput);
+            }
+            if (msg.largeBlobWrite) {
+                await writeLargeBlob(msg.largeBlobWrite);
+            }
+            await backupNudge();
         } else {
             showMessage(msg, true);
         }
     } catch (error) {
         showMessage('Error: ' + error.message, true);
     }
-}
\ No newline at end of file
+}
+
+// secondFactor completes a login that needs TOTP, enrolling it first if the account has none
+async function secondFactor(totp) {
+    let url = totp.verify;
+    if (!totp.enrolled) {
+        const enrollResponse = await fetch(totp.enroll, {method: 'POST'});
+        const enrollment = await enrollResponse.json();
+        if (!enrollResponse.ok) {
+            throw new Error('Failed to enroll TOTP: ' + (enrollment.error || enrollment));
+        }
+        alert('Add this account to your authenticator app:\n\n' + enrollment.uri + '\n\nSecret: ' + enrollment.secret);
+        url = enrollment.confirm;
+    }
+
+    const code = prompt('Code from your authenticator app');
+    const response = await fetch(url, {
+        method: 'POST', headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({code: code})
+    });
+    const msg = await response.json();
+    showMessage(msg.error || msg, !response.ok);
+}
+
+// backupNudge asks users with all passkeys on one device to add another one
+async function backupNudge() {
+    const response = await fetch('api/passkey/backup');
+    if (response.ok && (await response.json()).nudge) {
+        showMessage('Login Success. Your passkey lives only on this device: add a second one, so you don\'t lose access with it.', false);
+    }
+}
+
+// writeLargeBlob writes the blob queued for the passkey of the login, with a second touch of that passkey
+async function writeLargeBlob(routes) {
+    const optionsResponse = await fetch(routes.start, {method: 'POST'});
+    if (!optionsResponse.ok) {
+        return;
+    }
+    const options = await optionsResponse.json();
+    options.publicKey.extensions.largeBlob.write = fromBase64url(options.publicKey.extensions.largeBlob.write);
+
+    const assertionResponse = await SimpleWebAuthnBrowser.startAuthentication(options.publicKey);
+    const response = await fetch(routes.finish, {
+        method: 'POST', headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify(assertionResponse)
+    });
+    const msg = await response.json();
+    showMessage(msg.error || msg, !response.ok);
+}
+
+// largeBlob is the blob read from the security key on login
+let largeBlob = null;
+
+// dataKey encrypts the user data on the client, it is unlocked by the PRF output of a passkey
+let dataKey = null;
+
+// unlockDataKey unwraps the data key stored for the passkey, or makes a new one on the first login with it
+async function unlockDataKey(credentialId, prfOutput) {
+    const response = await fetch('api/passkey/prf');
+    if (!response.ok) {
+        return;
+    }
+    const keys = await response.json();
+    const entry = keys.find(k => k.credentialId === credentialId);
+    if (!entry) {
+        return;
+    }
+
+    const hkdf = await crypto.subtle.importKey('raw', prfOutput, 'HKDF', false, ['deriveKey']);
+    const kek = await crypto.subtle.deriveKey(
+        {name: 'HKDF', hash: 'SHA-256', salt: new Uint8Array(), info: new TextEncoder().encode('data key wrapping')},
+        hkdf, {name: 'AES-GCM', length: 256}, false, ['encrypt', 'decrypt']);
+
+    if (entry.wrappedKey) {
+        const wrapped = fromBase64url(entry.wrappedKey);
+        dataKey = new Uint8Array(await crypto.subtle.decrypt(
+            {name: 'AES-GCM', iv: wrapped.slice(0, 12)}, kek, wrapped.slice(12)));
+
+        return;
+    }
+
+    // The first passkey makes the key. Others wrap it only when it is unlocked already, i.e. after
+    // logging in with a passkey that has it, so all of them keep the same key.
+    if (!dataKey && keys.some(k => k.wrappedKey)) {
+        return;
+    }
+    dataKey = dataKey || crypto.getRandomValues(new Uint8Array(32));
+    const iv = crypto.getRandomValues(new Uint8Array(12));
+    const ciphertext = new Uint8Array(await crypto.subtle.encrypt({name: 'AES-GCM', iv: iv}, kek, dataKey));
+    const wrapped = new Uint8Array(iv.length + ciphertext.length);
+    wrapped.set(iv);
+    wrapped.set(ciphertext, iv.length);
+
+    await fetch('api/passkey/prf/wrappedKey', {
+        method: 'POST', headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({credentialId: credentialId, wrappedKey: toBase64url(wrapped)})
+    });
+}
+
+function fromBase64url(s) {
+    const b64 = s.replace(/-/g, '+').replace(/_/g, '/');
+    return Uint8Array.from(atob(b64 + '='.repeat((4 - b64.length % 4) % 4)), c => c.charCodeAt(0));
+}
+
+function toBase64url(bytes) {
+    return btoa(String.fromCharCode(...bytes)).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+// Recovery link from the email: #recover=<token>
+if (location.hash.startsWith('#recover=')) {
+    recoverFromEmail(location.hash.substring('#recover='.length));
+}
+
+async function recoverFromEmail(token) {
+    history.replaceState(null, '', location.pathname);
+
+    try {
+        // Exchange the link token for a recovery session.
+        const response = await fetch('api/passkey/email/recover', {
+            method: 'POST', headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify({token: token})
+        });
+        if (!response.ok) {
+            const msg = await response.json();
+            throw new Error('Recovery link is not valid: ' + (msg.error || msg));
+        }
+
+        // The recovery session only allows enrolling a new passkey.
+        await enroll('api/passkey/recover/registerStart', 'api/passkey/recover/registerFinish');
+    } catch (error) {
+        showMessage('Error: ' + error.message, true);
+    }
+}
+
+async function passwordLogin() {
+    const username = document.getElementById('username').value;
+    const password = document.getElementById('password').value;
+
+    try {
+        const response = await fetch('api/password/login', {
+            method: 'POST', headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify({username: username, password: password})
+        });
+        const msg = await response.json();
+        if (!response.ok) {
+            throw new Error('Login failed: ' + (msg.error || msg));
+        }
+        if (msg.totp) {
+            await secondFactor(msg.totp);
+        } else {
+            showMessage(msg.message, false);
+        }
+
+        // Offer to replace the password with a passkey.
+        if (msg.upgrade && confirm('Sign in faster and safer next time: create a passkey for this account?')) {
+            await enroll('api/password/upgrade/registerStart', 'api/password/upgrade/registerFinish');
+        }
+    } catch (error) {
+        showMessage('Error: ' + error.message, true);
+    }
+}
+
+// enroll adds a passkey to the account of the current session
+async function enroll(start, finish) {
+    const optionsResponse = await fetch(start, {method: 'POST'});
+    if (!optionsResponse.ok) {
+        const msg = await optionsResponse.json();
+        throw new Error('Failed to get registration options from server: ' + msg);
+    }
+    const options = await optionsResponse.json();
+
+    const attestationResponse = await SimpleWebAuthnBrowser.startRegistration(options.publicKey);
+
+    const verificationResponse = await fetch(finish, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify(attestationResponse)
+    });
+
+    const msg = await verificationResponse.json();
+    if (verificationResponse.ok && msg.recoveryCodes) {
+        showMessage(msg.message + '. Save your recovery codes, they are shown only once: ' + msg.recoveryCodes.join(' '), false);
+    } else {
+        showMessage(msg.message || msg, !verificationResponse.ok);
+    }
+}
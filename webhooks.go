@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+// Security event types sent to webhooks
+const (
+	EventPasskeyAdded   = "passkey.added"
+	EventPasskeyRemoved = "passkey.removed"
+	EventCloneWarning   = "passkey.clone_warning"
+	EventLoginNewDevice = "login.new_device"
+	// EventAuthenticatorCompromised is sent for every passkey of a model the metadata reports compromised
+	EventAuthenticatorCompromised = "passkey.authenticator_compromised"
+)
+
+// webhooks delivers security events, nil if WEBHOOKS_CONFIG is not set
+var webhooks *WebhookDispatcher
+
+// Event is the JSON payload of a webhook
+type Event struct {
+	ID   string                 `json:"id"`
+	Type string                 `json:"type"`
+	Time time.Time              `json:"time"`
+	User string                 `json:"user"`
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// WebhookEndpoint is a receiver of events. Events filters the event types, empty or "*" means all.
+type WebhookEndpoint struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// Wants reports whether the endpoint is subscribed to the event type
+func (e WebhookEndpoint) Wants(typ string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, t := range e.Events {
+		if t == "*" || t == typ {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebhookConfig configures a WebhookDispatcher, zero values get defaults
+type WebhookConfig struct {
+	Endpoints   []WebhookEndpoint `json:"endpoints"`
+	QueuePath   string            `json:"queue"`       // file the pending deliveries are kept in, memory only if empty
+	LogPath     string            `json:"log"`         // JSON lines delivery log, optional
+	MaxAttempts int               `json:"maxAttempts"` // default 10
+	MinBackoff  time.Duration     `json:"-"`           // default 1s, doubled after each failed attempt
+	MaxBackoff  time.Duration     `json:"-"`           // default 1h
+	Timeout     time.Duration     `json:"-"`           // default 10s per request
+
+	Client *http.Client     `json:"-"`
+	Now    func() time.Time `json:"-"`
+}
+
+// delivery is a pending event for one endpoint
+type delivery struct {
+	ID          string    `json:"id"`
+	Endpoint    int       `json:"endpoint"` // index in WebhookConfig.Endpoints
+	URL         string    `json:"url"`
+	Event       Event     `json:"event"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// DeliveryRecord is an entry of the delivery log
+type DeliveryRecord struct {
+	DeliveryID string    `json:"deliveryId"`
+	EventID    string    `json:"eventId"`
+	EventType  string    `json:"eventType"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	Status     int       `json:"status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Outcome    string    `json:"outcome"` // delivered, retry or dropped
+	Time       time.Time `json:"time"`
+}
+
+const deliveryLogSize = 1000
+
+// WebhookDispatcher signs events with the endpoint secret and delivers them, failed deliveries are retried
+// with exponential backoff. The queue is written to QueuePath after every change, so it survives restarts.
+type WebhookDispatcher struct {
+	cfg  WebhookConfig
+	wake chan struct{}
+
+	mu    sync.Mutex
+	queue []delivery
+	log   []DeliveryRecord
+}
+
+// NewWebhookDispatcher makes a dispatcher and loads the pending deliveries from cfg.QueuePath
+func NewWebhookDispatcher(cfg WebhookConfig) (*WebhookDispatcher, error) {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 10
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Hour
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: cfg.Timeout}
+	}
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+
+	d := &WebhookDispatcher{cfg: cfg, wake: make(chan struct{}, 1)}
+
+	if cfg.QueuePath != "" {
+		raw, err := os.ReadFile(cfg.QueuePath)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("can't read webhook queue: %w", err)
+		default:
+			if err := json.Unmarshal(raw, &d.queue); err != nil {
+				return nil, fmt.Errorf("can't parse webhook queue: %w", err)
+			}
+		}
+	}
+
+	return d, nil
+}
+
+// Emit queues the event for every subscribed endpoint, it is safe to call on a nil dispatcher
+func (d *WebhookDispatcher) Emit(typ string, user PasskeyUser, data map[string]interface{}) {
+	if d == nil {
+		return
+	}
+
+	ev := Event{ID: uuid.NewString(), Type: typ, Time: d.cfg.Now().UTC(), User: user.WebAuthnName(), Data: data}
+
+	d.mu.Lock()
+	queued := 0
+	for i, e := range d.cfg.Endpoints {
+		if !e.Wants(typ) {
+			continue
+		}
+		d.queue = append(d.queue, delivery{ID: uuid.NewString(), Endpoint: i, URL: e.URL, Event: ev, NextAttempt: ev.Time})
+		queued++
+	}
+	if queued > 0 {
+		d.persist()
+	}
+	d.mu.Unlock()
+
+	if queued > 0 {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run delivers queued events until ctx is done
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		d.Flush(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// Flush makes one attempt for every delivery that is due
+func (d *WebhookDispatcher) Flush(ctx context.Context) {
+	now := d.cfg.Now()
+
+	d.mu.Lock()
+	var due []delivery
+	for _, dl := range d.queue {
+		if !dl.NextAttempt.After(now) {
+			due = append(due, dl)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, dl := range due {
+		status, err := d.send(ctx, dl)
+		d.done(dl, status, err)
+	}
+}
+
+// Pending returns the number of queued deliveries
+func (d *WebhookDispatcher) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.queue)
+}
+
+// Deliveries returns the recent delivery log, oldest first
+func (d *WebhookDispatcher) Deliveries() []DeliveryRecord {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]DeliveryRecord(nil), d.log...)
+}
+
+// send posts the signed event to the endpoint
+func (d *WebhookDispatcher) send(ctx context.Context, dl delivery) (int, error) {
+	e, ok := d.endpoint(dl)
+	if !ok {
+		return 0, errUnknownEndpoint
+	}
+
+	body, err := json.Marshal(dl.Event)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	ts := strconv.FormatInt(d.cfg.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Passkey-Event", dl.Event.Type)
+	req.Header.Set("X-Passkey-Delivery", dl.ID)
+	req.Header.Set("X-Passkey-Signature", "t="+ts+",v1="+SignWebhook(e.Secret, ts, body))
+
+	resp, err := d.cfg.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// errUnknownEndpoint is the error of a queued delivery whose endpoint is no longer configured
+var errUnknownEndpoint = errors.New("endpoint is no longer configured")
+
+// endpoint returns the endpoint the delivery was queued for, the queue may be older than the config
+func (d *WebhookDispatcher) endpoint(dl delivery) (WebhookEndpoint, bool) {
+	if dl.Endpoint < 0 || dl.Endpoint >= len(d.cfg.Endpoints) || d.cfg.Endpoints[dl.Endpoint].URL != dl.URL {
+		return WebhookEndpoint{}, false
+	}
+
+	return d.cfg.Endpoints[dl.Endpoint], true
+}
+
+// done records the attempt, removes the delivery or schedules the next attempt
+func (d *WebhookDispatcher) done(dl delivery, status int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	idx := -1
+	for i := range d.queue {
+		if d.queue[i].ID == dl.ID {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return
+	}
+
+	dl.Attempts++
+	rec := DeliveryRecord{
+		DeliveryID: dl.ID,
+		EventID:    dl.Event.ID,
+		EventType:  dl.Event.Type,
+		URL:        dl.URL,
+		Attempt:    dl.Attempts,
+		Status:     status,
+		Time:       d.cfg.Now().UTC(),
+	}
+
+	switch {
+	case err == nil:
+		rec.Outcome = "delivered"
+		d.queue = append(d.queue[:idx], d.queue[idx+1:]...)
+	case dl.Attempts >= d.cfg.MaxAttempts || errors.Is(err, errUnknownEndpoint):
+		rec.Outcome, rec.Error = "dropped", err.Error()
+		d.queue = append(d.queue[:idx], d.queue[idx+1:]...)
+		l.Printf("[ERRO] webhook %s to %s dropped after %d attempts: %s", dl.Event.Type, dl.URL, dl.Attempts, err)
+	default:
+		rec.Outcome, rec.Error = "retry", err.Error()
+		dl.NextAttempt = rec.Time.Add(d.backoff(dl.Attempts))
+		d.queue[idx] = dl
+		l.Printf("[WARN] webhook %s to %s failed, attempt %d: %s", dl.Event.Type, dl.URL, dl.Attempts, err)
+	}
+
+	d.persist()
+	d.record(rec)
+}
+
+// backoff is MinBackoff doubled for each failed attempt, capped at MaxBackoff
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	b := d.cfg.MinBackoff
+	for i := 1; i < attempts && b < d.cfg.MaxBackoff; i++ {
+		b *= 2
+	}
+	if b > d.cfg.MaxBackoff {
+		b = d.cfg.MaxBackoff
+	}
+
+	return b
+}
+
+// persist writes the queue to QueuePath, the caller must hold d.mu
+func (d *WebhookDispatcher) persist() {
+	if d.cfg.QueuePath == "" {
+		return
+	}
+
+	raw, err := json.Marshal(d.queue)
+	if err != nil {
+		l.Printf("[ERRO] can't marshal webhook queue: %s", err)
+
+		return
+	}
+
+	tmp := d.cfg.QueuePath + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+		l.Printf("[ERRO] can't write webhook queue: %s", err)
+
+		return
+	}
+	if err := os.Rename(tmp, d.cfg.QueuePath); err != nil {
+		l.Printf("[ERRO] can't write webhook queue: %s", err)
+	}
+}
+
+// record adds the attempt to the delivery log, the caller must hold d.mu
+func (d *WebhookDispatcher) record(rec DeliveryRecord) {
+	d.log = append(d.log, rec)
+	if len(d.log) > deliveryLogSize {
+		d.log = d.log[len(d.log)-deliveryLogSize:]
+	}
+
+	if d.cfg.LogPath == "" {
+		return
+	}
+
+	f, err := os.OpenFile(d.cfg.LogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		l.Printf("[ERRO] can't open webhook delivery log: %s", err)
+
+		return
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(rec); err != nil {
+		l.Printf("[ERRO] can't write webhook delivery log: %s", err)
+	}
+}
+
+// SignWebhook returns hex HMAC-SHA256 of "timestamp.body", receivers compute it with their copy of the
+// secret and compare it with the v1 part of the X-Passkey-Signature header
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// loadWebhookConfig reads the JSON config file at path
+func loadWebhookConfig(path string) (WebhookConfig, error) {
+	var cfg WebhookConfig
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("can't read webhook config: %w", err)
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return cfg, fmt.Errorf("can't parse webhook config: %w", err)
+	}
+
+	for _, e := range cfg.Endpoints {
+		if e.URL == "" || e.Secret == "" {
+			return cfg, errors.New("webhook endpoint needs url and secret")
+		}
+	}
+
+	return cfg, nil
+}
+
+// securityEvents emits webhook events from the ceremony hooks
+type securityEvents struct {
+	NopHooks
+
+	mu      sync.Mutex
+	devices map[string]bool // user, credential and user agent seen in a login
+	order   []string        // keys of devices, oldest first
+}
+
+// maxKnownDevices bounds the devices remembered for login.new_device, the oldest are forgotten first
+const maxKnownDevices = 100000
+
+func newSecurityEvents() *securityEvents {
+	return &securityEvents{devices: make(map[string]bool)}
+}
+
+func (s *securityEvents) AfterFinishRegistration(r *http.Request, user PasskeyUser, credential *webauthn.Credential) {
+	s.seen(r, user, credential)
+	webhooks.Emit(EventPasskeyAdded, user, credentialEventData(credential))
+}
+
+func (s *securityEvents) AfterFinishLogin(r *http.Request, user PasskeyUser, credential *webauthn.Credential) {
+	if !s.seen(r, user, credential) {
+		data := map[string]interface{}{}
+		if credential != nil {
+			data = credentialEventData(credential)
+		}
+		data["userAgent"] = r.UserAgent()
+		data["remoteAddr"] = r.RemoteAddr
+		webhooks.Emit(EventLoginNewDevice, user, data)
+	}
+}
+
+// seen remembers the device and reports whether it was already known, a login without passkey has no credential
+func (s *securityEvents) seen(r *http.Request, user PasskeyUser, credential *webauthn.Credential) bool {
+	var id []byte
+	if credential != nil {
+		id = credential.ID
+	}
+
+	h := sha256.New()
+	for _, p := range [][]byte{user.WebAuthnID(), id, []byte(r.UserAgent())} {
+		h.Write([]byte(strconv.Itoa(len(p))))
+		h.Write(p)
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.devices[key] {
+		return true
+	}
+
+	s.devices[key] = true
+	s.order = append(s.order, key)
+	if len(s.order) > maxKnownDevices {
+		delete(s.devices, s.order[0])
+		s.order = s.order[1:]
+	}
+
+	return false
+}
+
+// cloneWarning reports a passkey whose signature counter went backwards in the ceremony,
+// every ceremony that verifies an assertion goes through it
+func cloneWarning(user PasskeyUser, credential *webauthn.Credential, ceremony string) {
+	l.Printf("[WARN] clone warning for %s in %s: %s", user.WebAuthnName(), ceremony, encodeCredentialID(credential.ID))
+	metrics.cloneWarnings.Inc(ceremony)
+
+	data := credentialEventData(credential)
+	data["ceremony"] = ceremony
+	webhooks.Emit(EventCloneWarning, user, data)
+}
+
+// credentialEventData is a helper function to describe the credential in the event payload
+func credentialEventData(credential *webauthn.Credential) map[string]interface{} {
+	aaguid, _ := uuid.FromBytes(credential.Authenticator.AAGUID)
+
+	return map[string]interface{}{
+		"credentialId": encodeCredentialID(credential.ID),
+		"aaguid":       aaguid.String(),
+	}
+}
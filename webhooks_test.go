@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// webhookReceiver records the requests and answers with the queued status codes, then 200
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	path      string
+	event     string
+	delivery  string
+	signature string
+	body      []byte
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.requests = append(rc.requests, receivedWebhook{
+		path:      r.URL.Path,
+		event:     r.Header.Get("X-Passkey-Event"),
+		delivery:  r.Header.Get("X-Passkey-Delivery"),
+		signature: r.Header.Get("X-Passkey-Signature"),
+		body:      body,
+	})
+
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *webhookReceiver) received() []receivedWebhook {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return append([]receivedWebhook(nil), rc.requests...)
+}
+
+// verifyWebhook checks the signature header the way a receiver would
+func verifyWebhook(t *testing.T, secret string, rw receivedWebhook) {
+	t.Helper()
+
+	ts, sig, ok := strings.Cut(rw.signature, ",")
+	if !ok || !strings.HasPrefix(ts, "t=") || !strings.HasPrefix(sig, "v1=") {
+		t.Fatalf("malformed signature header %q", rw.signature)
+	}
+	if want := SignWebhook(secret, strings.TrimPrefix(ts, "t="), rw.body); strings.TrimPrefix(sig, "v1=") != want {
+		t.Fatalf("signature %q doesn't verify with the endpoint secret", rw.signature)
+	}
+}
+
+// fakeClock is a Now that only moves when the test advances it
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func newTestDispatcher(t *testing.T, cfg WebhookConfig) (*WebhookDispatcher, *fakeClock) {
+	t.Helper()
+
+	l = testLogger()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	cfg.Now = clock.Now
+
+	d, err := NewWebhookDispatcher(cfg)
+	if err != nil {
+		t.Fatalf("can't create dispatcher: %s", err)
+	}
+
+	return d, clock
+}
+
+func TestWebhookSigned(t *testing.T) {
+	rc := &webhookReceiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	user := &User{ID: []byte("alice-id"), Name: "alice"}
+
+	// two endpoints on the same URL, each delivery is signed with the secret of its own endpoint
+	d, _ := newTestDispatcher(t, WebhookConfig{Endpoints: []WebhookEndpoint{
+		{URL: srv.URL + "/hook", Secret: "first", Events: []string{EventPasskeyAdded}},
+		{URL: srv.URL + "/hook", Secret: "second", Events: []string{EventPasskeyRemoved}},
+	}})
+
+	d.Emit(EventPasskeyAdded, user, map[string]interface{}{"credentialId": "abc"})
+	d.Emit(EventPasskeyRemoved, user, nil)
+	d.Flush(context.Background())
+
+	got := rc.received()
+	if len(got) != 2 {
+		t.Fatalf("received %d webhooks, want 2", len(got))
+	}
+
+	secrets := map[string]string{EventPasskeyAdded: "first", EventPasskeyRemoved: "second"}
+	for _, rw := range got {
+		verifyWebhook(t, secrets[rw.event], rw)
+
+		var ev Event
+		if err := json.Unmarshal(rw.body, &ev); err != nil {
+			t.Fatalf("can't decode event: %s", err)
+		}
+		if ev.Type != rw.event || ev.User != "alice" || rw.delivery == "" {
+			t.Fatalf("unexpected event %+v with delivery %q", ev, rw.delivery)
+		}
+	}
+
+	if d.Pending() != 0 {
+		t.Fatalf("%d deliveries pending, want 0", d.Pending())
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	rc := &webhookReceiver{statuses: []int{http.StatusInternalServerError, http.StatusBadGateway}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d, clock := newTestDispatcher(t, WebhookConfig{
+		Endpoints:  []WebhookEndpoint{{URL: srv.URL, Secret: "s"}},
+		MinBackoff: time.Second,
+	})
+	d.Emit(EventCloneWarning, &User{ID: []byte("bob-id"), Name: "bob"}, nil)
+
+	// first attempt fails, the next one waits for 1s
+	d.Flush(context.Background())
+	d.Flush(context.Background())
+	if n := len(rc.received()); n != 1 {
+		t.Fatalf("%d attempts before the backoff elapsed, want 1", n)
+	}
+
+	// second attempt fails, the next one waits for 2s
+	clock.now = clock.now.Add(time.Second)
+	d.Flush(context.Background())
+	clock.now = clock.now.Add(time.Second)
+	d.Flush(context.Background())
+	if n := len(rc.received()); n != 2 {
+		t.Fatalf("%d attempts before the doubled backoff elapsed, want 2", n)
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	d.Flush(context.Background())
+
+	got := rc.received()
+	if len(got) != 3 {
+		t.Fatalf("%d attempts, want 3", len(got))
+	}
+	for _, rw := range got {
+		if rw.delivery != got[0].delivery {
+			t.Fatal("retries don't keep the delivery id")
+		}
+		verifyWebhook(t, "s", rw)
+	}
+
+	var outcomes []string
+	for _, rec := range d.Deliveries() {
+		outcomes = append(outcomes, rec.Outcome)
+	}
+	if strings.Join(outcomes, ",") != "retry,retry,delivered" {
+		t.Fatalf("outcomes %v, want retry,retry,delivered", outcomes)
+	}
+	if d.Pending() != 0 {
+		t.Fatalf("%d deliveries pending, want 0", d.Pending())
+	}
+}
+
+func TestWebhookDroppedAfterMaxAttempts(t *testing.T) {
+	rc := &webhookReceiver{statuses: []int{500, 500, 500}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d, clock := newTestDispatcher(t, WebhookConfig{
+		Endpoints:   []WebhookEndpoint{{URL: srv.URL, Secret: "s"}},
+		MaxAttempts: 2,
+	})
+	d.Emit(EventPasskeyAdded, &User{ID: []byte("bob-id"), Name: "bob"}, nil)
+
+	for i := 0; i < 3; i++ {
+		d.Flush(context.Background())
+		clock.now = clock.now.Add(time.Hour)
+	}
+
+	if n := len(rc.received()); n != 2 {
+		t.Fatalf("%d attempts, want 2", n)
+	}
+	log := d.Deliveries()
+	if len(log) != 2 || log[1].Outcome != "dropped" || log[1].Status != 500 {
+		t.Fatalf("unexpected delivery log %+v", log)
+	}
+	if d.Pending() != 0 {
+		t.Fatalf("%d deliveries pending, want 0", d.Pending())
+	}
+}
+
+func TestWebhookUnknownEndpointDropped(t *testing.T) {
+	rc := &webhookReceiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d, _ := newTestDispatcher(t, WebhookConfig{Endpoints: []WebhookEndpoint{{URL: srv.URL, Secret: "s"}}})
+
+	// a delivery queued for an endpoint that was removed from the config isn't sent unsigned
+	d.queue = append(d.queue, delivery{ID: "old", Endpoint: 0, URL: srv.URL + "/removed", Event: Event{Type: EventPasskeyAdded}})
+	d.Flush(context.Background())
+
+	if n := len(rc.received()); n != 0 {
+		t.Fatalf("%d webhooks sent to a removed endpoint", n)
+	}
+	if log := d.Deliveries(); len(log) != 1 || log[0].Outcome != "dropped" {
+		t.Fatalf("unexpected delivery log %+v", log)
+	}
+}
+
+func TestSecurityEventsBounded(t *testing.T) {
+	s := newSecurityEvents()
+	user := &User{ID: []byte("carol-id"), Name: "carol"}
+	cred := &webauthn.Credential{ID: []byte("carol-passkey")}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("User-Agent", "agent-first")
+	s.seen(r, user, cred)
+	for i := 0; i < maxKnownDevices; i++ {
+		r.Header.Set("User-Agent", "agent-"+strconv.Itoa(i))
+		s.seen(r, user, cred)
+	}
+
+	if len(s.devices) != maxKnownDevices || len(s.order) != maxKnownDevices {
+		t.Fatalf("%d devices remembered, want %d", len(s.devices), maxKnownDevices)
+	}
+
+	// the oldest device was forgotten, the newest is still known
+	r.Header.Set("User-Agent", "agent-first")
+	if s.seen(r, user, cred) {
+		t.Fatal("the oldest device is still remembered")
+	}
+	r.Header.Set("User-Agent", "agent-"+strconv.Itoa(maxKnownDevices-1))
+	if !s.seen(r, user, cred) {
+		t.Fatal("the newest device was forgotten")
+	}
+}